@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ArcSegment is the longest line, in mm, used to linearise an arc.
+const ArcSegment = 0.5
+
+// arcTracker follows positioning so that arcs can be converted.
+type arcTracker struct {
+	relative, relativeE bool
+	known               bool
+	position            map[rune]float64
+}
+
+func (t *arcTracker) target(code Code, axis rune) (float64, bool) {
+	value, ok := code.Float(axis)
+	if !ok {
+		return t.position[axis], false
+	}
+	if (axis == 'E' && t.relativeE) || (axis != 'E' && t.relative) {
+		return t.position[axis] + value, true
+	}
+	return value, true
+}
+
+func (t *arcTracker) track(code Code) {
+	switch code.GCode {
+	case "G90":
+		t.relative = false
+	case "G91":
+		t.relative = true
+	case "M82":
+		t.relativeE = false
+	case "M83":
+		t.relativeE = true
+	case "G28":
+		home := len(code.Parameters) == 0 || (code.Has('X') && code.Has('Y'))
+		for _, axis := range []rune{'X', 'Y', 'Z'} {
+			if len(code.Parameters) == 0 || code.Has(axis) {
+				t.position[axis] = 0
+			}
+		}
+		t.known = t.known || home
+	case "G92":
+		for _, axis := range []rune{'X', 'Y', 'Z', 'E'} {
+			if value, ok := code.Float(axis); ok {
+				t.position[axis] = value
+			}
+		}
+		t.known = t.known || (code.Has('X') && code.Has('Y'))
+	case "G0", "G1", "G2", "G3":
+		_, hasX := t.target(code, 'X')
+		_, hasY := t.target(code, 'Y')
+		for _, axis := range []rune{'X', 'Y', 'Z', 'E'} {
+			t.position[axis], _ = t.target(code, axis)
+		}
+		t.known = t.known || (!t.relative && hasX && hasY)
+	}
+}
+
+// linearise converts one G2/G3 from the tracked position into lines.
+func (t *arcTracker) linearise(arc Code, segment float64) ([]Code, error) {
+	if !t.known {
+		return nil, errors.New("arc from an unknown position")
+	}
+	if arc.Has('R') {
+		return nil, errors.New("arcs given by radius (R) can't be linearised")
+	}
+	i, _ := arc.Float('I')
+	j, _ := arc.Float('J')
+	startX, startY := t.position['X'], t.position['Y']
+	endX, _ := t.target(arc, 'X')
+	endY, _ := t.target(arc, 'Y')
+	endZ, hasZ := t.target(arc, 'Z')
+	endE, hasE := t.target(arc, 'E')
+	centreX, centreY := startX+i, startY+j
+	radius := math.Hypot(i, j)
+	if radius == 0 {
+		return nil, errors.New("arc with no radius")
+	}
+
+	start := math.Atan2(startY-centreY, startX-centreX)
+	sweep := math.Atan2(endY-centreY, endX-centreX) - start
+	if arc.GCode == "G2" && sweep >= 0 {
+		sweep -= 2 * math.Pi
+	} else if arc.GCode == "G3" && sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+	count := int(math.Max(1, math.Ceil(math.Abs(sweep)*radius/segment)))
+
+	startZ, startE := t.position['Z'], t.position['E']
+	previous := map[rune]float64{'X': startX, 'Y': startY, 'Z': startZ, 'E': startE}
+	lines := make([]Code, 0, count)
+	for step := 1; step <= count; step++ {
+		fraction := float64(step) / float64(count)
+		point := map[rune]float64{'X': endX, 'Y': endY, 'Z': startZ + (endZ-startZ)*fraction, 'E': startE + (endE-startE)*fraction}
+		if step < count {
+			angle := start + sweep*fraction
+			point['X'], point['Y'] = centreX+radius*math.Cos(angle), centreY+radius*math.Sin(angle)
+		}
+		params := make([]Param, 0, 5)
+		for _, axis := range []rune{'X', 'Y', 'Z', 'E'} {
+			if (axis == 'Z' && !hasZ) || (axis == 'E' && !hasE) {
+				continue
+			}
+			value := point[axis]
+			if (axis == 'E' && t.relativeE) || (axis != 'E' && t.relative) {
+				value -= previous[axis]
+			}
+			params = append(params, FloatParam(axis, value))
+		}
+		if feed, ok := arc.Parameter('F'); ok && step == 1 {
+			params = append(params, Param{'F', feed})
+		}
+		lines = append(lines, Move(params...))
+		previous = point
+	}
+	return lines, nil
+}
+
+// LineariseArcs replaces G2/G3 arcs with G1 lines no longer than segment,
+// for firmware built without arc support. Positions are followed from
+// the start of codes, which must establish where the arcs begin.
+func LineariseArcs(codes []Code, segment float64) ([]Code, error) {
+	tracker := &arcTracker{position: map[rune]float64{}}
+	lines := make([]Code, 0, len(codes))
+	for idx, code := range codes {
+		if code.GCode == "G2" || code.GCode == "G3" {
+			segments, err := tracker.linearise(code, segment)
+			if err != nil {
+				return nil, fmt.Errorf("code %d: %s", idx+1, err)
+			}
+			lines = append(lines, segments...)
+		} else {
+			lines = append(lines, code)
+		}
+		tracker.track(code)
+	}
+	return lines, nil
+}
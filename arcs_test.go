@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineariseArcs(t *testing.T) {
+	codes := []Code{
+		AbsolutePositioning(),
+		Home(),
+		Travel(FloatParam('X', 10), FloatParam('Y', 0)),
+		NewCode("G3", "", FloatParam('X', 0), FloatParam('Y', 10), FloatParam('I', -10), FloatParam('J', 0), FloatParam('E', 2), FloatParam('F', 600)),
+	}
+	lines, err := LineariseArcs(codes, 8)
+	assert.Nil(t, err)
+	// a quarter circle of radius 10 is 15.7mm, so two segments
+	assert.Equal(t, "G90 ;absolute positioning\nG28 ;home\nG0 X10 Y0 ;travel\n"+
+		"G1 X7.071 Y7.071 E1 F600 ;move\nG1 X0 Y10 E2 ;move", emitAll(lines))
+
+	codes[3].GCode = "G2"
+	lines, err = LineariseArcs(codes, 16)
+	assert.Nil(t, err)
+	// clockwise goes the long way round, 47.1mm
+	assert.Equal(t, "G1 X0 Y-10 E0.66667 F600 ;move\nG1 X-10 Y0 E1.33333 ;move\nG1 X0 Y10 E2 ;move", emitAll(lines[3:]))
+
+	_, err = LineariseArcs(codes[3:], 1)
+	assert.Equal(t, "code 1: arc from an unknown position", err.Error())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// BatchUserInterface runs REPL commands from a file or pipe without any
+// interaction, stopping at the first error so that it can be used from
+// cron jobs and Makefiles.
+type BatchUserInterface struct {
+	UserInterface
+	output io.Writer
+	errors io.Writer
+	closed bool
+
+	mutex   sync.Mutex
+	failure string // the first error reported while running
+}
+
+func NewBatchUserInterface(output io.Writer, errors io.Writer) *BatchUserInterface {
+	return &BatchUserInterface{output: output, errors: errors}
+}
+
+func (u *BatchUserInterface) Close() {
+	if !u.closed {
+		u.closed = true
+		u.UserInterface.Close()
+	}
+}
+
+func (u *BatchUserInterface) Write(text []byte) (count int, err error) {
+	return fmt.Fprintln(u.output, string(text))
+}
+
+func (u *BatchUserInterface) WriteString(text string) {
+	u.Write([]byte(text))
+}
+
+// Error may come from the printer at any time, e.g. a lost connection,
+// and fails the batch as much as a command's error does.
+func (u *BatchUserInterface) Error(text string) {
+	u.fail(text)
+	fmt.Fprintln(u.errors, "** Error: "+text)
+}
+
+func (u *BatchUserInterface) fail(text string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failure == "" {
+		u.failure = text
+	}
+}
+
+func (u *BatchUserInterface) failed() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failure == "" {
+		return nil
+	}
+	return errors.New(u.failure)
+}
+
+// Run executes each line of input in turn. A "quit" ends the batch
+// early; otherwise, once the input is exhausted, it waits for anything
+// still queued to reach the printer. Errors the printer reports stop it
+// too, after whichever line is running when they arrive.
+func (u *BatchUserInterface) Run(ctx Context, input io.Reader) error {
+	ctx.User = u
+	u.mutex.Lock()
+	u.failure = ""
+	u.mutex.Unlock()
+	if ctx.Printer != nil {
+		// the replies EventError reports, seen before their "ok" so that
+		// none is missed once the printer is idle; the printer's other
+		// errors come through Error
+		printer := ctx.Printer
+		cancel := printer.Watch(func(line string) {
+			if reply := printer.Dialect.Reply(line); reply.Kind == ReplyError || reply.Kind == ReplyRejected {
+				u.fail(reply.Text)
+			}
+		})
+		defer cancel()
+	}
+	scanner := bufio.NewScanner(input)
+	lineNo := 0
+	for scanner.Scan() && !u.closed {
+		lineNo++
+		if err := dispatch(ctx, strings.TrimRight(scanner.Text(), "\r\n \t")); err != nil {
+			return fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if err := u.failed(); err != nil {
+			return fmt.Errorf("after line %d: %s", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if ctx.Printer != nil {
+		if err := ctx.Printer.WaitForIdle(ctx.Timeout); err != nil {
+			return err
+		}
+	}
+	if err := u.failed(); err != nil {
+		return fmt.Errorf("after line %d: %s", lineNo, err)
+	}
+	return nil
+}
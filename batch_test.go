@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBatch() (*BatchUserInterface, *strings.Builder, *strings.Builder, Context) {
+	output, errors := &strings.Builder{}, &strings.Builder{}
+	ui := NewBatchUserInterface(output, errors)
+	ui.Start()
+	ctx := Context{User: ui, Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+	return ui, output, errors, ctx
+}
+
+func TestBatchRun(t *testing.T) {
+	ui, output, _, ctx := newBatch()
+	err := ui.Run(ctx, strings.NewReader("help\n\n# comment\n\"G28\r\nwait 0\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "> help\nThere's no help yet.\n> # comment\n> \"G28\n> wait 0\n", output.String())
+	assert.Equal(t, []string{"G28"}, drainRemote(ctx))
+}
+
+func TestBatchStopsOnError(t *testing.T) {
+	ui, output, _, ctx := newBatch()
+	err := ui.Run(ctx, strings.NewReader("help\nbogus\n\"G28\n"))
+	assert.EqualError(t, err, "line 2: No such command: bogus")
+	assert.Equal(t, "> help\nThere's no help yet.\n> bogus\n", output.String())
+	assert.Equal(t, 0, len(drainRemote(ctx)))
+
+	ui, _, _, ctx = newBatch()
+	err = ui.Run(ctx, strings.NewReader("wait temps\n"))
+	assert.EqualError(t, err, "line 1: 'wait': no printer connected")
+}
+
+func TestBatchQuit(t *testing.T) {
+	ui, _, _, ctx := newBatch()
+	assert.Nil(t, ui.Run(ctx, strings.NewReader("\"M1\nquit\n\"M2\n")))
+	assert.Equal(t, []string{"M1"}, drainRemote(ctx))
+}
+
+func TestBatchStopsOnPrinterError(t *testing.T) {
+	ui, _, _, ctx := newBatch()
+	host, device := net.Pipe()
+	ctx.Printer = NewPrinter(host, ui, ctx.Remote, time.Second)
+	simulate(device, func(line string) []string {
+		if line == "G99" {
+			return []string{"Error:Unknown command: \"G99\"", "ok"}
+		}
+		return []string{"ok"}
+	})
+	ctx.Printer.Start()
+	defer ctx.Printer.Close()
+
+	err := ui.Run(ctx, strings.NewReader("\"G28\n\"G99\n"))
+	assert.EqualError(t, err, "after line 2: Unknown command: \"G99\"")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marlin built with BINARY_FILE_TRANSFER takes uploads to the SD card as
+// packets after M28 B1, rather than as numbered lines of G-code:
+//
+//	token 0xB5AD, sync, protocol<<4|type, payload size, header checksum
+//	payload, checksum of the header and payload
+//
+// with every field little-endian and the checksums Fletcher-16, the
+// firmware keeping one running checksum over the whole packet. It
+// answers each packet with "ok<sync>", or "rs<sync>" to have it again.
+const binaryToken = 0xB5AD
+
+// Binary protocols and their packet types.
+const (
+	binaryControl  = 0
+	binaryTransfer = 1
+
+	controlSync  = 1
+	controlClose = 2 // back to G-code
+
+	transferQuery = 0
+	transferOpen  = 1
+	transferClose = 2
+	transferWrite = 3
+	transferAbort = 4
+)
+
+func fletcher16(data []byte) uint16 {
+	var low, high uint16
+	for _, b := range data {
+		low = (low + uint16(b)) % 255
+		high = (high + low) % 255
+	}
+	return high<<8 | low
+}
+
+// binaryPacket frames a payload; packets without one have no footer.
+func binaryPacket(sync, protocol, kind byte, payload []byte) []byte {
+	packet := make([]byte, 8, 10+len(payload))
+	binary.LittleEndian.PutUint16(packet, binaryToken)
+	packet[2] = sync
+	packet[3] = protocol<<4 | kind&0xF
+	binary.LittleEndian.PutUint16(packet[4:], uint16(len(payload)))
+	binary.LittleEndian.PutUint16(packet[6:], fletcher16(packet[:6]))
+	if len(payload) == 0 {
+		return packet
+	}
+	packet = append(packet, payload...)
+	checksum := fletcher16(packet)
+	return append(packet, byte(checksum), byte(checksum>>8))
+}
+
+// bitWriter packs bits most significant first.
+type bitWriter struct {
+	data  []byte
+	count uint
+}
+
+func (w *bitWriter) write(value, bits uint) {
+	for bit := bits; bit > 0; bit-- {
+		if w.count%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if value>>(bit-1)&1 == 1 {
+			w.data[len(w.data)-1] |= 0x80 >> (w.count % 8)
+		}
+		w.count++
+	}
+}
+
+// heatshrink compresses data for Marlin's heatshrink decoder: LZSS with
+// a window of 2^window bytes and matches of up to 2^lookahead. Each step
+// is a 1 bit then a literal byte, or a 0 bit then the distance back and
+// the length of a match, both less one.
+func heatshrink(data []byte, window, lookahead uint) []byte {
+	w := &bitWriter{data: make([]byte, 0, len(data)/2)}
+	maxDistance, maxLength := 1<<window, 1<<lookahead
+	for pos := 0; pos < len(data); {
+		length, distance := 0, 0
+		for back := 1; back <= maxDistance && back <= pos && length < maxLength; back++ {
+			match := 0
+			for match < maxLength && pos+match < len(data) && data[pos+match] == data[pos+match-back] {
+				match++
+			}
+			if match > length {
+				length, distance = match, back
+			}
+		}
+		// a match is only worth it if it's shorter than the literals
+		if 1+window+lookahead < 9*uint(length) {
+			w.write(0, 1)
+			w.write(uint(distance-1), window)
+			w.write(uint(length-1), lookahead)
+			pos += length
+			continue
+		}
+		w.write(1, 1)
+		w.write(uint(data[pos]), 8)
+		pos++
+	}
+	return w.data
+}
+
+// binarySession is a session with the firmware after M28 B1.
+type binarySession struct {
+	ctx      Context
+	lines    chan string
+	sync     byte
+	maxBlock int
+}
+
+// exchange sends a packet until the firmware accepts it. If a response
+// is expected, such as "PFT:" or "ss", it returns the rest of the line.
+func (s *binarySession) exchange(protocol, kind byte, payload []byte, response string) (string, error) {
+	packet := binaryPacket(s.sync, protocol, kind, payload)
+	aborted := s.ctx.Printer.Aborted()
+	for attempt := 0; attempt <= maxResends; attempt++ {
+		if err := s.ctx.Printer.writeRaw(packet); err != nil {
+			return "", err
+		}
+		acked, timeout := false, time.After(s.ctx.Timeout)
+	replies:
+		for {
+			select {
+			case <-aborted:
+				return "", errAborted
+			case <-timeout:
+				break replies
+			case line := <-s.lines:
+				switch {
+				case strings.HasPrefix(line, "ok"):
+					if sync, err := strconv.Atoi(line[2:]); err == nil && byte(sync) == s.sync && !acked {
+						acked = true
+						s.sync++
+						if response == "" {
+							return "", nil
+						}
+					}
+				case response != "" && strings.HasPrefix(line, response):
+					if !acked && response != "ss" {
+						// the "ok" was lost, but the response shows it arrived
+						s.sync++
+					}
+					return strings.TrimPrefix(line, response), nil
+				case strings.HasPrefix(line, "rs"):
+					if !acked {
+						break replies
+					}
+				case strings.HasPrefix(line, "fe"):
+					return "", fmt.Errorf("binary transfer failed: %s", strings.TrimPrefix(line, "fe"))
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("binary transfer failed: no reply after %d attempts", maxResends+1)
+}
+
+// connect synchronises with the firmware, which tells us the next sync
+// number it expects and how big a payload it takes, e.g. "ss0,512,0.1.0".
+func (s *binarySession) connect() error {
+	reply, err := s.exchange(binaryControl, controlSync, nil, "ss")
+	if err != nil {
+		return err
+	}
+	fields := strings.Split(reply, ",")
+	if len(fields) < 2 {
+		return fmt.Errorf("bad binary transfer sync: ss%s", reply)
+	}
+	sync, err1 := strconv.Atoi(fields[0])
+	maxBlock, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || maxBlock <= 0 {
+		return fmt.Errorf("bad binary transfer sync: ss%s", reply)
+	}
+	s.sync, s.maxBlock = byte(sync), maxBlock
+	return nil
+}
+
+// transfer sends a file transfer packet and checks its response, which
+// is "success" or a reason for failing such as "busy" or "ioerror".
+func (s *binarySession) transfer(kind byte, payload []byte) error {
+	reply, err := s.exchange(binaryTransfer, kind, payload, "PFT:")
+	if err != nil {
+		return err
+	}
+	if reply != "success" {
+		return fmt.Errorf("binary transfer failed: %s", reply)
+	}
+	return nil
+}
+
+// compression asks which the firmware can decompress, e.g.
+// "PFT:version:0.1:compression:heatshrink,8,4", returning its window
+// and lookahead, or 0s for none.
+func (s *binarySession) compression() (uint, uint, error) {
+	reply, err := s.exchange(binaryTransfer, transferQuery, nil, "PFT:")
+	if err != nil {
+		return 0, 0, err
+	}
+	parts := strings.SplitN(reply, ":compression:", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "heatshrink,") {
+		return 0, 0, nil
+	}
+	fields := strings.Split(strings.TrimPrefix(parts[1], "heatshrink,"), ",")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("bad binary transfer compression: %s", parts[1])
+	}
+	window, err1 := strconv.ParseUint(fields[0], 10, 4)
+	lookahead, err2 := strconv.ParseUint(fields[1], 10, 4)
+	if err1 != nil || err2 != nil || window == 0 || lookahead == 0 {
+		return 0, 0, fmt.Errorf("bad binary transfer compression: %s", parts[1])
+	}
+	return uint(window), uint(lookahead), nil
+}
+
+// UploadBinarySD writes data to a file on the SD card with Marlin's
+// binary file transfer, compressed if the firmware can decompress it.
+// It returns the number of bytes sent. As with UploadSD, nothing else
+// may be sent meanwhile.
+func UploadBinarySD(ctx Context, name string, data []byte) (int, error) {
+	if ctx.Printer == nil {
+		return 0, errNoPrinter
+	}
+	if name == "" || strings.ContainsRune(name, 0) {
+		return 0, errors.New("bad file name for binary transfer")
+	}
+	s := &binarySession{ctx: ctx, lines: make(chan string, 256)}
+	cancel := ctx.Printer.Watch(func(line string) {
+		select {
+		case s.lines <- line:
+		default:
+		}
+	})
+	defer cancel()
+	if _, err := queryCode(ctx, SDBinaryMode(), ctx.Timeout); err != nil {
+		return 0, err
+	}
+	// whatever happens, go back to G-code; there's no reply to wait for
+	defer func() {
+		ctx.Printer.writeRaw(binaryPacket(s.sync, binaryControl, controlClose, nil))
+	}()
+	if err := s.connect(); err != nil {
+		return 0, err
+	}
+	window, lookahead, err := s.compression()
+	if err != nil {
+		return 0, err
+	}
+	compressed := byte(0)
+	if window != 0 {
+		data, compressed = heatshrink(data, window, lookahead), 1
+	}
+	if err := s.transfer(transferOpen, append(append([]byte{0, compressed}, name...), 0)); err != nil {
+		return 0, err
+	}
+	for sent := 0; sent < len(data); sent += s.maxBlock {
+		end := sent + s.maxBlock
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := s.exchange(binaryTransfer, transferWrite, data[sent:end], ""); err != nil {
+			if err != errAborted {
+				s.transfer(transferAbort, nil)
+			}
+			return sent, err
+		}
+	}
+	return len(data), s.transfer(transferClose, nil)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryPackets(t *testing.T) {
+	assert.Equal(t, uint16(0xC8F0), fletcher16([]byte("abcde")))
+
+	packet := binaryPacket(3, binaryTransfer, transferWrite, []byte("G28"))
+	assert.Equal(t, []byte{0xAD, 0xB5, 3, 0x13, 3, 0}, packet[:6])
+	assert.Equal(t, fletcher16(packet[:6]), binary.LittleEndian.Uint16(packet[6:]))
+	// the footer covers the header too
+	assert.Equal(t, fletcher16(packet[:11]), binary.LittleEndian.Uint16(packet[11:]))
+	assert.Equal(t, 8, len(binaryPacket(0, binaryControl, controlSync, nil)))
+}
+
+// unheatshrink is the firmware's side of heatshrink.
+func unheatshrink(data []byte, window, lookahead uint) []byte {
+	bit, out := 0, []byte{}
+	read := func(count uint) (int, bool) {
+		if bit+int(count) > len(data)*8 {
+			return 0, false
+		}
+		value := 0
+		for ; count > 0; count-- {
+			value = value<<1 | int(data[bit/8]>>(7-bit%8)&1)
+			bit++
+		}
+		return value, true
+	}
+	for {
+		tag, ok := read(1)
+		if !ok {
+			return out
+		}
+		if tag == 1 {
+			literal, ok := read(8)
+			if !ok {
+				return out
+			}
+			out = append(out, byte(literal))
+			continue
+		}
+		index, ok1 := read(window)
+		count, ok2 := read(lookahead)
+		if !ok1 || !ok2 {
+			return out
+		}
+		for ; count >= 0; count-- {
+			out = append(out, out[len(out)-index-1])
+		}
+	}
+}
+
+func TestHeatshrink(t *testing.T) {
+	// a literal "a", then nine more copied from one back
+	assert.Equal(t, []byte{0xB0, 0x80, 0x20}, heatshrink([]byte("aaaaaaaaaa"), 8, 4))
+
+	gcode := []byte(strings.Repeat("G1 X10.5 Y20 E0.4\nG1 X12 Y21.25 E0.41\n", 50) + "M84\n")
+	for _, params := range [][2]uint{{8, 4}, {10, 5}, {4, 3}} {
+		compressed := heatshrink(gcode, params[0], params[1])
+		assert.Equal(t, gcode, unheatshrink(compressed, params[0], params[1]))
+		if params[0] >= 8 {
+			// the window covers the repeat
+			assert.True(t, len(compressed) < len(gcode)/4)
+		}
+	}
+	assert.Equal(t, []byte{}, heatshrink(nil, 8, 4))
+}
+
+// marlinChecksum adds a byte to a running checksum, as Marlin's
+// BinaryStream does for every byte of a packet it receives.
+func marlinChecksum(cs uint16, value byte) uint16 {
+	low := ((cs & 0xFF) + uint16(value)) % 255
+	return ((cs>>8)+low)%255<<8 | low
+}
+
+// binaryDevice acts as Marlin with BINARY_FILE_TRANSFER: it answers
+// G-code with "ok" until M28 B1, then takes packets until told to close.
+// The first write is asked for again, as though it were corrupted.
+type binaryDevice struct {
+	mutex   sync.Mutex
+	files   map[string][]byte
+	packets []string
+}
+
+func (d *binaryDevice) record(packet string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.packets = append(d.packets, packet)
+}
+
+func (d *binaryDevice) Packets() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.packets...)
+}
+
+func simulateBinary(conn net.Conn, compression string, maxBlock int) *binaryDevice {
+	d := &binaryDevice{files: make(map[string][]byte)}
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\n"))
+		}
+	}
+	go func() {
+		reader := bufio.NewReader(conn)
+		packets, sync, resent := false, byte(0), false
+		name, compressed, data := "", false, []byte{}
+		for {
+			if !packets {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				d.record(strings.TrimSpace(line))
+				if packets = strings.TrimSpace(line) == "M28 B1"; packets {
+					reply("echo:Switching to Binary Protocol")
+				}
+				reply("ok")
+				continue
+			}
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				return
+			}
+			payload := make([]byte, binary.LittleEndian.Uint16(header[4:]))
+			footer := make([]byte, 2)
+			if len(payload) > 0 {
+				io.ReadFull(reader, payload)
+				io.ReadFull(reader, footer)
+			}
+			// one checksum runs through the header and payload; the header's
+			// own is checked against it before its last two bytes
+			cs, headerCS := uint16(0), uint16(0)
+			for idx, value := range append(append([]byte{}, header...), payload...) {
+				if idx == 6 {
+					headerCS = cs
+				}
+				cs = marlinChecksum(cs, value)
+			}
+			if binary.LittleEndian.Uint16(header) != binaryToken || binary.LittleEndian.Uint16(header[6:]) != headerCS ||
+				(len(payload) > 0 && binary.LittleEndian.Uint16(footer) != cs) {
+				reply(fmt.Sprintf("rs%d", sync))
+				continue
+			}
+			protocol, kind := header[3]>>4, header[3]&0xF
+			d.record(fmt.Sprintf("%d:%d %d", protocol, kind, len(payload)))
+			switch {
+			case protocol == binaryControl && kind == controlSync:
+				reply(fmt.Sprintf("ss%d,%d,0.1.0", sync, maxBlock))
+				continue
+			case protocol == binaryControl && kind == controlClose:
+				packets = false
+				continue
+			case header[2] != sync, protocol == binaryTransfer && kind == transferWrite && !resent:
+				resent = true
+				reply(fmt.Sprintf("rs%d", sync))
+				continue
+			}
+			reply(fmt.Sprintf("ok%d", sync))
+			sync++
+			switch kind {
+			case transferQuery:
+				reply("PFT:version:0.1:compression:" + compression)
+			case transferOpen:
+				name, compressed, data = string(payload[2:len(payload)-1]), payload[1] == 1, []byte{}
+				reply("PFT:success")
+			case transferWrite:
+				data = append(data, payload...)
+			case transferClose:
+				if compressed {
+					data = unheatshrink(data, 8, 4)
+				}
+				d.mutex.Lock()
+				d.files[name] = data
+				d.mutex.Unlock()
+				reply("PFT:success")
+			}
+		}
+	}()
+	return d
+}
+
+func TestUploadBinarySD(t *testing.T) {
+	data := []byte(strings.Repeat("G1 X10 Y10 E0.5\nG1 X20 Y10 E1\n", 20))
+	for _, compression := range []string{"none", "heatshrink,8,4"} {
+		var simulated *binaryDevice
+		ctx, _ := newConnectedContext(t, func(conn net.Conn) { simulated = simulateBinary(conn, compression, 64) })
+
+		sent, err := UploadBinarySD(ctx, "cube.gco", data)
+		assert.Nil(t, err)
+		waitFor(t, func() bool {
+			return len(simulated.Packets()) > 0 && simulated.Packets()[len(simulated.Packets())-1] == "0:2 0"
+		})
+		simulated.mutex.Lock()
+		assert.Equal(t, data, simulated.files["cube.gco"], compression)
+		simulated.mutex.Unlock()
+
+		packets := simulated.Packets()
+		assert.Equal(t, []string{"M28 B1", "0:1 0", "1:0 0", "1:1 11"}, packets[:4])
+		writes := (sent + 63) / 64
+		// the first write was sent twice
+		assert.Equal(t, 1+writes, len(packets)-6, compression)
+		if compression == "none" {
+			assert.Equal(t, len(data), sent)
+		} else {
+			assert.True(t, sent < len(data)/4)
+		}
+		assert.Equal(t, []string{"1:2 0", "0:2 0"}, packets[len(packets)-2:])
+
+		// back to G-code
+		reply, err := ctx.Printer.Query("M105", time.Second)
+		assert.Nil(t, err)
+		assert.Empty(t, reply)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalibrationConfig describes the machine and filament the calibration
+// patterns are generated for; zero values take the defaults below.
+type CalibrationConfig struct {
+	BedX             float64 `json:"bed_x,omitempty"` // patterns are centred on the bed
+	BedY             float64 `json:"bed_y,omitempty"`
+	Nozzle           float64 `json:"nozzle,omitempty"`
+	FilamentDiameter float64 `json:"filament_diameter,omitempty"`
+	LayerHeight      float64 `json:"layer_height,omitempty"`
+	Hotend           uint    `json:"hotend,omitempty"`
+	Bed              uint    `json:"bed,omitempty"`
+	PrintFeed        float64 `json:"print_feed,omitempty"` // mm/min
+	TravelFeed       float64 `json:"travel_feed,omitempty"`
+	Retract          float64 `json:"retract,omitempty"` // mm
+	RetractFeed      float64 `json:"retract_feed,omitempty"`
+	SegmentHeight    float64 `json:"segment_height,omitempty"` // mm per step of a tower
+
+	TempHigh uint `json:"temp_high,omitempty"` // temperature tower, printed top down
+	TempLow  uint `json:"temp_low,omitempty"`
+	TempStep uint `json:"temp_step,omitempty"`
+
+	RetractMin  float64 `json:"retract_min,omitempty"` // retraction tower
+	RetractMax  float64 `json:"retract_max,omitempty"`
+	RetractStep float64 `json:"retract_step,omitempty"`
+
+	KStart float64 `json:"k_start,omitempty"` // linear advance, M900 K
+	KEnd   float64 `json:"k_end,omitempty"`
+	KStep  float64 `json:"k_step,omitempty"`
+
+	EStepsLength float64 `json:"esteps_length,omitempty"` // mm extruded
+	EStepsMark   float64 `json:"esteps_mark,omitempty"`   // mm marked on the filament
+	EStepsFeed   float64 `json:"esteps_feed,omitempty"`
+
+	PIDCycles int `json:"pid_cycles,omitempty"` // M303 C
+}
+
+func (c CalibrationConfig) withDefaults() CalibrationConfig {
+	if c.BedX == 0 {
+		c.BedX = 220
+	}
+	if c.BedY == 0 {
+		c.BedY = 220
+	}
+	if c.Nozzle == 0 {
+		c.Nozzle = 0.4
+	}
+	if c.FilamentDiameter == 0 {
+		c.FilamentDiameter = 1.75
+	}
+	if c.LayerHeight == 0 {
+		c.LayerHeight = 0.2
+	}
+	if c.PrintFeed == 0 {
+		c.PrintFeed = 1800
+	}
+	if c.TravelFeed == 0 {
+		c.TravelFeed = 6000
+	}
+	if c.Retract == 0 {
+		c.Retract = 0.8
+	}
+	if c.RetractFeed == 0 {
+		c.RetractFeed = 2100
+	}
+	if c.SegmentHeight == 0 {
+		c.SegmentHeight = 5
+	}
+	if c.RetractMax == 0 {
+		c.RetractMax = 2
+	}
+	if c.RetractStep == 0 {
+		c.RetractStep = 0.2
+	}
+	if c.KEnd == 0 {
+		c.KEnd = 0.1
+	}
+	if c.KStep == 0 {
+		c.KStep = 0.01
+	}
+	if c.EStepsLength == 0 {
+		c.EStepsLength = 100
+	}
+	if c.EStepsMark == 0 {
+		c.EStepsMark = 120
+	}
+	if c.EStepsFeed == 0 {
+		c.EStepsFeed = 100
+	}
+	if c.Hotend == 0 {
+		c.Hotend = 210
+	}
+	if c.Bed == 0 {
+		c.Bed = 60
+	}
+	if c.TempHigh == 0 {
+		c.TempHigh = 230
+	}
+	if c.TempLow == 0 {
+		c.TempLow = 190
+	}
+	if c.TempStep == 0 {
+		c.TempStep = 5
+	}
+	if c.PIDCycles == 0 {
+		c.PIDCycles = 8
+	}
+	return c
+}
+
+// Calibrations are the pattern generators by name.
+var Calibrations = map[string]func(CalibrationConfig) ([]Code, error){
+	"temperature": TemperatureTower,
+	"retraction":  RetractionTower,
+	"flow":        FlowCube,
+	"advance":     AdvancePattern,
+	"firstlayer":  FirstLayerGrid,
+	"esteps":      EStepsProgram,
+}
+
+// CalibrationNames lists the generators in Calibrations.
+func CalibrationNames() []string {
+	names := make([]string, 0, len(Calibrations))
+	for name := range Calibrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// calibration adds printing helpers to a Program.
+type calibration struct {
+	CalibrationConfig
+	*Program
+	retracted float64
+}
+
+func newCalibration(config CalibrationConfig) *calibration {
+	return &calibration{CalibrationConfig: config.withDefaults(), Program: NewProgram()}
+}
+
+// width of the extruded line
+func (c *calibration) width() float64 {
+	return c.Nozzle * 1.2
+}
+
+// extrusion is the filament needed per mm of line.
+func (c *calibration) extrusion() float64 {
+	radius := c.FilamentDiameter / 2
+	return c.width() * c.LayerHeight / (math.Pi * radius * radius)
+}
+
+func (c *calibration) centre() (x, y float64) {
+	return c.BedX / 2, c.BedY / 2
+}
+
+// start homes and heats up.
+func (c *calibration) start() {
+	c.Home().HeatBed(c.Bed).Heat(T0, c.Hotend).Wait().RelativeExtrusion()
+}
+
+// finish lifts clear of the print and turns everything off.
+func (c *calibration) finish() ([]Code, error) {
+	c.retract(c.Retract)
+	_, _, z, _ := c.Position()
+	c.Feed(c.TravelFeed).MoveZ(z + 10).Cool().Fan(0).Code(NewCode("M84", "motors off"))
+	return c.Codes()
+}
+
+func (c *calibration) layer(z float64) {
+	c.Feed(c.TravelFeed).MoveZ(z)
+}
+
+func (c *calibration) travel(x, y float64) {
+	if c.Distance(x, y) == 0 {
+		return
+	}
+	c.Feed(c.TravelFeed).MoveTo(x, y)
+}
+
+func (c *calibration) line(x, y, feed float64) {
+	c.unretract()
+	c.Feed(feed).LineTo(x, y, c.Distance(x, y)*c.extrusion())
+}
+
+// retract pulls the filament back before a travel; the next line
+// pushes it out again.
+func (c *calibration) retract(length float64) {
+	if c.retracted == 0 && length > 0 {
+		c.retracted = length
+		c.Feed(c.RetractFeed).Extrude(-length)
+	}
+}
+
+func (c *calibration) unretract() {
+	if c.retracted != 0 {
+		c.Feed(c.RetractFeed).Extrude(c.retracted)
+		c.retracted = 0
+	}
+}
+
+// square prints the outline of a square from its lower left corner.
+func (c *calibration) square(x, y, size float64) {
+	c.travel(x, y)
+	c.line(x+size, y, c.PrintFeed)
+	c.line(x+size, y+size, c.PrintFeed)
+	c.line(x, y+size, c.PrintFeed)
+	c.line(x, y, c.PrintFeed)
+}
+
+// fill prints a square solid with back and forth lines.
+func (c *calibration) fill(x, y, size float64) {
+	c.square(x, y, size)
+	step := c.width()
+	for row, ty := 0, y+step; ty < y+size; row, ty = row+1, ty+step {
+		from, to := x+step, x+size-step
+		if row%2 == 1 {
+			from, to = to, from
+		}
+		c.travel(from, ty)
+		c.line(to, ty, c.PrintFeed)
+	}
+}
+
+// layers is the number of layers in a tower segment.
+func (c *calibration) layers() int {
+	return int(math.Max(1, math.Round(c.SegmentHeight/c.LayerHeight)))
+}
+
+// steps counts the values from start to end inclusive.
+func steps(start, end, step float64) (int, error) {
+	if step <= 0 || end < start {
+		return 0, fmt.Errorf("invalid range %v to %v in steps of %v", start, end, step)
+	}
+	return int(math.Floor((end-start)/step+1e-9)) + 1, nil
+}
+
+// TemperatureTower prints a hollow tower, lowering the hotend
+// temperature by TempStep every SegmentHeight from TempHigh to TempLow.
+func TemperatureTower(config CalibrationConfig) ([]Code, error) {
+	c := newCalibration(config)
+	if c.TempHigh < c.TempLow {
+		return nil, fmt.Errorf("temp_high %d is below temp_low %d", c.TempHigh, c.TempLow)
+	}
+	c.Hotend = c.TempHigh
+	c.start()
+	const size = 20.0
+	cx, cy := c.centre()
+	layer := 0
+	for temp := int(c.TempHigh); temp >= int(c.TempLow); temp -= int(c.TempStep) {
+		if temp != int(c.TempHigh) {
+			c.Heat(T0, uint(temp)).Wait()
+		}
+		for idx := 0; idx < c.layers(); idx++ {
+			layer++
+			c.layer(float64(layer) * c.LayerHeight)
+			c.square(cx-size/2, cy-size/2, size)
+			c.square(cx-size/2+c.width(), cy-size/2+c.width(), size-2*c.width())
+		}
+	}
+	return c.finish()
+}
+
+// RetractionTower prints two pillars, retracting on every travel between
+// them and lengthening the retraction every SegmentHeight.
+func RetractionTower(config CalibrationConfig) ([]Code, error) {
+	c := newCalibration(config)
+	count, err := steps(c.RetractMin, c.RetractMax, c.RetractStep)
+	if err != nil {
+		return nil, err
+	}
+	c.start()
+	const size, gap = 10.0, 40.0
+	cx, cy := c.centre()
+	left, right := cx-gap/2-size, cx+gap/2
+	layer := 0
+	for step := 0; step < count; step++ {
+		retraction := c.RetractMin + float64(step)*c.RetractStep
+		for idx := 0; idx < c.layers(); idx++ {
+			layer++
+			c.layer(float64(layer) * c.LayerHeight)
+			c.square(left, cy-size/2, size)
+			c.retract(retraction)
+			c.square(right, cy-size/2, size)
+			c.retract(retraction)
+		}
+	}
+	return c.finish()
+}
+
+// FlowCube prints a single walled cube; compare the measured wall with
+// the line width to correct the flow.
+func FlowCube(config CalibrationConfig) ([]Code, error) {
+	c := newCalibration(config)
+	c.start()
+	const size = 20.0
+	cx, cy := c.centre()
+	for layer := 1; float64(layer)*c.LayerHeight <= size/2+1e-9; layer++ {
+		c.layer(float64(layer) * c.LayerHeight)
+		if layer <= 2 {
+			c.fill(cx-size/2, cy-size/2, size)
+		} else {
+			c.square(cx-size/2, cy-size/2, size)
+		}
+	}
+	return c.finish()
+}
+
+// AdvancePattern prints a line for each linear advance factor from
+// KStart to KEnd, each slow, fast then slow again; the best K gives the
+// most even line across the speed changes.
+func AdvancePattern(config CalibrationConfig) ([]Code, error) {
+	c := newCalibration(config)
+	count, err := steps(c.KStart, c.KEnd, c.KStep)
+	if err != nil {
+		return nil, err
+	}
+	c.start()
+	const spacing, length = 5.0, 80.0
+	cx, cy := c.centre()
+	x, y := cx-length/2, cy-float64(count-1)*spacing/2
+	slow, fast := c.PrintFeed/2, c.PrintFeed*2
+	c.layer(c.LayerHeight)
+	for step := 0; step < count; step++ {
+		k := c.KStart + float64(step)*c.KStep
+		c.Code(NewCode("M900", "linear advance", FloatParam('K', k)))
+		c.travel(x, y)
+		c.line(x+length/4, y, slow)
+		c.line(x+3*length/4, y, fast)
+		c.line(x+length, y, slow)
+		c.retract(c.Retract)
+		y += spacing
+	}
+	return c.finish()
+}
+
+// FirstLayerGrid prints a solid square at the centre and towards each
+// corner and edge of the bed to check the first layer's squish.
+func FirstLayerGrid(config CalibrationConfig) ([]Code, error) {
+	c := newCalibration(config)
+	c.start()
+	const size, margin = 30.0, 20.0
+	xs := []float64{margin, c.BedX/2 - size/2, c.BedX - margin - size}
+	ys := []float64{margin, c.BedY/2 - size/2, c.BedY - margin - size}
+	c.layer(c.LayerHeight)
+	for _, y := range ys {
+		for _, x := range xs {
+			c.fill(x, y, size)
+			c.retract(c.Retract)
+		}
+	}
+	return c.finish()
+}
+
+// EStepsProgram extrudes EStepsLength slowly with the filament marked
+// EStepsMark above the extruder; what remains of the mark shows how far
+// the filament really moved.
+func EStepsProgram(config CalibrationConfig) ([]Code, error) {
+	heat, extrude, err := eStepsStages(config)
+	return append(heat, extrude...), err
+}
+
+// heatTimeout allows for heating from cold.
+const heatTimeout = 10 * time.Minute
+
+// eStepsStages splits EStepsProgram into heating and extruding, so the
+// filament can be marked once it's soft.
+func eStepsStages(config CalibrationConfig) (heat, extrude []Code, err error) {
+	c := newCalibration(config)
+	if c.EStepsMark <= c.EStepsLength {
+		return nil, nil, fmt.Errorf("esteps_mark %v must be beyond esteps_length %v", c.EStepsMark, c.EStepsLength)
+	}
+	if heat, err = c.Heat(T0, c.Hotend).Wait().Codes(); err != nil {
+		return nil, nil, err
+	}
+	all, err := c.RelativeExtrusion().Feed(c.EStepsFeed).Extrude(c.EStepsLength).Code(FinishMoves()).Codes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return heat, all[len(heat):], nil
+}
+
+// CorrectSteps scales steps/mm by how far the filament should have
+// moved over how far it did.
+func CorrectSteps(steps, requested, actual float64) (float64, error) {
+	if actual <= 0 || steps <= 0 {
+		return 0, fmt.Errorf("can't correct %v steps/mm from %v mm extruded", steps, actual)
+	}
+	return steps * requested / actual, nil
+}
+
+// replyCode finds the echo of a code in the printer's reply, e.g.
+// "echo: M92 X80.00 Y80.00 Z400.00 E93.00".
+func replyCode(lines []string, gcode string) (Code, error) {
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "echo:"))
+		if strings.HasPrefix(line, gcode+" ") {
+			return ParseCode(line)
+		}
+	}
+	return Code{}, fmt.Errorf("no %s in the printer's reply", gcode)
+}
+
+// CalibrateESteps walks the user through measuring the extruder:
+// heat, mark the filament, extrude, measure what's left of the mark and
+// apply the corrected steps/mm.
+func CalibrateESteps(ctx Context) error {
+	config := ctx.Profile.Calibration.withDefaults()
+	heat, extrude, err := eStepsStages(config)
+	if err != nil {
+		return err
+	}
+	reply, err := queryCode(ctx, NewCode("M92", "get steps/mm"), ctx.Timeout)
+	if err != nil {
+		return err
+	}
+	m92, err := replyCode(reply, "M92")
+	if err != nil {
+		return err
+	}
+	steps, ok := m92.Float('E')
+	if !ok {
+		return errors.New("the printer didn't report E steps/mm")
+	}
+	ctx.User.WriteString(fmt.Sprintf("Current E steps/mm: %s", FormatFloat(steps, 2)))
+
+	if err := sendCodes(ctx, heat...); err != nil {
+		return err
+	}
+	if err := ctx.Printer.WaitForIdle(heatTimeout); err != nil {
+		return err
+	}
+	answer, err := prompt(ctx, fmt.Sprintf("Mark the filament %s mm above the extruder, then press enter (q to stop)", FormatFloat(config.EStepsMark, 1)))
+	if err != nil || stopped(answer) {
+		return err
+	}
+	if err := sendCodes(ctx, extrude...); err != nil {
+		return err
+	}
+	if err := ctx.Printer.WaitForIdle(heatTimeout); err != nil {
+		return err
+	}
+	answer, err = prompt(ctx, "How many mm of the mark are left above the extruder?")
+	if err != nil {
+		return err
+	}
+	remaining, err := strconv.ParseFloat(answer, 64)
+	if err != nil {
+		return err
+	}
+	corrected, err := CorrectSteps(steps, config.EStepsLength, config.EStepsMark-remaining)
+	if err != nil {
+		return err
+	}
+	ctx.User.WriteString(fmt.Sprintf("Extruded %s mm of %s, new E steps/mm: %s",
+		FormatFloat(config.EStepsMark-remaining, 2), FormatFloat(config.EStepsLength, 2), FormatFloat(corrected, 2)))
+	if apply, err := confirm(ctx, "Apply the new steps/mm?"); err != nil || !apply {
+		return err
+	}
+	if err := sendCodes(ctx, NewCode("M92", "set steps/mm", Param{'E', FormatFloat(corrected, 2)})); err != nil {
+		return err
+	}
+	if save, err := confirm(ctx, "Save to EEPROM?"); err != nil || !save {
+		return err
+	}
+	return sendCodes(ctx, NewCode("M500", "save settings"))
+}
+
+var flowRe = regexp.MustCompile(`Flow:\s*(\d+)%`)
+
+// CalibrateFlow corrects the flow rate (M221) from the wall thickness
+// measured on a FlowCube.
+func CalibrateFlow(ctx Context, measured float64) error {
+	width := newCalibration(ctx.Profile.Calibration).width()
+	if measured <= 0 {
+		return fmt.Errorf("invalid wall thickness %v", measured)
+	}
+	reply, err := queryCode(ctx, NewCode("M221", "get flow"), ctx.Timeout)
+	if err != nil {
+		return err
+	}
+	flow := 100.0
+	for _, line := range reply {
+		if match := flowRe.FindStringSubmatch(line); match != nil {
+			flow, _ = strconv.ParseFloat(match[1], 64)
+		}
+	}
+	corrected := int(math.Round(flow * width / measured))
+	ctx.User.WriteString(fmt.Sprintf("Wall should be %s mm, flow %d%% -> %d%%", FormatFloat(width, 2), int(flow), corrected))
+	if apply, err := confirm(ctx, "Apply the new flow?"); err != nil || !apply {
+		return err
+	}
+	return sendCodes(ctx, NewCode("M221", "set flow", IntParam('S', corrected)))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrationsBuild(t *testing.T) {
+	for _, name := range CalibrationNames() {
+		codes, err := Calibrations[name](CalibrationConfig{})
+		assert.Nil(t, err, name)
+		assert.NotEmpty(t, codes, name)
+	}
+}
+
+func TestTemperatureTower(t *testing.T) {
+	codes, err := TemperatureTower(CalibrationConfig{TempHigh: 220, TempLow: 210, TempStep: 5})
+	assert.Nil(t, err)
+	emitted := emitAll(codes)
+	assert.Contains(t, emitted, "M109 T0 S220 ;wait for tool temp")
+	assert.Contains(t, emitted, "M104 T0 S215 ;set tool temp")
+	assert.Contains(t, emitted, "M104 T0 S210 ;set tool temp")
+	// M109 S only waits while heating
+	assert.Contains(t, emitted, "M109 T0 R215 ;wait for tool to cool")
+	assert.Contains(t, emitted, "M109 T0 R210 ;wait for tool to cool")
+	assert.NotContains(t, emitted, "M109 T0 S215")
+	assert.NotContains(t, emitted, "M104 T0 S205 ;set tool temp")
+	// three segments of 25 layers
+	assert.Contains(t, emitted, "G0 Z15 F6000 ;travel")
+	assert.NotContains(t, emitted, "G0 Z15.2 F6000 ;travel")
+
+	_, err = TemperatureTower(CalibrationConfig{TempHigh: 200, TempLow: 210})
+	assert.NotNil(t, err)
+}
+
+func TestAdvancePattern(t *testing.T) {
+	codes, err := AdvancePattern(CalibrationConfig{KStart: 0.1, KEnd: 0.3, KStep: 0.1})
+	assert.Nil(t, err)
+	sweep := []string{}
+	for _, code := range codes {
+		if code.GCode == "M900" {
+			sweep = append(sweep, code.Emit(0))
+		}
+	}
+	assert.Equal(t, []string{"M900 K0.1 ;linear advance", "M900 K0.2 ;linear advance", "M900 K0.3 ;linear advance"}, sweep)
+
+	_, err = AdvancePattern(CalibrationConfig{KStart: 0.2, KEnd: 0.1})
+	assert.NotNil(t, err)
+}
+
+func TestRetractionTower(t *testing.T) {
+	codes, err := RetractionTower(CalibrationConfig{RetractMin: 1, RetractMax: 2, RetractStep: 1, SegmentHeight: 0.2})
+	assert.Nil(t, err)
+	emitted := emitAll(codes)
+	assert.Contains(t, emitted, "G1 E-1 F2100 ;move")
+	assert.Contains(t, emitted, "G1 E2 F2100 ;move")
+}
+
+func TestEStepsProgram(t *testing.T) {
+	codes, err := EStepsProgram(CalibrationConfig{Hotend: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"M104 T0 S200 ;set tool temp",
+		"M109 T0 S200 ;wait for tool temp",
+		"M83 ;relative extrusion",
+		"G1 E100 F100 ;move",
+		"M400 ;finish moves",
+	}, "\n"), emitAll(codes))
+
+	_, err = EStepsProgram(CalibrationConfig{EStepsLength: 100, EStepsMark: 90})
+	assert.NotNil(t, err)
+}
+
+func TestCalibrateCommand(t *testing.T) {
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+	path := filepath.Join(t.TempDir(), "esteps.gcode")
+
+	assert.Nil(t, dispatch(ctx, "calibrate esteps -o "+path))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "M104 T0 S210 ;set tool temp\n"))
+	assert.Empty(t, drainRemote(ctx))
+
+	assert.NotNil(t, dispatch(ctx, "calibrate nonsense"))
+}
+
+func TestCorrectSteps(t *testing.T) {
+	steps, err := CorrectSteps(93, 100, 98)
+	assert.Nil(t, err)
+	assert.InDelta(t, 94.898, steps, 0.001)
+	_, err = CorrectSteps(93, 100, 0)
+	assert.NotNil(t, err)
+}
+
+func TestCalibrateESteps(t *testing.T) {
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if line == "M92" {
+			return []string{"echo: M92 X80.00 Y80.00 Z400.00 E93.00", "ok"}
+		}
+		return []string{"ok"}
+	})
+
+	for _, answer := range []string{"", "22", "y", "n"} {
+		ui.Commands() <- Command{answer, ui}
+	}
+	assert.Nil(t, dispatch(ctx, "calibrate esteps"))
+	assert.Contains(t, ui.Lines(), "Extruded 98 mm of 100, new E steps/mm: 94.9")
+	waitFor(t, func() bool { return len(received()) == 7 })
+	assert.Equal(t, []string{"M92", "M104 T0 S210", "M109 T0 S210", "M83", "G1 E100 F100", "M400", "M92 E94.9"}, received())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -13,6 +14,56 @@ type Param struct {
 	Value string
 }
 
+// DefaultPrecision is the number of decimal places used for float
+// parameters whose key has no entry in ParamPrecision.
+const DefaultPrecision = 4
+
+// ParamPrecision gives the decimal places used for float parameters by
+// key; trailing zeros are trimmed so these are upper bounds.
+var ParamPrecision = map[rune]int{
+	'X': 3, 'Y': 3, 'Z': 3,
+	'I': 3, 'J': 3, 'R': 3,
+	'E': 5,
+	'F': 1,
+}
+
+// FormatFloat renders a value with at most precision decimal places,
+// trimming trailing zeros and independent of locale ("12.5", not "12,50").
+func FormatFloat(value float64, precision int) string {
+	text := strconv.FormatFloat(value, 'f', precision, 64)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	if text == "-0" {
+		return "0"
+	}
+	return text
+}
+
+func precisionOf(key rune) int {
+	if precision, ok := ParamPrecision[unicode.ToUpper(key)]; ok {
+		return precision
+	}
+	return DefaultPrecision
+}
+
+func FloatParam(key rune, value float64) Param {
+	return Param{unicode.ToUpper(key), FormatFloat(value, precisionOf(key))}
+}
+
+func IntParam(key rune, value int) Param {
+	return Param{unicode.ToUpper(key), strconv.Itoa(value)}
+}
+
+// FlagParam is a key without a value, such as the axes in "G28 X Y".
+func FlagParam(key rune) Param {
+	return Param{unicode.ToUpper(key), ""}
+}
+
+func StringParam(key rune, value string) Param {
+	return Param{unicode.ToUpper(key), value}
+}
+
 func getRune(param interface{}) rune {
 	switch typedval := param.(type) {
 	case rune:
@@ -50,10 +101,26 @@ func NewParamArray(params ...interface{}) (parameters []Param) {
 		case bool:
 			{
 				if value {
-					parameters = append(parameters, Param{key, ""})
+					parameters = append(parameters, FlagParam(key))
 				}
 				continue
 			}
+		case float64:
+			{
+				parameters = append(parameters, FloatParam(key, value))
+			}
+		case float32:
+			{
+				parameters = append(parameters, FloatParam(key, float64(value)))
+			}
+		case int:
+			{
+				parameters = append(parameters, IntParam(key, value))
+			}
+		case string:
+			{
+				parameters = append(parameters, StringParam(key, value))
+			}
 		default:
 			{
 				parameters = append(parameters, Param{key, fmt.Sprint(value)})
@@ -84,6 +151,38 @@ func NewCode(gcode string, comment string, params ...Param) Code {
 	return code
 }
 
+// ParseCode reads a line of G-code such as "N12 G1 X10 E0.5*87 ;move",
+// as sent to or echoed back by the printer.
+func ParseCode(line string) (Code, error) {
+	var code Code
+	if idx := strings.IndexRune(line, ';'); idx >= 0 {
+		code.Comment = strings.TrimSpace(line[idx+1:])
+		line = line[:idx]
+	}
+	if idx := strings.IndexRune(line, '*'); idx >= 0 {
+		line = line[:idx]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 && len(fields[0]) > 1 && unicode.ToUpper(rune(fields[0][0])) == 'N' {
+		lineNo, err := strconv.ParseUint(fields[0][1:], 10, 32)
+		if err != nil {
+			return Code{}, fmt.Errorf("Invalid line number: %s", fields[0])
+		}
+		code.LineNo = uint(lineNo)
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || !unicode.IsLetter(rune(fields[0][0])) {
+		return Code{}, fmt.Errorf("Not a G-code: %s", line)
+	}
+	code.GCode = strings.ToUpper(fields[0])
+	for _, field := range fields[1:] {
+		if err := code.Override(rune(field[0]), field[1:]); err != nil {
+			return Code{}, err
+		}
+	}
+	return code, nil
+}
+
 func GCodeChecksum(code string) int {
 	sum := 0
 	for _, c := range code {
@@ -92,11 +191,36 @@ func GCodeChecksum(code string) int {
 	return sum & 255
 }
 
+// CanonicalOrder is the order parameters are sorted into by Canonical:
+// axes first, then arc offsets, extrusion and feedrate. Keys not listed
+// follow in alphabetical order.
+const CanonicalOrder = "XYZABCUVWIJKRDEF"
+
+func canonicalRank(key rune) int {
+	if idx := strings.IndexRune(CanonicalOrder, key); idx >= 0 {
+		return idx
+	}
+	return len(CanonicalOrder) + int(key)
+}
+
+// Canonical returns a copy with the parameters in canonical order, so
+// that equivalent codes emit identically.
+func (c Code) Canonical() Code {
+	c.Parameters = append([]Param(nil), c.Parameters...)
+	sort.SliceStable(c.Parameters, func(i, j int) bool {
+		return canonicalRank(c.Parameters[i].Key) < canonicalRank(c.Parameters[j].Key)
+	})
+	return c
+}
+
+// Equal compares the code and its parameters, regardless of the order
+// the parameters were given in.
 func (lhs Code) Equal(rhs Code) bool {
-	return lhs.GCode == rhs.GCode && reflect.DeepEqual(lhs.Parameters, rhs.Parameters)
+	return lhs.GCode == rhs.GCode && reflect.DeepEqual(lhs.Canonical().Parameters, rhs.Canonical().Parameters)
 }
 
 func (c Code) Parameter(key rune) (value string, ok bool) {
+	key = unicode.ToUpper(key)
 	for _, param := range c.Parameters {
 		if param.Key == key {
 			return param.Value, true
@@ -105,28 +229,91 @@ func (c Code) Parameter(key rune) (value string, ok bool) {
 	return "", false
 }
 
+func (c Code) Has(key rune) bool {
+	_, ok := c.Parameter(key)
+	return ok
+}
+
+// HasFlag reports whether the key is present without a value, as in "G28 X".
+func (c Code) HasFlag(key rune) bool {
+	value, ok := c.Parameter(key)
+	return ok && value == ""
+}
+
+func (c Code) Float(key rune) (value float64, ok bool) {
+	text, ok := c.Parameter(key)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	return value, err == nil
+}
+
+func (c Code) Int(key rune) (value int, ok bool) {
+	text, ok := c.Parameter(key)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.Atoi(text)
+	return value, err == nil
+}
+
+// Override replaces the value of an existing parameter, keeping its
+// position, or appends it if the code doesn't have it yet. Copies of a
+// Code share parameters, so they are copied before being changed.
 func (c *Code) Override(key rune, value string) error {
 	key = unicode.ToUpper(key)
 	if !unicode.IsLetter(key) {
 		return fmt.Errorf("Invalid key: %c", key)
 	}
-	for _, param := range c.Parameters {
-		if param.Key == key {
-			param.Value = value
+	for idx := range c.Parameters {
+		if c.Parameters[idx].Key == key {
+			c.Parameters = append([]Param(nil), c.Parameters...)
+			c.Parameters[idx].Value = value
 			return nil
 		}
 	}
-	c.Parameters = append(c.Parameters, Param{key, value})
+	count := len(c.Parameters)
+	c.Parameters = append(c.Parameters[:count:count], Param{key, value})
+	return nil
+}
+
+// Set overrides several parameters at once; new keys are appended in
+// the order given.
+func (c *Code) Set(params ...Param) error {
+	for _, param := range params {
+		if err := c.Override(param.Key, param.Value); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Remove deletes a parameter, reporting whether it was present.
+func (c *Code) Remove(key rune) bool {
+	key = unicode.ToUpper(key)
+	for idx, param := range c.Parameters {
+		if param.Key == key {
+			c.Parameters = append(c.Parameters[:idx:idx], c.Parameters[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Code) Emit(lineNo uint) string {
+	return c.EmitAs(Marlin, lineNo)
+}
+
+// EmitAs renders the code for a dialect; codes that set the line number
+// aren't numbered themselves.
+func (c *Code) EmitAs(dialect Dialect, lineNo uint) string {
 	// Max atoms will be:
 	//  Nxxx    line number
 	//  Mxxx    code
 	//  kxxx    parameter
 	atoms := make([]string, 0, 1+1+len(c.Parameters))
-	if lineNo > 0 && c.GCode != "M110" {
+	if lineNo > 0 && !dialect.SetsLineNumber(*c) {
 		atoms = append(atoms, fmt.Sprintf("N%d", lineNo))
 	}
 	atoms = append(atoms, c.GCode)
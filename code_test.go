@@ -112,3 +112,116 @@ func TestGCodeEmitCommentAndParamsLineNo(t *testing.T) {
 	code.HideChecksum = false
 	assert.Equal(t, "N1844674407379551617 M123 A111 B234 Z935*98 ;the comment", code.Emit(1844674407379551617))
 }
+
+func TestFormatFloat(t *testing.T) {
+	assert.Equal(t, "12.345", FormatFloat(12.3450000001, 3))
+	assert.Equal(t, "12.35", FormatFloat(12.345, 2))
+	assert.Equal(t, "12", FormatFloat(12.0004, 3))
+	assert.Equal(t, "120", FormatFloat(120, 3))
+	assert.Equal(t, "120", FormatFloat(119.96, 0))
+	assert.Equal(t, "0", FormatFloat(-0.0001, 3))
+	assert.Equal(t, "-0.5", FormatFloat(-0.5, 3))
+}
+
+func TestTypedParams(t *testing.T) {
+	assert.Equal(t, Param{'X', "12.345"}, FloatParam('x', 12.3450000001))
+	assert.Equal(t, Param{'E', "0.12346"}, FloatParam('E', 0.123456789))
+	assert.Equal(t, Param{'F', "1500"}, FloatParam('F', 1500.04))
+	assert.Equal(t, Param{'S', "0.3333"}, FloatParam('S', 1.0/3))
+	assert.Equal(t, Param{'P', "-42"}, IntParam('p', -42))
+	assert.Equal(t, Param{'X', ""}, FlagParam('x'))
+	assert.Equal(t, Param{'M', "hello"}, StringParam('m', "hello"))
+
+	saved := ParamPrecision['E']
+	ParamPrecision['E'] = 2
+	defer func() { ParamPrecision['E'] = saved }()
+	assert.Equal(t, Param{'E', "0.12"}, FloatParam('E', 0.123456789))
+}
+
+func TestNewParamArrayTyped(t *testing.T) {
+	actual := NewParamArray('x', 0.1+0.2, 'e', float32(1.5), 'p', -3, 'f', 1200.0, 'o', true, 'k', false)
+	expected := []Param{{'X', "0.3"}, {'E', "1.5"}, {'P', "-3"}, {'F', "1200"}, {'O', ""}}
+	assert.Equal(t, expected, actual)
+}
+
+func TestGCodeOverrideExisting(t *testing.T) {
+	code := NewCode("G1", "", Param{'X', "1"}, Param{'Y', "2"})
+	assert.Nil(t, code.Override('x', "10"))
+	assert.Equal(t, []Param{{'X', "10"}, {'Y', "2"}}, code.Parameters)
+
+	// repeated keys given to NewCode override rather than duplicate
+	code = NewCode("G1", "", Param{'X', "1"}, Param{'X', "3"})
+	assert.Equal(t, []Param{{'X', "3"}}, code.Parameters)
+
+	assert.NotNil(t, code.Override('1', "3"))
+}
+
+func TestGCodeSetAndRemove(t *testing.T) {
+	code := NewCode("G1", "", Param{'X', "1"}, Param{'Y', "2"}, Param{'Z', "3"})
+	original := code.Parameters
+
+	assert.Nil(t, code.Set(Param{'F', "100"}, Param{'y', "5"}, Param{'E', "1"}))
+	assert.Equal(t, []Param{{'X', "1"}, {'Y', "5"}, {'Z', "3"}, {'F', "100"}, {'E', "1"}}, code.Parameters)
+
+	assert.True(t, code.Remove('y'))
+	assert.False(t, code.Remove('Y'))
+	assert.Equal(t, []Param{{'X', "1"}, {'Z', "3"}, {'F', "100"}, {'E', "1"}}, code.Parameters)
+	assert.Equal(t, Param{'Y', "2"}, original[1])
+}
+
+func TestGCodeTypedGetters(t *testing.T) {
+	code := NewCode("G1", "", NewParamArray('x', 12.5, 'y', "abc", 's', 200, 'o', true)...)
+	assert.True(t, code.Has('x'))
+	assert.False(t, code.Has('z'))
+	assert.True(t, code.HasFlag('O'))
+	assert.False(t, code.HasFlag('X'))
+	assert.False(t, code.HasFlag('Z'))
+
+	x, ok := code.Float('X')
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, x)
+	_, ok = code.Float('Y')
+	assert.False(t, ok)
+	_, ok = code.Float('Z')
+	assert.False(t, ok)
+
+	s, ok := code.Int('s')
+	assert.True(t, ok)
+	assert.Equal(t, 200, s)
+	_, ok = code.Int('X')
+	assert.False(t, ok)
+}
+
+func TestGCodeCanonical(t *testing.T) {
+	code := NewCode("G1", "", NewParamArray('s', 1, 'f', 1200, 'e', 2, 'y', 3, 'x', 4, 'a', 5)...)
+	canonical := code.Canonical()
+	assert.Equal(t, "G1 X4 Y3 A5 E2 F1200 S1", canonical.Emit(0))
+	// the original is left untouched
+	assert.Equal(t, "G1 S1 F1200 E2 Y3 X4 A5", code.Emit(0))
+
+	assert.True(t, code.Equal(code.Canonical()))
+	assert.True(t, NewCode("G1", "", Param{'X', "1"}, Param{'Y', "2"}).Equal(NewCode("G1", "", Param{'Y', "2"}, Param{'X', "1"})))
+	assert.False(t, NewCode("G1", "", Param{'X', "1"}, Param{'Y', "2"}).Equal(NewCode("G1", "", Param{'Y', "1"}, Param{'X', "2"})))
+}
+
+func TestParseCode(t *testing.T) {
+	code, err := ParseCode("N12 g1 x10 E0.5 F1200*87 ; extrude ")
+	assert.Nil(t, err)
+	assert.Equal(t, Code{GCode: "G1", Comment: "extrude", LineNo: 12,
+		Parameters: []Param{{'X', "10"}, {'E', "0.5"}, {'F', "1200"}}}, code)
+
+	code, err = ParseCode("M92 X80.00 Y80.00 Z400.00 E93.00")
+	assert.Nil(t, err)
+	steps, ok := code.Float('E')
+	assert.True(t, ok)
+	assert.Equal(t, 93.0, steps)
+
+	code, err = ParseCode("G28 X Y")
+	assert.Nil(t, err)
+	assert.True(t, code.HasFlag('Y'))
+
+	_, err = ParseCode("; just a comment")
+	assert.NotNil(t, err)
+	_, err = ParseCode("Nxx G1")
+	assert.NotNil(t, err)
+}
@@ -1,5 +1,16 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
 func cmd_quit(ctx Context) error {
 	ctx.User.Close()
 	return nil
@@ -9,3 +20,657 @@ func cmd_help(ctx Context) error {
 	ctx.User.WriteString("There's no help yet.")
 	return nil
 }
+
+func cmd_shutdown(ctx Context) error {
+	ctx.Host.Close()
+	return nil
+}
+
+func cmd_macro(ctx Context) error {
+	if len(ctx.Argv) == 0 {
+		return errors.New("usage: macro define|show|list|delete ...")
+	}
+	switch ctx.Argv[0] {
+	case "define":
+		if len(ctx.Argv) < 2 {
+			return errors.New("usage: macro define <name> [param[=default]...] : <line> [| <line>...]")
+		}
+		name := ctx.Argv[1]
+		if _, ok := commands[name]; ok {
+			return fmt.Errorf("can't define %s: it's a built-in command, which would always run instead", name)
+		}
+		macro, err := ParseMacro(strings.Join(ctx.Argv[2:], " "))
+		if err != nil {
+			return err
+		}
+		ctx.Profile.Macros[name] = macro
+	case "show":
+		for _, name := range ctx.Argv[1:] {
+			macro, ok := ctx.Profile.Macros[name]
+			if !ok {
+				return fmt.Errorf("no such macro: %s", name)
+			}
+			ctx.User.WriteString(name + " " + macro.String())
+		}
+	case "list":
+		names := make([]string, 0, len(ctx.Profile.Macros))
+		for name := range ctx.Profile.Macros {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ctx.User.WriteString(name + " " + ctx.Profile.Macros[name].String())
+		}
+	case "delete":
+		for _, name := range ctx.Argv[1:] {
+			delete(ctx.Profile.Macros, name)
+		}
+	default:
+		return fmt.Errorf("unknown macro operation: %s", ctx.Argv[0])
+	}
+	return nil
+}
+
+func cmd_profile(ctx Context) error {
+	if len(ctx.Argv) != 1 || ctx.Argv[0] != "save" {
+		return errors.New("usage: profile save")
+	}
+	return ctx.Profile.Save()
+}
+
+func cmd_script(ctx Context) error {
+	if len(ctx.Argv) == 0 {
+		return errors.New("usage: script run <file>... | hooks | clear")
+	}
+	switch ctx.Argv[0] {
+	case "run":
+		for _, filename := range ctx.Argv[1:] {
+			if err := ctx.Scripts.ExecFile(ctx, filename); err != nil {
+				return err
+			}
+		}
+	case "hooks":
+		for _, hook := range ctx.Scripts.Hooks() {
+			ctx.User.WriteString(hook)
+		}
+	case "clear":
+		ctx.Scripts.ClearHooks()
+	default:
+		return fmt.Errorf("unknown script operation: %s", ctx.Argv[0])
+	}
+	return nil
+}
+
+// parseTimeout accepts a Go duration ("90s", "10m") or plain seconds.
+func parseTimeout(text string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(text)
+}
+
+func cmd_wait(ctx Context) error {
+	if len(ctx.Argv) == 0 {
+		return errors.New("usage: wait temps [tolerance] [timeout] | idle [timeout] | <duration>")
+	}
+	if ctx.Argv[0] != "temps" && ctx.Argv[0] != "idle" {
+		delay, err := parseTimeout(ctx.Argv[0])
+		if err != nil {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+			return nil
+		case <-ctx.Aborted:
+			return errAborted
+		}
+	}
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+
+	timeout := ctx.Timeout
+	if ctx.Argv[0] == "idle" {
+		if len(ctx.Argv) > 1 {
+			var err error
+			if timeout, err = parseTimeout(ctx.Argv[1]); err != nil {
+				return err
+			}
+		}
+		return ctx.Printer.WaitForIdle(timeout)
+	}
+
+	tolerance := 2.0
+	if len(ctx.Argv) > 1 {
+		var err error
+		if tolerance, err = strconv.ParseFloat(ctx.Argv[1], 64); err != nil {
+			return err
+		}
+	}
+	if len(ctx.Argv) > 2 {
+		var err error
+		if timeout, err = parseTimeout(ctx.Argv[2]); err != nil {
+			return err
+		}
+	}
+	return ctx.Printer.WaitForTemperatures(tolerance, timeout)
+}
+
+func cmd_tool(ctx Context) error {
+	if len(ctx.Argv) != 1 {
+		return errors.New("usage: tool <index> | setup | current")
+	}
+	switch ctx.Argv[0] {
+	case "setup":
+		return sendCodes(ctx, ctx.Tools.Setup()...)
+	case "current":
+		ctx.User.WriteString(fmt.Sprintf("Tool %d", ctx.Tools.Current()))
+		return nil
+	}
+	tool, err := strconv.ParseUint(ctx.Argv[0], 10, 32)
+	if err != nil {
+		return err
+	}
+	codes, err := ctx.Tools.Change(ToolId(tool))
+	if err != nil {
+		return err
+	}
+	return sendCodes(ctx, codes...)
+}
+
+// probeTimeout allows for probing a large grid, which Marlin only
+// acknowledges once it has finished.
+const probeTimeout = 10 * time.Minute
+
+func cmd_mesh(ctx Context) error {
+	if len(ctx.Argv) == 0 {
+		return errors.New("usage: mesh probe [G29 args] | report | show | save <name> | load <name> | list | delete <name>")
+	}
+	dialect := dialectOf(ctx)
+	switch ctx.Argv[0] {
+	case "probe", "report", "load":
+		// without a report there's no telling what the mesh is, so don't
+		// probe one only to fail, or load one blind
+		if len(dialect.Translate(MeshReport())) == 0 {
+			return fmt.Errorf("meshes aren't supported by %s", dialect.Name())
+		}
+	}
+	switch ctx.Argv[0] {
+	case "probe":
+		if ctx.Printer == nil {
+			return errNoPrinter
+		}
+		probe, err := ParseCode(strings.Join(append([]string{"G29"}, ctx.Argv[1:]...), " "))
+		if err != nil {
+			return err
+		}
+		if _, err := queryCode(ctx, AutoLevel(probe.Parameters...), probeTimeout); err != nil {
+			return err
+		}
+		fallthrough
+	case "report":
+		if ctx.Printer == nil {
+			return errNoPrinter
+		}
+		lines, err := queryCode(ctx, MeshReport(), ctx.Timeout)
+		if err != nil {
+			return err
+		}
+		mesh, err := ParseMesh(lines)
+		if err != nil {
+			return err
+		}
+		ctx.Profile.mesh = mesh
+		showMesh(ctx.User, mesh)
+	case "show":
+		if ctx.Profile.mesh == nil {
+			return errors.New("no mesh has been probed or loaded")
+		}
+		showMesh(ctx.User, ctx.Profile.mesh)
+	case "save":
+		if len(ctx.Argv) != 2 {
+			return errors.New("usage: mesh save <name>")
+		}
+		if ctx.Profile.mesh == nil {
+			return errors.New("no mesh has been probed or loaded")
+		}
+		ctx.Profile.Meshes[ctx.Argv[1]] = ctx.Profile.mesh
+		if store, ok := dialect.(MeshStore); ok && ctx.Printer != nil {
+			if err := sendCodes(ctx, store.SaveMesh(ctx.Argv[1])...); err != nil {
+				return err
+			}
+		}
+		return ctx.Profile.Save()
+	case "load":
+		if len(ctx.Argv) != 2 {
+			return errors.New("usage: mesh load <name>")
+		}
+		mesh, ok := ctx.Profile.Meshes[ctx.Argv[1]]
+		if !ok {
+			return fmt.Errorf("no mesh called %s", ctx.Argv[1])
+		}
+		ctx.Profile.mesh = mesh
+		if store, ok := dialect.(MeshStore); ok {
+			return sendCodes(ctx, store.LoadMesh(ctx.Argv[1])...)
+		}
+		return sendCodes(ctx, mesh.Codes()...)
+	case "list":
+		for _, name := range ctx.Profile.MeshNames() {
+			ctx.User.WriteString(name + ": " + ctx.Profile.Meshes[name].Stats().String())
+		}
+	case "delete":
+		if len(ctx.Argv) != 2 {
+			return errors.New("usage: mesh delete <name>")
+		}
+		if _, ok := ctx.Profile.Meshes[ctx.Argv[1]]; !ok {
+			return fmt.Errorf("no mesh called %s", ctx.Argv[1])
+		}
+		delete(ctx.Profile.Meshes, ctx.Argv[1])
+		return ctx.Profile.Save()
+	default:
+		return fmt.Errorf("unknown mesh command: %s", ctx.Argv[0])
+	}
+	return nil
+}
+
+func cmd_tram(ctx Context) error {
+	if len(ctx.Argv) > 1 || (len(ctx.Argv) == 1 && ctx.Argv[0] != "probe") {
+		return errors.New("usage: tram [probe]")
+	}
+	return Tram(ctx, len(ctx.Argv) == 1)
+}
+
+// cmd_calibrate streams a calibration pattern to the printer or, with
+// -o, saves it for printing later; esteps and flow guide the user
+// through applying the results.
+func cmd_calibrate(ctx Context) error {
+	usage := fmt.Errorf("usage: calibrate %s [-o file] | flow <measured wall mm>", strings.Join(CalibrationNames(), "|"))
+	if len(ctx.Argv) == 2 && ctx.Argv[0] == "flow" {
+		measured, err := strconv.ParseFloat(ctx.Argv[1], 64)
+		if err != nil {
+			return err
+		}
+		return CalibrateFlow(ctx, measured)
+	}
+	if len(ctx.Argv) != 1 && (len(ctx.Argv) != 3 || ctx.Argv[1] != "-o") {
+		return usage
+	}
+	generate, ok := Calibrations[ctx.Argv[0]]
+	if !ok {
+		return usage
+	}
+	codes, err := generate(ctx.Profile.Calibration)
+	if err != nil {
+		return err
+	}
+	if len(ctx.Argv) == 1 {
+		if ctx.Argv[0] == "esteps" {
+			return CalibrateESteps(ctx)
+		}
+		return sendCodes(ctx, codes...)
+	}
+	return writeCodes(ctx, ctx.Argv[2], codes)
+}
+
+// writeCodes saves codes to a file, for the firmware's dialect, rather
+// than sending them.
+func writeCodes(ctx Context, path string, codes []Code) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	run := NewRun(false, true, file)
+	run.Dialect = dialectOf(ctx)
+	if err := run.ExecuteImmediate(codes...); err != nil {
+		file.Close()
+		return err
+	}
+	ctx.User.WriteString(fmt.Sprintf("Wrote %d codes to %s", len(codes), path))
+	return file.Close()
+}
+
+func cmd_autotune(ctx Context) error {
+	if len(ctx.Argv) < 1 || len(ctx.Argv) > 3 || (ctx.Argv[0] != "hotend" && ctx.Argv[0] != "bed") {
+		return errors.New("usage: autotune hotend|bed [target] [cycles]")
+	}
+	config := ctx.Profile.Calibration.withDefaults()
+	bed := ctx.Argv[0] == "bed"
+	target, cycles := config.Hotend, config.PIDCycles
+	if bed {
+		target = config.Bed
+	}
+	if len(ctx.Argv) > 1 {
+		value, err := strconv.ParseUint(ctx.Argv[1], 10, 32)
+		if err != nil {
+			return err
+		}
+		target = uint(value)
+	}
+	if len(ctx.Argv) > 2 {
+		var err error
+		if cycles, err = strconv.Atoi(ctx.Argv[2]); err != nil {
+			return err
+		}
+	}
+	return Autotune(ctx, bed, target, cycles)
+}
+
+func cmd_eeprom(ctx Context) error {
+	if len(ctx.Argv) == 0 || (ctx.Argv[0] != "show" && len(ctx.Argv) != 2) {
+		return errors.New("usage: eeprom show | backup <file> | diff <file> | restore <file>")
+	}
+	if ctx.Argv[0] == "restore" {
+		backup, err := LoadSettings(ctx.Argv[1])
+		if err != nil {
+			return err
+		}
+		if err := sendCodes(ctx, backup.Codes()...); err != nil {
+			return err
+		}
+		if save, err := confirm(ctx, "Save to EEPROM?"); err != nil || !save {
+			return err
+		}
+		return sendCodes(ctx, NewCode("M500", "save settings"))
+	}
+
+	settings, err := ReadSettings(ctx)
+	if err != nil {
+		return err
+	}
+	switch ctx.Argv[0] {
+	case "show":
+		for _, setting := range settings.Settings {
+			code := setting.Code()
+			ctx.User.WriteString(code.Emit(0))
+		}
+	case "backup":
+		return settings.Save(ctx.Argv[1])
+	case "diff":
+		backup, err := LoadSettings(ctx.Argv[1])
+		if err != nil {
+			return err
+		}
+		changes := backup.Diff(settings)
+		for _, change := range changes {
+			ctx.User.WriteString(change.String())
+		}
+		if len(changes) == 0 {
+			ctx.User.WriteString("No changes since " + ctx.Argv[1])
+		}
+	default:
+		return fmt.Errorf("unknown eeprom command: %s", ctx.Argv[0])
+	}
+	return nil
+}
+
+func cmd_firmware(ctx Context) error {
+	if len(ctx.Argv) > 1 || (len(ctx.Argv) == 1 && ctx.Argv[0] != "detect") {
+		return errors.New("usage: firmware [detect]")
+	}
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	firmware := ctx.Printer.Firmware()
+	if firmware == nil || len(ctx.Argv) == 1 {
+		var err error
+		if firmware, err = DetectFirmware(ctx); err != nil {
+			return err
+		}
+	}
+	for _, line := range firmware.Describe() {
+		ctx.User.WriteString(line)
+	}
+	ctx.User.WriteString("  Using: " + firmware.Features().String())
+	return nil
+}
+
+// cmd_answer replies to a host action prompt from the printer.
+func cmd_answer(ctx Context) error {
+	if len(ctx.Argv) != 1 {
+		return errors.New("usage: answer <choice>")
+	}
+	choice, err := strconv.Atoi(ctx.Argv[0])
+	if err != nil {
+		return err
+	}
+	return sendCodes(ctx, NewCode("M876", "prompt response", IntParam('S', choice)))
+}
+
+// jogFeed is the feed rate, in mm/min, for jogs that don't give one.
+const jogFeed = 1000
+
+func cmd_grbl(ctx Context) error {
+	usage := errors.New("usage: grbl status | hold | resume | reset | unlock | settings [$<n>=<value>] | jog cancel | jog <axis><distance>... [F<feed>]")
+	if len(ctx.Argv) == 0 {
+		return usage
+	}
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	if ctx.Printer.Dialect.Name() != "grbl" {
+		return fmt.Errorf("the printer's dialect is %s, not grbl", ctx.Printer.Dialect.Name())
+	}
+	switch ctx.Argv[0] {
+	case "status":
+		status, err := ctx.Printer.Status(ctx.Timeout)
+		if err != nil {
+			return err
+		}
+		ctx.User.WriteString(status.String())
+	case "hold":
+		return ctx.Printer.Realtime(RealtimeHold)
+	case "resume":
+		return ctx.Printer.Realtime(RealtimeResume)
+	case "reset":
+		return ctx.Printer.Realtime(RealtimeReset)
+	case "unlock":
+		return sendCodes(ctx, NewCode("$X", "kill alarm lock"))
+	case "settings":
+		if len(ctx.Argv) == 2 {
+			code, err := GrblSetting(ctx.Argv[1])
+			if err != nil {
+				return err
+			}
+			return sendCodes(ctx, code)
+		}
+		reply, err := queryCode(ctx, NewCode("$$", "list settings"), ctx.Timeout)
+		if err != nil {
+			return err
+		}
+		settings, err := ParseGrblSettings(reply)
+		if err != nil {
+			return err
+		}
+		for _, line := range settings.Describe() {
+			ctx.User.WriteString(line)
+		}
+	case "jog":
+		if len(ctx.Argv) == 2 && ctx.Argv[1] == "cancel" {
+			return ctx.Printer.Realtime(RealtimeJogCancel)
+		}
+		feed, params := float64(jogFeed), make([]Param, 0, len(ctx.Argv)-1)
+		for _, arg := range ctx.Argv[1:] {
+			value, err := strconv.ParseFloat(arg[1:], 64)
+			if err != nil || !strings.ContainsRune("XYZF", unicode.ToUpper(rune(arg[0]))) {
+				return usage
+			}
+			if unicode.ToUpper(rune(arg[0])) == 'F' {
+				feed = value
+				continue
+			}
+			params = append(params, FloatParam(rune(arg[0]), value))
+		}
+		if len(params) == 0 {
+			return usage
+		}
+		return sendCodes(ctx, Jog(feed, params...))
+	default:
+		return usage
+	}
+	return nil
+}
+
+func cmd_laser(ctx Context) error {
+	if len(ctx.Argv) != 1 && (len(ctx.Argv) != 3 || ctx.Argv[1] != "-o") {
+		return errors.New("usage: laser <image> [-o file]")
+	}
+	img, err := LoadImage(ctx.Argv[0])
+	if err != nil {
+		return err
+	}
+	codes, err := Raster(img, ctx.Profile.Laser)
+	if err != nil {
+		return err
+	}
+	if len(ctx.Argv) == 3 {
+		return writeCodes(ctx, ctx.Argv[2], codes)
+	}
+	return sendCodes(ctx, codes...)
+}
+
+func cmd_plot(ctx Context) error {
+	if len(ctx.Argv) != 1 && (len(ctx.Argv) != 3 || ctx.Argv[1] != "-o") {
+		return errors.New("usage: plot <svg or dxf file> [-o file]")
+	}
+	drawing, err := LoadDrawing(ctx.Argv[0])
+	if err != nil {
+		return err
+	}
+	codes, err := drawing.Toolpaths(ctx.Profile.Plot)
+	if err != nil {
+		return err
+	}
+	if len(ctx.Argv) == 3 {
+		return writeCodes(ctx, ctx.Argv[2], codes)
+	}
+	return sendCodes(ctx, codes...)
+}
+
+// cmd_estop sends M112 ahead of everything queued. Marlin built without
+// the emergency parser only reads it once the command it's running is
+// done, which could be a long heat up or homing.
+func cmd_estop(ctx Context) error {
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	if firmware := ctx.Printer.Firmware(); firmware != nil && firmware.Name == "Marlin" && !firmware.Has(CapEmergencyParser) {
+		ctx.User.Error("The firmware has no emergency parser: it will finish its current command before stopping")
+	}
+	if err := ctx.Printer.Emergency(NewCode("M112", "emergency stop")); err != nil {
+		return err
+	}
+	ctx.User.WriteString("-- Emergency stop: reset the printer before carrying on")
+	return nil
+}
+
+// cmd_quickstop sends M410, which stops moving and discards planned moves
+// but, unlike M112, leaves the printer running.
+func cmd_quickstop(ctx Context) error {
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	if err := ctx.Printer.Emergency(NewCode("M410", "quick stop")); err != nil {
+		return err
+	}
+	ctx.User.WriteString("-- Stopped: home before moving again, as the position may be lost")
+	return nil
+}
+
+// cmd_kill stops the host, dropping everything queued and whatever the
+// other commands were waiting on, without telling the printer.
+func cmd_kill(ctx Context) error {
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	ctx.Printer.Abort()
+	ctx.User.WriteString("-- Killed everything queued for the printer")
+	return nil
+}
+
+func cmd_watchdog(ctx Context) error {
+	if ctx.Watchdog == nil {
+		return errNoPrinter
+	}
+	switch {
+	case len(ctx.Argv) == 0:
+		for _, line := range ctx.Watchdog.Describe() {
+			ctx.User.WriteString(line)
+		}
+	case len(ctx.Argv) == 1 && (ctx.Argv[0] == "on" || ctx.Argv[0] == "off"):
+		ctx.Watchdog.Arm(ctx.Argv[0] == "on")
+	case len(ctx.Argv) == 1 && ctx.Argv[0] == "resume":
+		ctx.Printer.Release()
+	default:
+		return errors.New("usage: watchdog [on|off|resume]")
+	}
+	return nil
+}
+
+func cmd_sd(ctx Context) error {
+	usage := errors.New("usage: sd ls | print <file> | pause | resume | progress [<seconds>] | delete <file> | upload <local file> [<name>] [-binary|-text]")
+	if len(ctx.Argv) == 0 {
+		return usage
+	}
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	switch {
+	case ctx.Argv[0] == "ls" && len(ctx.Argv) == 1:
+		files, err := ListSD(ctx)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			ctx.User.WriteString(file.String())
+		}
+		if len(files) == 0 {
+			ctx.User.WriteString("No files on the SD card")
+		}
+	case ctx.Argv[0] == "print" && len(ctx.Argv) == 2:
+		file, err := PrintSD(ctx, ctx.Argv[1])
+		if err != nil {
+			return err
+		}
+		ctx.User.WriteString(fmt.Sprintf("-- Printing %s (%d bytes) from SD", file.Name, file.Size))
+	case ctx.Argv[0] == "pause" && len(ctx.Argv) == 1:
+		return sendCodes(ctx, SDPause())
+	case ctx.Argv[0] == "resume" && len(ctx.Argv) == 1:
+		return sendCodes(ctx, SDStart())
+	case ctx.Argv[0] == "progress" && len(ctx.Argv) == 1:
+		status, err := ReadSDStatus(ctx)
+		if err != nil {
+			return err
+		}
+		ctx.User.WriteString(status.String())
+	case ctx.Argv[0] == "progress" && len(ctx.Argv) == 2:
+		interval, err := strconv.ParseUint(ctx.Argv[1], 10, 16)
+		if err != nil {
+			return usage
+		}
+		return sendCodes(ctx, SDAutoReport(uint(interval)))
+	case ctx.Argv[0] == "delete" && len(ctx.Argv) == 2:
+		return DeleteSD(ctx, ctx.Argv[1])
+	case ctx.Argv[0] == "upload" && len(ctx.Argv) >= 2:
+		// binary transfer is much faster, where the firmware has it
+		packets := ctx.Printer.Firmware().Has(CapBinaryTransfer)
+		args := make([]string, 0, 2)
+		for _, arg := range ctx.Argv[1:] {
+			switch arg {
+			case "-binary":
+				packets = true
+			case "-text":
+				packets = false
+			default:
+				args = append(args, arg)
+			}
+		}
+		if len(args) == 0 || len(args) > 2 {
+			return usage
+		}
+		args = append(args, "")
+		return UploadFileSD(ctx, args[0], args[1], packets)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// NewDaemonUserInterface creates a headless host that only talks to
+// clients attached through a unix domain socket. It ignores hangups so
+// a long print outlives the terminal that started it.
+func NewDaemonUserInterface(socket string) (*NetUserInterface, error) {
+	signal.Ignore(syscall.SIGHUP)
+	return NewNetUserInterface(nil, "unix:"+socket)
+}
+
+// Attach connects a local console to a daemon: lines typed are relayed
+// to the daemon and everything it says is shown, until the user detaches
+// or the daemon goes away.
+func Attach(ui UserInterfacer, socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	detached := make(chan struct{})
+	ui.Start()
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			ui.WriteString(scanner.Text())
+		}
+		select {
+		case <-detached:
+			ui.WriteString("-- Detached")
+		default:
+			ui.WriteString("-- Daemon closed the connection")
+		}
+		ui.Close()
+	}()
+
+	// The reader closes the ui once the connection is gone, which is
+	// what ends this loop.
+	for cmd := range ui.Commands() {
+		if strings.TrimSpace(cmd.Text) == "detach" {
+			select {
+			case <-detached:
+			default:
+				close(detached)
+				conn.Close()
+			}
+			continue
+		}
+		if _, err := conn.Write([]byte(cmd.Text + "\n")); err != nil {
+			ui.Error(err.Error())
+		}
+	}
+	return nil
+}
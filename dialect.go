@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReplyKind classifies a line sent by the printer.
+type ReplyKind int
+
+const (
+	ReplyInfo      ReplyKind = iota // anything else, e.g. echo: or temperature reports
+	ReplyOk                         // the command was accepted
+	ReplyBusy                       // still working on a long command
+	ReplyError                      // something went wrong
+	ReplyRejected                   // the command failed; it won't be acknowledged otherwise
+	ReplyResend                     // the line was corrupted, resend from Text
+	ReplyStart                      // the firmware (re)started
+	ReplyPrintDone                  // a print from SD finished
+	ReplyStatus                     // a GRBL status report
+)
+
+type Reply struct {
+	Kind ReplyKind
+	Text string
+}
+
+// Dialect adapts the host to a firmware family. Codes are written in
+// Marlin's terms and translated on the way out; replies are classified
+// on the way back in.
+type Dialect interface {
+	Name() string
+	// Translate maps a code to the firmware's equivalents; none drops it.
+	Translate(code Code) []Code
+	// Numbered reports whether the firmware checks line numbers and
+	// checksums.
+	Numbered() bool
+	// SetsLineNumber reports whether code sets the line counter, and so
+	// is sent unnumbered.
+	SetsLineNumber(code Code) bool
+	Reply(line string) Reply
+	ParseTemperatures(line string) map[string]Temperature
+	// ReceiveBuffer is the size of the firmware's serial buffer when lines
+	// are streamed by counting characters, or 0 to wait for each "ok".
+	ReceiveBuffer() int
+	// Features are assumed until the firmware says otherwise.
+	Features() Features
+}
+
+// MeshStore is implemented by dialects whose firmware keeps meshes by
+// name, which are saved and loaded there rather than sent point by point.
+type MeshStore interface {
+	SaveMesh(name string) []Code
+	LoadMesh(name string) []Code
+}
+
+// Marlin is the default dialect, which the others build on.
+var Marlin Dialect = marlin{}
+
+// Dialects are the supported firmware families by name.
+var Dialects = map[string]Dialect{
+	"marlin":   Marlin,
+	"prusa":    prusa{},
+	"klipper":  klipper{},
+	"rrf":      rrf{},
+	"smoothie": smoothie{},
+	"grbl":     grbl{},
+}
+
+// DialectNames lists the keys of Dialects.
+func DialectNames() []string {
+	names := make([]string, 0, len(Dialects))
+	for name := range Dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupDialect finds a dialect by name; "" is Marlin.
+func LookupDialect(name string) (Dialect, error) {
+	if name == "" {
+		return Marlin, nil
+	}
+	dialect, ok := Dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown dialect %s, expected one of %s", name, strings.Join(DialectNames(), ", "))
+	}
+	return dialect, nil
+}
+
+type marlin struct{}
+
+func (marlin) Name() string                  { return "marlin" }
+func (marlin) Translate(code Code) []Code    { return []Code{code} }
+func (marlin) Numbered() bool                { return true }
+func (marlin) SetsLineNumber(code Code) bool { return code.GCode == "M110" }
+func (marlin) ReceiveBuffer() int            { return 0 }
+func (marlin) Features() Features            { return Features{} }
+
+func (marlin) ParseTemperatures(line string) map[string]Temperature {
+	return ParseTemperatures(line)
+}
+
+func (marlin) Reply(line string) Reply {
+	switch {
+	case strings.HasPrefix(line, "ok"):
+		return Reply{ReplyOk, strings.TrimSpace(strings.TrimPrefix(line, "ok"))}
+	case strings.HasPrefix(line, "echo:busy:") || strings.HasPrefix(line, "busy:"):
+		return Reply{ReplyBusy, line}
+	case line == "start":
+		return Reply{ReplyStart, line}
+	case strings.HasPrefix(line, "Error:"):
+		return Reply{ReplyError, strings.TrimPrefix(line, "Error:")}
+	case strings.HasPrefix(line, "Resend:") || strings.HasPrefix(line, "rs "):
+		return Reply{ReplyResend, strings.TrimSpace(line[strings.IndexAny(line, ": ")+1:])}
+	case strings.HasPrefix(line, "Done printing file"):
+		return Reply{ReplyPrintDone, line}
+	}
+	return Reply{ReplyInfo, line}
+}
+
+// prusa is Marlin with mesh bed leveling driven by G80.
+type prusa struct{ marlin }
+
+func (prusa) Name() string { return "prusa" }
+
+func (prusa) Translate(code Code) []Code {
+	switch code.GCode {
+	case "G29":
+		return []Code{NewCode("G80", "mesh bed leveling")}
+	case "M420":
+		// the mesh from G80 is always used
+		return nil
+	}
+	return []Code{code}
+}
+
+// klipper takes extended commands for anything beyond basic G-code, and
+// keeps its configuration in printer.cfg rather than EEPROM.
+type klipper struct{ marlin }
+
+func (klipper) Name() string   { return "klipper" }
+func (klipper) Numbered() bool { return false }
+
+// extended builds a Klipper command such as "SET_PRESSURE_ADVANCE ADVANCE=0.05".
+func extended(comment, name string, args ...string) Code {
+	return NewCode(strings.Join(append([]string{name}, args...), " "), comment)
+}
+
+func klipperHeater(code Code) string {
+	if code.GCode == "M304" || code.GCode == "M140" || code.GCode == "M190" {
+		return "heater_bed"
+	}
+	tool, _ := code.Int('E')
+	switch {
+	case tool < 0:
+		return "heater_bed"
+	case tool > 0:
+		return "extruder" + strconv.Itoa(tool)
+	}
+	return "extruder"
+}
+
+func (klipper) Translate(code Code) []Code {
+	switch code.GCode {
+	case "G29":
+		return []Code{extended(code.Comment, "BED_MESH_CALIBRATE")}
+	case "M420":
+		if code.Has('V') {
+			return []Code{extended(code.Comment, "BED_MESH_OUTPUT")}
+		}
+		if enable, _ := code.Int('S'); enable == 0 {
+			return []Code{extended(code.Comment, "BED_MESH_CLEAR")}
+		}
+		return []Code{extended(code.Comment, "BED_MESH_PROFILE", "LOAD=default")}
+	case "M303":
+		target, _ := code.Parameter('S')
+		return []Code{extended(code.Comment, "PID_CALIBRATE", "HEATER="+klipperHeater(code), "TARGET="+target)}
+	case "M900":
+		advance, _ := code.Parameter('K')
+		return []Code{extended(code.Comment, "SET_PRESSURE_ADVANCE", "ADVANCE="+advance)}
+	case "M500":
+		return []Code{extended(code.Comment, "SAVE_CONFIG")}
+	case "M92", "M301", "M304", "M421", "M155", "M876":
+		// configured in printer.cfg, or not supported
+		return nil
+	}
+	return []Code{code}
+}
+
+// SaveMesh keeps the mesh in use as a named profile, until SAVE_CONFIG
+// writes it to printer.cfg.
+func (klipper) SaveMesh(name string) []Code {
+	return []Code{extended("save mesh", "BED_MESH_PROFILE", "SAVE="+name)}
+}
+
+func (klipper) LoadMesh(name string) []Code {
+	return []Code{extended("load mesh", "BED_MESH_PROFILE", "LOAD="+name)}
+}
+
+func (k klipper) Reply(line string) Reply {
+	switch {
+	case strings.HasPrefix(line, "!! "):
+		return Reply{ReplyError, strings.TrimPrefix(line, "!! ")}
+	case strings.HasPrefix(line, "// Klipper state: Ready"):
+		return Reply{ReplyStart, line}
+	}
+	return k.marlin.Reply(line)
+}
+
+// rrf is RepRapFirmware 3, whose state is read from the object model.
+type rrf struct{ marlin }
+
+func (rrf) Name() string { return "rrf" }
+
+func (rrf) Translate(code Code) []Code {
+	switch code.GCode {
+	case "M105":
+		return []Code{NewCode("M409", code.Comment, StringParam('K', `"heat"`), StringParam('F', `"v"`))}
+	case "G29":
+		return []Code{NewCode("G29", code.Comment, IntParam('S', 0))}
+	case "M420":
+		if code.Has('V') {
+			// no mesh report
+			return nil
+		}
+		if enable, _ := code.Int('S'); enable == 0 {
+			return []Code{NewCode("G29", code.Comment, IntParam('S', 2))}
+		}
+		return []Code{NewCode("G29", code.Comment, IntParam('S', 1))}
+	case "M303":
+		heater := IntParam('T', 0)
+		if tool, ok := code.Int('E'); ok && tool >= 0 {
+			heater = IntParam('T', tool)
+		} else if ok {
+			heater = IntParam('H', 0)
+		}
+		translated := NewCode("M303", code.Comment, heater)
+		if target, ok := code.Parameter('S'); ok {
+			translated.Set(StringParam('S', target))
+		}
+		return []Code{translated}
+	case "M900":
+		advance, _ := code.Parameter('K')
+		return []Code{NewCode("M572", code.Comment, IntParam('D', 0), StringParam('S', advance))}
+	case "M301", "M304", "M155", "M876":
+		// heaters are tuned with M307 models; reports are read from the object model
+		return nil
+	}
+	return []Code{code}
+}
+
+// ObjectModel is the "heat" key of RRF's object model, as returned by
+// M409 K"heat".
+type ObjectModel struct {
+	Key    string `json:"key"`
+	Result struct {
+		BedHeaters []int `json:"bedHeaters"`
+		Heaters    []struct {
+			Current float64 `json:"current"`
+			Active  float64 `json:"active"`
+			State   string  `json:"state"`
+		} `json:"heaters"`
+	} `json:"result"`
+}
+
+// ParseTemperatures reads M409 object model replies, numbering the
+// heaters that aren't bed heaters as tools, as well as M105 reports.
+func (r rrf) ParseTemperatures(line string) map[string]Temperature {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "ok"))
+	if !strings.HasPrefix(line, "{") {
+		return r.marlin.ParseTemperatures(line)
+	}
+	var model ObjectModel
+	if err := json.Unmarshal([]byte(line), &model); err != nil || model.Key != "heat" {
+		return nil
+	}
+	beds := make(map[int]bool)
+	for _, heater := range model.Result.BedHeaters {
+		beds[heater] = true
+	}
+	temps := make(map[string]Temperature, len(model.Result.Heaters))
+	tool := 0
+	for idx, heater := range model.Result.Heaters {
+		target := heater.Active
+		if heater.State == "off" {
+			target = 0
+		}
+		temp := Temperature{heater.Current, target}
+		if beds[idx] {
+			temps["B"] = temp
+			continue
+		}
+		if tool == 0 {
+			temps["T"] = temp
+		}
+		temps["T"+strconv.Itoa(tool)] = temp
+		tool++
+	}
+	return temps
+}
+
+// smoothie keeps settings in config-override and levels with G32.
+type smoothie struct{ marlin }
+
+func (smoothie) Name() string   { return "smoothie" }
+func (smoothie) Numbered() bool { return false }
+
+func (smoothie) Translate(code Code) []Code {
+	switch code.GCode {
+	case "G29":
+		return []Code{NewCode("G32", code.Comment)}
+	case "M420":
+		if code.Has('V') {
+			// no mesh report
+			return nil
+		}
+		if enable, _ := code.Int('S'); enable == 0 {
+			return []Code{NewCode("M561", code.Comment)}
+		}
+		return []Code{NewCode("M375", code.Comment)}
+	case "M110", "M155", "M876", "M900":
+		return nil
+	}
+	return []Code{code}
+}
+
+func (s smoothie) Reply(line string) Reply {
+	switch {
+	case strings.HasPrefix(line, "!!"):
+		return Reply{ReplyError, "halted: " + strings.TrimSpace(strings.TrimPrefix(line, "!!"))}
+	case strings.HasPrefix(line, "error:"):
+		return Reply{ReplyError, strings.TrimPrefix(line, "error:")}
+	case strings.HasPrefix(line, "Smoothie"):
+		return Reply{ReplyStart, line}
+	}
+	return s.marlin.Reply(line)
+}
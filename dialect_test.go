@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func translate(dialect Dialect, codes ...Code) string {
+	writer := &strings.Builder{}
+	run := NewRun(true, false, writer)
+	run.Dialect = dialect
+	run.ExecuteImmediate(codes...)
+	return strings.TrimSpace(writer.String())
+}
+
+func TestLookupDialect(t *testing.T) {
+	dialect, err := LookupDialect("")
+	assert.Nil(t, err)
+	assert.Equal(t, "marlin", dialect.Name())
+	dialect, err = LookupDialect("Klipper")
+	assert.Nil(t, err)
+	assert.Equal(t, "klipper", dialect.Name())
+	_, err = LookupDialect("sailfish")
+	assert.EqualError(t, err, "unknown dialect sailfish, expected one of grbl, klipper, marlin, prusa, rrf, smoothie")
+}
+
+func TestDialectTranslate(t *testing.T) {
+	codes := []Code{
+		NewCode("G29", ""),
+		NewCode("M420", "", IntParam('S', 1)),
+		NewCode("M900", "", StringParam('K', "0.05")),
+		NewCode("M500", ""),
+	}
+	assert.Equal(t, "N1 G29*19\nN2 M420 S1*101\nN3 M900 K0.05*89\nN4 M500*34", translate(Marlin, codes...))
+	assert.Equal(t, "N1 G80*16\nN2 M900 K0.05*88\nN3 M500*37", translate(Dialects["prusa"], codes...))
+	assert.Equal(t, "BED_MESH_CALIBRATE\nBED_MESH_PROFILE LOAD=default\nSET_PRESSURE_ADVANCE ADVANCE=0.05\nSAVE_CONFIG",
+		translate(Dialects["klipper"], codes...))
+	assert.Equal(t, "N1 G29 S0*80\nN2 G29 S1*82\nN3 M572 D0 S0.05*28\nN4 M500*34", translate(Dialects["rrf"], codes...))
+	assert.Equal(t, "G32\nM375\nM500", translate(Dialects["smoothie"], codes...))
+
+	// only Marlin and Klipper report the mesh
+	assert.Equal(t, "N1 M420 V*82", translate(Marlin, MeshReport()))
+	assert.Equal(t, "BED_MESH_OUTPUT", translate(Dialects["klipper"], MeshReport()))
+	for _, name := range []string{"prusa", "rrf", "smoothie"} {
+		assert.Equal(t, "", translate(Dialects[name], MeshReport()), name)
+	}
+
+	assert.Equal(t, "PID_CALIBRATE HEATER=heater_bed TARGET=60",
+		translate(Dialects["klipper"], NewCode("M303", "", IntParam('E', -1), IntParam('S', 60), IntParam('C', 8))))
+	assert.Equal(t, "N1 M303 T1 S210*39",
+		translate(Dialects["rrf"], NewCode("M303", "", IntParam('E', 1), IntParam('S', 210), IntParam('C', 8))))
+}
+
+func TestDialectGRBL(t *testing.T) {
+	codes := []Code{
+		Home(),
+		ToolTemp(0, 200),
+		NewCode("T1", ""),
+		Move(FloatParam('X', 10), FloatParam('E', 1)),
+		Move(FloatParam('E', -1)),
+		FinishMoves(),
+	}
+	assert.Equal(t, "$H\nG1 X10\nG4 P0", translate(Dialects["grbl"], codes...))
+
+	grbl := Dialects["grbl"]
+	assert.Equal(t, Reply{ReplyOk, ""}, grbl.Reply("ok"))
+	assert.Equal(t, Reply{ReplyRejected, "error:20 Unsupported command"}, grbl.Reply("error:20"))
+	assert.Equal(t, Reply{ReplyError, "ALARM:1 Hard limit triggered, position lost"}, grbl.Reply("ALARM:1"))
+	assert.Equal(t, ReplyStart, grbl.Reply("Grbl 1.1h ['$' for help]").Kind)
+	assert.Nil(t, grbl.ParseTemperatures("<Idle|MPos:0.000,0.000,0.000|FS:0,0>"))
+}
+
+func TestDialectReply(t *testing.T) {
+	assert.Equal(t, Reply{ReplyOk, "T:20.0 /0.0"}, Marlin.Reply("ok T:20.0 /0.0"))
+	assert.Equal(t, Reply{ReplyBusy, "echo:busy: processing"}, Marlin.Reply("echo:busy: processing"))
+	assert.Equal(t, Reply{ReplyResend, "12"}, Marlin.Reply("Resend: 12"))
+	assert.Equal(t, Reply{ReplyError, "Printer halted"}, Marlin.Reply("Error:Printer halted"))
+	assert.Equal(t, Reply{ReplyInfo, "echo:Settings Stored"}, Marlin.Reply("echo:Settings Stored"))
+
+	assert.Equal(t, Reply{ReplyError, "Move out of range: 300.000 0.000 0.000 [0.000]"},
+		Dialects["klipper"].Reply("!! Move out of range: 300.000 0.000 0.000 [0.000]"))
+	assert.Equal(t, Reply{ReplyError, "halted: Kill button pressed"}, Dialects["smoothie"].Reply("!!Kill button pressed"))
+	assert.Equal(t, ReplyStart, Dialects["smoothie"].Reply("Smoothie").Kind)
+}
+
+func TestRRFObjectModel(t *testing.T) {
+	rrf := Dialects["rrf"]
+	poll := rrf.Translate(NewCode("M105", ""))
+	assert.Equal(t, 1, len(poll))
+	assert.Equal(t, `M409 K"heat" F"v"`, poll[0].EmitAs(rrf, 0))
+	line := `{"key":"heat","flags":"v","result":{"bedHeaters":[0],"heaters":[` +
+		`{"current":59.8,"active":60,"state":"active"},{"current":205.1,"active":210,"state":"active"},` +
+		`{"current":25,"active":200,"state":"off"}]}}`
+	assert.Equal(t, map[string]Temperature{
+		"B":  {59.8, 60},
+		"T":  {205.1, 210},
+		"T0": {205.1, 210},
+		"T1": {25, 0},
+	}, rrf.ParseTemperatures(line))
+	assert.Nil(t, rrf.ParseTemperatures(`{"key":"move","result":{}}`))
+	assert.Equal(t, map[string]Temperature{"T": {20, 0}}, rrf.ParseTemperatures("ok T:20.0 /0.0"))
+}
+
+func TestPrinterDialect(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	p.Dialect = Dialects["grbl"]
+	events := make(chan Event, 8)
+	p.OnEvent(func(event Event) { events <- event })
+	received := simulate(device, func(line string) []string {
+		if line == "G1 X1000" {
+			return []string{"error:15"}
+		}
+		return []string{"ok"}
+	})
+	p.Start()
+	defer p.Close()
+	assert.Equal(t, Event{EventConnect, ""}, <-events)
+
+	// a rejected line isn't followed by "ok", so mustn't stall the queue
+	remote <- "G1 X1000"
+	assert.Equal(t, Event{EventError, "error:15 Jog target exceeds machine travel"}, <-events)
+	lines, err := p.Query("$H", time.Second)
+	assert.Nil(t, err)
+	assert.Empty(t, lines)
+	assert.Equal(t, []string{"G1 X1000", "$H"}, received())
+	assert.Empty(t, ui.Errors())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dxfEntity is an entity's group codes, in order, as DXF repeats codes
+// for vertices.
+type dxfEntity struct {
+	kind   string
+	groups []dxfGroup
+}
+
+type dxfGroup struct {
+	code  int
+	value string
+}
+
+func (e *dxfEntity) float(code int) float64 {
+	for _, group := range e.groups {
+		if group.code == code {
+			value, _ := strconv.ParseFloat(group.value, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// bulgeArc adds the arc between two polyline vertices, whose bulge is
+// the tangent of a quarter of its angle, positive counter-clockwise.
+func bulgeArc(path *VectorPath, from, to Point, bulge float64) {
+	if bulge == 0 {
+		path.lineTo(to)
+		return
+	}
+	sweep := 4 * math.Atan(bulge)
+	chord := to.sub(from)
+	// the centre is off the chord's midpoint, to its left when
+	// counter-clockwise
+	offset := chord.length() / 2 / math.Tan(sweep/2)
+	normal := Point{-chord.Y, chord.X}.scale(1 / chord.length())
+	centre := from.lerp(to, 0.5).add(normal.scale(offset))
+	path.arcTo(centre, sweep, to)
+}
+
+func dxfPolyline(entity *dxfEntity) (VectorPath, bool) {
+	points, bulges := make([]Point, 0, 8), make([]float64, 0, 8)
+	closed := false
+	for _, group := range entity.groups {
+		value, _ := strconv.ParseFloat(group.value, 64)
+		switch group.code {
+		case 10:
+			points = append(points, Point{X: value})
+			bulges = append(bulges, 0)
+		case 20:
+			if len(points) > 0 {
+				points[len(points)-1].Y = value
+			}
+		case 42:
+			if len(bulges) > 0 {
+				bulges[len(bulges)-1] = value
+			}
+		case 70:
+			closed = int(value)&1 == 1
+		}
+	}
+	if len(points) < 2 {
+		return VectorPath{}, false
+	}
+	path := VectorPath{Start: points[0], Closed: closed}
+	for idx := 1; idx < len(points); idx++ {
+		bulgeArc(&path, points[idx-1], points[idx], bulges[idx-1])
+	}
+	if closed {
+		bulgeArc(&path, points[len(points)-1], points[0], bulges[len(points)-1])
+	}
+	return path, true
+}
+
+// dxfShape converts the entities we can draw: lines, polylines, circles
+// and arcs.
+func dxfShape(entity *dxfEntity) (VectorPath, bool) {
+	switch entity.kind {
+	case "LINE":
+		path := VectorPath{Start: Point{entity.float(10), entity.float(20)}}
+		path.lineTo(Point{entity.float(11), entity.float(21)})
+		return path, true
+	case "LWPOLYLINE":
+		return dxfPolyline(entity)
+	case "CIRCLE", "ARC":
+		centre, radius := Point{entity.float(10), entity.float(20)}, entity.float(40)
+		start, end := 0.0, 2*math.Pi
+		if entity.kind == "ARC" {
+			start, end = entity.float(50)*math.Pi/180, entity.float(51)*math.Pi/180
+			for end <= start {
+				end += 2 * math.Pi
+			}
+		}
+		at := func(angle float64) Point {
+			return Point{centre.X + radius*math.Cos(angle), centre.Y + radius*math.Sin(angle)}
+		}
+		path := VectorPath{Start: at(start), Closed: entity.kind == "CIRCLE"}
+		path.arcTo(centre, end-start, at(end))
+		if path.Closed {
+			path.Segments[0].to = path.Start
+		}
+		return path, true
+	}
+	return VectorPath{}, false
+}
+
+// ParseDXF reads the entities of an ASCII DXF file, pairs of lines
+// giving a group code then its value.
+func ParseDXF(reader io.Reader) (*Drawing, error) {
+	scanner := bufio.NewScanner(reader)
+	drawing := &Drawing{}
+	var entity *dxfEntity
+	inEntities, skipped := false, make(map[string]int)
+	finish := func() {
+		if entity == nil {
+			return
+		}
+		if path, ok := dxfShape(entity); ok {
+			drawing.Paths = append(drawing.Paths, path)
+		} else {
+			skipped[entity.kind]++
+		}
+		entity = nil
+	}
+	for line := 1; scanner.Scan(); line += 2 {
+		code, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad group code %q", line, scanner.Text())
+		}
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("line %d: group code %d has no value", line, code)
+		}
+		value := strings.TrimSpace(scanner.Text())
+		switch {
+		case code == 2 && entity == nil && value == "ENTITIES":
+			inEntities = true
+		case code == 0 && inEntities:
+			finish()
+			if value == "ENDSEC" {
+				inEntities = false
+			} else {
+				entity = &dxfEntity{kind: value}
+			}
+		case entity != nil:
+			entity.groups = append(entity.groups, dxfGroup{code, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+	if len(drawing.Paths) == 0 {
+		kinds := make([]string, 0, len(skipped))
+		for kind := range skipped {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		return nil, fmt.Errorf("no lines, polylines, circles or arcs in the DXF (found %s)", strings.Join(kinds, ", "))
+	}
+	return drawing, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Setting is one line of an M503 report, such as "M92 X80.00 E93.00".
+// Codes reported once per tool or preset are told apart by Index.
+type Setting struct {
+	GCode  string            `json:"gcode"`
+	Index  string            `json:"index,omitempty"` // e.g. "T1", or "S0" for M145
+	Values map[string]string `json:"values"`
+}
+
+// Settings are the firmware's stored configuration, in the order it
+// reported them.
+type Settings struct {
+	Settings []Setting `json:"settings"`
+}
+
+// SettingNames describes the codes M503 reports.
+var SettingNames = map[string]string{
+	"M92":  "steps per unit",
+	"M200": "filament diameter",
+	"M201": "max acceleration",
+	"M203": "max feedrate",
+	"M204": "acceleration",
+	"M205": "advanced and jerk",
+	"M206": "home offset",
+	"M145": "material preset",
+	"M218": "hotend offset",
+	"M301": "hotend PID",
+	"M304": "bed PID",
+	"M420": "bed leveling",
+	"M851": "probe offset",
+	"M900": "linear advance",
+	"M906": "stepper current",
+	"M913": "hybrid threshold",
+	"M914": "stallguard threshold",
+}
+
+// settingIndex is the parameter that distinguishes repeated codes, if
+// the code has one.
+func settingIndex(gcode string) rune {
+	switch gcode {
+	case "M145":
+		return 'S'
+	case "M301":
+		return 'E'
+	case "M92", "M201", "M203", "M218", "M906", "M913", "M914":
+		return 'T'
+	}
+	return 0
+}
+
+func (s Setting) key() string {
+	return s.GCode + s.Index
+}
+
+// Name describes the setting, e.g. "max feedrate T1".
+func (s Setting) Name() string {
+	name, ok := SettingNames[s.GCode]
+	if !ok {
+		name = s.GCode
+	}
+	if s.Index != "" {
+		name += " " + s.Index
+	}
+	return name
+}
+
+func (s Setting) keys() []string {
+	keys := make([]string, 0, len(s.Values))
+	for key := range s.Values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return canonicalRank(rune(keys[i][0])) < canonicalRank(rune(keys[j][0]))
+	})
+	return keys
+}
+
+// Code sets the value again.
+func (s Setting) Code() Code {
+	code := NewCode(s.GCode, s.Name())
+	if s.Index != "" {
+		code.Override(rune(s.Index[0]), s.Index[1:])
+	}
+	for _, key := range s.keys() {
+		code.Override(rune(key[0]), s.Values[key])
+	}
+	return code
+}
+
+// ParseSettings reads an M503 report, e.g.
+//
+//	echo:; Steps per unit:
+//	echo: M92 X80.00 Y80.00 Z400.00 E93.00
+func ParseSettings(lines []string) (*Settings, error) {
+	settings := &Settings{}
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "echo:"))
+		if !strings.HasPrefix(line, "M") {
+			continue
+		}
+		code, err := ParseCode(line)
+		if err != nil {
+			return nil, err
+		}
+		setting := Setting{GCode: code.GCode, Values: make(map[string]string, len(code.Parameters))}
+		index := settingIndex(code.GCode)
+		for _, param := range code.Parameters {
+			if index != 0 && param.Key == index {
+				setting.Index = string(param.Key) + param.Value
+				continue
+			}
+			setting.Values[string(param.Key)] = param.Value
+		}
+		settings.set(setting)
+	}
+	if len(settings.Settings) == 0 {
+		return nil, fmt.Errorf("no settings in the printer's reply")
+	}
+	return settings, nil
+}
+
+// set replaces a setting, or adds it if new.
+func (s *Settings) set(setting Setting) {
+	for idx := range s.Settings {
+		if s.Settings[idx].key() == setting.key() {
+			s.Settings[idx] = setting
+			return
+		}
+	}
+	s.Settings = append(s.Settings, setting)
+}
+
+// Get looks up a setting by code and index ("" for most).
+func (s *Settings) Get(gcode, index string) (Setting, bool) {
+	for _, setting := range s.Settings {
+		if setting.GCode == gcode && setting.Index == index {
+			return setting, true
+		}
+	}
+	return Setting{}, false
+}
+
+// Floats returns a setting's values as numbers, e.g.
+// Floats("M92", "")["E"] for the extruder's steps/mm.
+func (s *Settings) Floats(gcode, index string) map[string]float64 {
+	setting, ok := s.Get(gcode, index)
+	if !ok {
+		return nil
+	}
+	values := make(map[string]float64, len(setting.Values))
+	for key, text := range setting.Values {
+		if value, err := strconv.ParseFloat(text, 64); err == nil {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (s *Settings) StepsPerUnit() map[string]float64     { return s.Floats("M92", "") }
+func (s *Settings) MaxFeedrates() map[string]float64     { return s.Floats("M203", "") }
+func (s *Settings) MaxAccelerations() map[string]float64 { return s.Floats("M201", "") }
+func (s *Settings) Accelerations() map[string]float64    { return s.Floats("M204", "") }
+func (s *Settings) Jerk() map[string]float64             { return s.Floats("M205", "") }
+func (s *Settings) HomeOffset() map[string]float64       { return s.Floats("M206", "") }
+func (s *Settings) ProbeOffset() map[string]float64      { return s.Floats("M851", "") }
+func (s *Settings) LinearAdvance() map[string]float64    { return s.Floats("M900", "") }
+
+// HotendPID and BedPID return the P, I and D constants.
+func (s *Settings) HotendPID() PID { return pidOf(s.Floats("M301", "E0"), s.Floats("M301", "")) }
+func (s *Settings) BedPID() PID    { return pidOf(s.Floats("M304", "")) }
+
+func pidOf(candidates ...map[string]float64) PID {
+	for _, values := range candidates {
+		if values != nil {
+			return PID{values["P"], values["I"], values["D"]}
+		}
+	}
+	return PID{}
+}
+
+// Codes restores the settings; follow with M500 to store them.
+func (s *Settings) Codes() []Code {
+	codes := make([]Code, 0, len(s.Settings))
+	for _, setting := range s.Settings {
+		codes = append(codes, setting.Code())
+	}
+	return codes
+}
+
+// SettingChange is a value that differs between two sets of settings;
+// Old or New is empty if the value is only in one of them.
+type SettingChange struct {
+	Setting  Setting
+	Key      string
+	Old, New string
+}
+
+func (c SettingChange) String() string {
+	old, current := c.Old, c.New
+	if old == "" {
+		old = "-"
+	}
+	if current == "" {
+		current = "-"
+	}
+	return fmt.Sprintf("%s %s (%s): %s -> %s", strings.TrimSpace(c.Setting.GCode+" "+c.Setting.Index), c.Key, c.Setting.Name(), old, current)
+}
+
+// same compares values numerically where possible, so "80" and "80.00"
+// don't count as a change.
+func same(lhs, rhs string) bool {
+	left, err1 := strconv.ParseFloat(lhs, 64)
+	right, err2 := strconv.ParseFloat(rhs, 64)
+	if err1 == nil && err2 == nil {
+		return left == right
+	}
+	return lhs == rhs
+}
+
+// Diff lists what changed going from s to other.
+func (s *Settings) Diff(other *Settings) []SettingChange {
+	changes := make([]SettingChange, 0)
+	seen := make(map[string]bool)
+	for _, old := range s.Settings {
+		seen[old.key()] = true
+		current, _ := other.Get(old.GCode, old.Index)
+		for _, key := range old.keys() {
+			if value, ok := current.Values[key]; !ok || !same(old.Values[key], value) {
+				changes = append(changes, SettingChange{old, key, old.Values[key], value})
+			}
+		}
+		for _, key := range current.keys() {
+			if _, ok := old.Values[key]; !ok {
+				changes = append(changes, SettingChange{current, key, "", current.Values[key]})
+			}
+		}
+	}
+	for _, current := range other.Settings {
+		if seen[current.key()] {
+			continue
+		}
+		for _, key := range current.keys() {
+			changes = append(changes, SettingChange{current, key, "", current.Values[key]})
+		}
+	}
+	return changes
+}
+
+func (s *Settings) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func LoadSettings(path string) (*Settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := &Settings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// ReadSettings asks the printer for its settings with M503.
+func ReadSettings(ctx Context) (*Settings, error) {
+	reply, err := queryCode(ctx, NewCode("M503", "report settings"), ctx.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSettings(reply)
+}
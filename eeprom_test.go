@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var m503Reply = []string{
+	"echo:; Steps per unit:",
+	"echo: M92 X80.00 Y80.00 Z400.00 E93.00",
+	"echo:; Maximum feedrates (units/s):",
+	"echo:  M203 X500.00 Y500.00 Z5.00 E25.00",
+	"echo:; Acceleration (units/s2): P<print_accel> R<retract_accel> T<travel_accel>",
+	"echo:  M204 P500.00 R1000.00 T500.00",
+	"echo:; Hotend PID:",
+	"echo:  M301 P21.73 I1.54 D76.55",
+	"echo:; Material heatup parameters:",
+	"echo:  M145 S0 H185 B45 F255",
+	"echo:  M145 S1 H240 B110 F255",
+	"echo:; Linear Advance:",
+	"echo:  M900 K0.05",
+}
+
+func TestParseSettings(t *testing.T) {
+	settings, err := ParseSettings(m503Reply)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(settings.Settings))
+	assert.Equal(t, 93.0, settings.StepsPerUnit()["E"])
+	assert.Equal(t, 1000.0, settings.Accelerations()["R"])
+	assert.Equal(t, 0.05, settings.LinearAdvance()["K"])
+	assert.Equal(t, PID{21.73, 1.54, 76.55}, settings.HotendPID())
+	preset, ok := settings.Get("M145", "S1")
+	assert.True(t, ok)
+	assert.Equal(t, "240", preset.Values["H"])
+
+	var emitted []string
+	for _, code := range settings.Codes() {
+		emitted = append(emitted, code.Emit(0))
+	}
+	assert.Equal(t, "M92 X80.00 Y80.00 Z400.00 E93.00 ;steps per unit", emitted[0])
+	assert.Equal(t, "M145 S1 B110 F255 H240 ;material preset S1", emitted[5])
+
+	_, err = ParseSettings([]string{"ok"})
+	assert.NotNil(t, err)
+}
+
+func TestSettingsDiffAndBackup(t *testing.T) {
+	old, err := ParseSettings(m503Reply)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "backup.json")
+	assert.Nil(t, old.Save(path))
+	backup, err := LoadSettings(path)
+	assert.Nil(t, err)
+	assert.Equal(t, old, backup)
+	assert.Empty(t, backup.Diff(old))
+
+	current, err := ParseSettings([]string{
+		"M92 X80 Y80 Z400 E94.9",
+		"M203 X500.00 Y500.00 Z5.00 E25.00",
+		"M204 P500.00 R1000.00 T500.00",
+		"M301 P21.73 I1.54 D76.55",
+		"M145 S0 H185 B45 F255",
+		"M145 S1 H240 B110 F255",
+		"M851 Z-1.5",
+	})
+	assert.Nil(t, err)
+	var changes []string
+	for _, change := range backup.Diff(current) {
+		changes = append(changes, change.String())
+	}
+	assert.Equal(t, []string{
+		"M92 E (steps per unit): 93.00 -> 94.9",
+		"M900 K (linear advance): 0.05 -> -",
+		"M851 Z (probe offset): - -> -1.5",
+	}, changes)
+}
+
+func TestEEPROMCommand(t *testing.T) {
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if line == "M503" {
+			return append(m503Reply, "ok")
+		}
+		return []string{"ok"}
+	})
+
+	path := filepath.Join(t.TempDir(), "backup.json")
+	assert.Nil(t, dispatch(ctx, "eeprom backup "+path))
+	assert.Nil(t, dispatch(ctx, "eeprom diff "+path))
+	assert.Contains(t, ui.Lines(), "No changes since "+path)
+
+	ui.Commands() <- Command{"y", ui}
+	assert.Nil(t, dispatch(ctx, "eeprom restore "+path))
+	waitFor(t, func() bool { return len(received()) == 10 })
+	sent := received()
+	assert.Equal(t, "M92 X80.00 Y80.00 Z400.00 E93.00", sent[2])
+	assert.Equal(t, "M500", sent[9])
+	assert.True(t, strings.HasPrefix(sent[8], "M900"))
+}
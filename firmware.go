@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Capabilities reported in M115's "Cap:" lines that we make use of.
+const (
+	CapEEPROM          = "EEPROM"
+	CapAutoReportTemp  = "AUTOREPORT_TEMP"
+	CapAutoLevel       = "AUTOLEVEL"
+	CapArcs            = "ARCS"
+	CapEmergencyParser = "EMERGENCY_PARSER"
+	CapPromptSupport   = "PROMPT_SUPPORT"
+	CapBinaryTransfer  = "BINARY_FILE_TRANSFER"
+	CapLongFilename    = "LONG_FILENAME"
+)
+
+// Firmware is what the printer told us about itself in reply to M115.
+type Firmware struct {
+	Name         string
+	Version      string
+	Fields       map[string]string // FIRMWARE_NAME, MACHINE_TYPE, EXTRUDER_COUNT...
+	Capabilities map[string]bool
+}
+
+var firmwareFieldRe = regexp.MustCompile(`([A-Z][A-Z_]+):`)
+
+// ParseFirmware reads an M115 reply, e.g.
+//
+//	FIRMWARE_NAME:Marlin 2.1.2 (Jan  1 2023) SOURCE_CODE_URL:github.com/MarlinFirmware/Marlin PROTOCOL_VERSION:1.0 MACHINE_TYPE:Ender-3
+//	Cap:EEPROM:1
+//	Cap:AUTOREPORT_TEMP:1
+func ParseFirmware(lines []string) (*Firmware, error) {
+	firmware := &Firmware{Fields: make(map[string]string), Capabilities: make(map[string]bool)}
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "echo:"))
+		if strings.HasPrefix(line, "Cap:") {
+			parts := strings.SplitN(strings.TrimPrefix(line, "Cap:"), ":", 2)
+			firmware.Capabilities[parts[0]] = len(parts) == 2 && strings.TrimSpace(parts[1]) == "1"
+			continue
+		}
+		if !strings.Contains(line, "FIRMWARE_NAME:") {
+			continue
+		}
+		// values run up to the next KEY:, and may contain spaces
+		fields := firmwareFieldRe.FindAllStringSubmatchIndex(line, -1)
+		for idx, field := range fields {
+			end := len(line)
+			if idx+1 < len(fields) {
+				end = fields[idx+1][0]
+			}
+			firmware.Fields[line[field[2]:field[3]]] = strings.TrimSpace(line[field[1]:end])
+		}
+	}
+	name, ok := firmware.Fields["FIRMWARE_NAME"]
+	if !ok {
+		return nil, fmt.Errorf("no firmware name in the printer's reply")
+	}
+	words := strings.Fields(name)
+	if len(words) > 0 {
+		firmware.Name = words[0]
+	}
+	if version, ok := firmware.Fields["FIRMWARE_VERSION"]; ok {
+		firmware.Version = version
+	} else if len(words) > 1 {
+		firmware.Version = words[1]
+	}
+	return firmware, nil
+}
+
+// Has reports whether the firmware claims a capability.
+func (f *Firmware) Has(capability string) bool {
+	return f != nil && f.Capabilities[capability]
+}
+
+// Describe lists everything we know, for the firmware command.
+func (f *Firmware) Describe() []string {
+	lines := []string{fmt.Sprintf("%s %s", f.Name, f.Version)}
+	keys := make([]string, 0, len(f.Fields))
+	for key := range f.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %s", key, f.Fields[key]))
+	}
+	caps := make([]string, 0, len(f.Capabilities))
+	for capability, enabled := range f.Capabilities {
+		if enabled {
+			caps = append(caps, capability)
+		}
+	}
+	sort.Strings(caps)
+	return append(lines, "  Capabilities: "+strings.Join(caps, " "))
+}
+
+// Features are the host behaviours chosen from the firmware's
+// capabilities.
+type Features struct {
+	AutoReport  bool // M155 temperature reports rather than polling M105
+	Arcs        bool // send G2/G3 rather than linearising them
+	HostPrompts bool // answer //action:prompt with M876
+}
+
+func (f *Firmware) Features() Features {
+	return Features{
+		AutoReport:  f.Has(CapAutoReportTemp),
+		Arcs:        f.Has(CapArcs),
+		HostPrompts: f.Has(CapPromptSupport),
+	}
+}
+
+func (f Features) String() string {
+	describe := func(on bool, yes, no string) string {
+		if on {
+			return yes
+		}
+		return no
+	}
+	return strings.Join([]string{
+		describe(f.AutoReport, "temperatures auto-reported (M155)", "temperatures polled (M105)"),
+		describe(f.Arcs, "arcs sent as G2/G3", "arcs linearised"),
+		describe(f.HostPrompts, "host prompts answered (M876)", "no host prompts"),
+	}, ", ")
+}
+
+// Setup enables the features on the printer.
+func (f Features) Setup(interval uint) []Code {
+	codes := make([]Code, 0, 2)
+	if f.AutoReport {
+		codes = append(codes, NewCode("M155", "auto-report temperatures", Param{'S', UintStr(interval)}))
+	}
+	if f.HostPrompts {
+		codes = append(codes, NewCode("M876", "host prompt support", IntParam('P', 1)))
+	}
+	return codes
+}
+
+// DetectFirmware asks the printer what it is with M115, then configures
+// the printer and host for what it supports.
+func DetectFirmware(ctx Context) (*Firmware, error) {
+	reply, err := queryCode(ctx, NewCode("M115", "firmware info"), ctx.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	firmware, err := ParseFirmware(reply)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Printer.SetFirmware(firmware)
+	features := firmware.Features()
+	interval := uint(math.Max(1, math.Round(ctx.Printer.PollInterval.Seconds())))
+	if err := sendCodes(ctx, features.Setup(interval)...); err != nil {
+		return nil, err
+	}
+	return firmware, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var m115Reply = []string{
+	"FIRMWARE_NAME:Marlin 2.1.2 (Jan  1 2023 12:00:00) SOURCE_CODE_URL:github.com/MarlinFirmware/Marlin PROTOCOL_VERSION:1.0 MACHINE_TYPE:Ender-3 V2 EXTRUDER_COUNT:1",
+	"Cap:SERIAL_XON_XOFF:0",
+	"Cap:EEPROM:1",
+	"Cap:AUTOREPORT_TEMP:1",
+	"Cap:ARCS:0",
+	"Cap:PROMPT_SUPPORT:1",
+}
+
+func TestParseFirmware(t *testing.T) {
+	firmware, err := ParseFirmware(m115Reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "Marlin", firmware.Name)
+	assert.Equal(t, "2.1.2", firmware.Version)
+	assert.Equal(t, "Ender-3 V2", firmware.Fields["MACHINE_TYPE"])
+	assert.Equal(t, "1", firmware.Fields["EXTRUDER_COUNT"])
+	assert.True(t, firmware.Has(CapEEPROM))
+	assert.False(t, firmware.Has(CapArcs))
+	assert.False(t, firmware.Has(CapEmergencyParser))
+	assert.Equal(t, Features{AutoReport: true, HostPrompts: true}, firmware.Features())
+
+	firmware, err = ParseFirmware([]string{"FIRMWARE_NAME: RepRapFirmware for Duet 3 MB6HC FIRMWARE_VERSION: 3.4.5 ELECTRONICS: Duet 3"})
+	assert.Nil(t, err)
+	assert.Equal(t, "RepRapFirmware", firmware.Name)
+	assert.Equal(t, "3.4.5", firmware.Version)
+
+	_, err = ParseFirmware([]string{"ok"})
+	assert.NotNil(t, err)
+
+	var unknown *Firmware
+	assert.Equal(t, Features{}, unknown.Features())
+}
+
+func TestDetectFirmwareAndPrompts(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+	ctx.Printer = NewPrinter(host, ui, ctx.Remote, time.Second)
+	received := simulate(device, func(line string) []string {
+		switch line {
+		case "M115":
+			return append(m115Reply, "ok")
+		case "M876 P1":
+			return []string{"ok", "//action:prompt_begin Filament runout", "//action:prompt_button Continue",
+				"//action:prompt_button Purge more", "//action:prompt_show"}
+		}
+		return []string{"ok"}
+	})
+	prompts := make(chan Event, 1)
+	ctx.Printer.OnEvent(func(event Event) {
+		if event.Kind == EventPrompt {
+			prompts <- event
+		}
+	})
+	ctx.Printer.Start()
+	defer ctx.Printer.Close()
+
+	assert.Nil(t, dispatch(ctx, "firmware"))
+	assert.Contains(t, ui.Lines(), "Marlin 2.1.2")
+	assert.Contains(t, ui.Lines(), "  Using: temperatures auto-reported (M155), arcs linearised, host prompts answered (M876)")
+	assert.Equal(t, "Filament runout [0] Continue [1] Purge more", (<-prompts).Text)
+
+	assert.Nil(t, dispatch(ctx, "answer 1"))
+	waitFor(t, func() bool { return len(received()) == 4 })
+	assert.Equal(t, []string{"M115", "M155 S1", "M876 P1", "M876 S1"}, received())
+}
+
+func TestDetectFirmwareKlipper(t *testing.T) {
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if line == "M115" {
+			return []string{"ok FIRMWARE_NAME:Klipper FIRMWARE_VERSION:v0.12.0-114-ga3b5b7b8"}
+		}
+		return []string{"ok"}
+	})
+	ctx.Dialect = Dialects["klipper"]
+
+	assert.Nil(t, dispatch(ctx, "firmware"))
+	assert.Equal(t, "Klipper", ctx.Printer.Firmware().Name)
+	assert.Contains(t, ui.Lines(), "Klipper v0.12.0-114-ga3b5b7b8")
+	assert.Equal(t, []string{"M115"}, received())
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Real-time commands are single bytes GRBL acts on as soon as they
+// arrive, ahead of anything buffered.
+const (
+	RealtimeStatus    = '?'
+	RealtimeHold      = '!'
+	RealtimeResume    = '~'
+	RealtimeReset     = 0x18 // Ctrl-X
+	RealtimeJogCancel = 0x85
+)
+
+// GrblReceiveBuffer is the size of GRBL's serial receive buffer.
+const GrblReceiveBuffer = 128
+
+// grbl drives CNC machines and lasers: no heaters or extruders, homing
+// with $H, lines streamed by character counting, and a rejected line
+// gets "error:N" instead of "ok".
+type grbl struct{}
+
+func (grbl) Name() string                                         { return "grbl" }
+func (grbl) Numbered() bool                                       { return false }
+func (grbl) SetsLineNumber(code Code) bool                        { return false }
+func (grbl) ParseTemperatures(line string) map[string]Temperature { return nil }
+func (grbl) ReceiveBuffer() int                                   { return GrblReceiveBuffer }
+func (grbl) Features() Features                                   { return Features{Arcs: true} }
+
+func (grbl) Translate(code Code) []Code {
+	if _, ok := toolOf(code); ok {
+		return nil
+	}
+	switch code.GCode {
+	case "G28":
+		return []Code{NewCode("$H", code.Comment)}
+	case "M400":
+		return []Code{Dwell(0)}
+	case "G0", "G1", "G2", "G3":
+		if code.Has('E') {
+			code.Remove('E')
+			if len(code.Parameters) == 0 {
+				return nil
+			}
+		}
+		return []Code{code}
+	case "M82", "M83", "M84", "M104", "M105", "M106", "M107", "M109", "M110",
+		"M115", "M140", "M155", "M190", "M218", "M220", "M221", "M420", "M500", "M876", "M900":
+		return nil
+	}
+	return []Code{code}
+}
+
+func (grbl) Reply(line string) Reply {
+	switch {
+	case line == "ok":
+		return Reply{ReplyOk, ""}
+	case strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">"):
+		return Reply{ReplyStatus, line}
+	case strings.HasPrefix(line, "error:"):
+		return Reply{ReplyRejected, describeGrbl(line, GrblErrors)}
+	case strings.HasPrefix(line, "ALARM:"):
+		return Reply{ReplyError, describeGrbl(line, GrblAlarms)}
+	case strings.HasPrefix(line, "Grbl "):
+		return Reply{ReplyStart, line}
+	}
+	return Reply{ReplyInfo, line}
+}
+
+// GrblErrors describe the codes in "error:N" replies.
+var GrblErrors = map[int]string{
+	1:  "Expected command letter",
+	2:  "Bad number format",
+	3:  "Invalid $ statement",
+	4:  "Negative value",
+	5:  "Homing not enabled",
+	6:  "Step pulse too short",
+	7:  "EEPROM read failed, defaults restored",
+	8:  "$ command only valid when idle",
+	9:  "G-code locked out during alarm or jog",
+	10: "Soft limits need homing enabled",
+	11: "Line too long",
+	12: "Step rate exceeded",
+	13: "Safety door opened",
+	14: "Startup line too long",
+	15: "Jog target exceeds machine travel",
+	16: "Invalid jog command",
+	17: "Laser mode requires PWM output",
+	20: "Unsupported command",
+	21: "Modal group violation",
+	22: "Undefined feed rate",
+	23: "Command requires an integer value",
+	24: "Two commands need axis words",
+	25: "Word repeated in block",
+	26: "Axis words missing",
+	27: "Invalid line number",
+	28: "Value word missing",
+	29: "Unsupported coordinate system",
+	30: "G53 needs G0 or G1",
+	31: "Unused axis words",
+	32: "Arc without axis words in plane",
+	33: "Invalid motion target",
+	34: "Arc radius error",
+	35: "Arc offset missing",
+	36: "Unused words",
+	37: "Tool length offset not on configured axis",
+	38: "Tool number too large",
+}
+
+// GrblAlarms describe the codes in "ALARM:N" reports; after one GRBL
+// refuses G-code until it is homed or unlocked with $X.
+var GrblAlarms = map[int]string{
+	1:  "Hard limit triggered, position lost",
+	2:  "Motion target exceeds machine travel",
+	3:  "Reset while in motion, position lost",
+	4:  "Probe not in expected initial state",
+	5:  "Probe did not make contact",
+	6:  "Homing reset",
+	7:  "Safety door opened while homing",
+	8:  "Homing failed to clear limit switch",
+	9:  "Homing failed to find limit switch",
+	10: "Homing failed to find second limit switch",
+}
+
+// describeGrbl appends the description of "error:N" or "ALARM:N".
+func describeGrbl(line string, descriptions map[int]string) string {
+	number, err := strconv.Atoi(line[strings.IndexRune(line, ':')+1:])
+	if description, ok := descriptions[number]; err == nil && ok {
+		return line + " " + description
+	}
+	return line
+}
+
+// GrblStatus is a report sent in reply to '?', e.g.
+// "<Run|MPos:10.000,0.000,-1.000|Bf:15,128|FS:500,8000|WCO:0.000,0.000,-2.000>".
+// Only the fields reported are set; GRBL sends WCO only now and then.
+type GrblStatus struct {
+	State   string // Idle, Run, Hold:0, Jog, Alarm, Door:1, Check, Home or Sleep
+	MPos    []float64
+	WPos    []float64
+	WCO     []float64
+	Feed    float64
+	Speed   float64
+	Blocks  int // free planner blocks
+	Bytes   int // free receive buffer
+	Pins    string
+	Unknown map[string]string
+}
+
+func parseFloats(text string) ([]float64, error) {
+	fields := strings.Split(text, ",")
+	values := make([]float64, len(fields))
+	for idx, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+func ParseGrblStatus(line string) (*GrblStatus, error) {
+	if !strings.HasPrefix(line, "<") || !strings.HasSuffix(line, ">") {
+		return nil, fmt.Errorf("not a status report: %s", line)
+	}
+	fields := strings.Split(line[1:len(line)-1], "|")
+	status := &GrblStatus{State: fields[0], Unknown: make(map[string]string)}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			status.Unknown[field] = ""
+			continue
+		}
+		values, err := parseFloats(parts[1])
+		switch parts[0] {
+		case "MPos":
+			status.MPos = values
+		case "WPos":
+			status.WPos = values
+		case "WCO":
+			status.WCO = values
+		case "FS", "F":
+			if len(values) > 0 {
+				status.Feed = values[0]
+			}
+			if len(values) > 1 {
+				status.Speed = values[1]
+			}
+		case "Bf":
+			if len(values) == 2 {
+				status.Blocks, status.Bytes = int(values[0]), int(values[1])
+			}
+		case "Pn":
+			status.Pins, err = parts[1], nil
+		default:
+			status.Unknown[parts[0]], err = parts[1], nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s in status report: %s", parts[0], parts[1])
+		}
+	}
+	return status, nil
+}
+
+// Position is the work position, worked out from the machine position
+// and offset when GRBL only reports MPos.
+func (s *GrblStatus) Position() []float64 {
+	if s.WPos != nil || s.MPos == nil || s.WCO == nil {
+		return s.WPos
+	}
+	position := make([]float64, len(s.MPos))
+	for idx := range s.MPos {
+		position[idx] = s.MPos[idx]
+		if idx < len(s.WCO) {
+			position[idx] -= s.WCO[idx]
+		}
+	}
+	return position
+}
+
+func (s *GrblStatus) String() string {
+	format := func(values []float64) string {
+		parts := make([]string, len(values))
+		for idx, value := range values {
+			parts[idx] = FormatFloat(value, 3)
+		}
+		return strings.Join(parts, ",")
+	}
+	parts := []string{s.State}
+	if s.MPos != nil {
+		parts = append(parts, "MPos:"+format(s.MPos))
+	}
+	if position := s.Position(); position != nil {
+		parts = append(parts, "WPos:"+format(position))
+	}
+	parts = append(parts, fmt.Sprintf("F:%s S:%s", FormatFloat(s.Feed, 1), FormatFloat(s.Speed, 1)))
+	if s.Pins != "" {
+		parts = append(parts, "Pn:"+s.Pins)
+	}
+	return strings.Join(parts, " ")
+}
+
+// GrblSettingNames describe the $ settings of GRBL 1.1.
+var GrblSettingNames = map[int]string{
+	0: "step pulse, us", 1: "step idle delay, ms", 2: "step port invert mask",
+	3: "direction port invert mask", 4: "step enable invert", 5: "limit pins invert",
+	6: "probe pin invert", 10: "status report mask", 11: "junction deviation, mm",
+	12: "arc tolerance, mm", 13: "report inches", 20: "soft limits", 21: "hard limits",
+	22: "homing cycle", 23: "homing direction invert mask", 24: "homing feed, mm/min",
+	25: "homing seek, mm/min", 26: "homing debounce, ms", 27: "homing pull-off, mm",
+	30: "max spindle speed, RPM", 31: "min spindle speed, RPM", 32: "laser mode",
+	100: "X steps/mm", 101: "Y steps/mm", 102: "Z steps/mm",
+	110: "X max rate, mm/min", 111: "Y max rate, mm/min", 112: "Z max rate, mm/min",
+	120: "X acceleration, mm/s^2", 121: "Y acceleration, mm/s^2", 122: "Z acceleration, mm/s^2",
+	130: "X max travel, mm", 131: "Y max travel, mm", 132: "Z max travel, mm",
+}
+
+// GrblSettings are the values listed by $$, by number.
+type GrblSettings map[int]string
+
+// ParseGrblSettings reads a $$ report of lines such as "$100=250.000".
+func ParseGrblSettings(lines []string) (GrblSettings, error) {
+	settings := make(GrblSettings)
+	for _, line := range lines {
+		number, value, ok := parseGrblSetting(line)
+		if ok {
+			settings[number] = value
+		}
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("no settings in GRBL's reply")
+	}
+	return settings, nil
+}
+
+func parseGrblSetting(text string) (int, string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(text), "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "$") {
+		return 0, "", false
+	}
+	number, err := strconv.Atoi(parts[0][1:])
+	return number, strings.TrimSpace(parts[1]), err == nil
+}
+
+// Describe lists the settings in order, named where known.
+func (s GrblSettings) Describe() []string {
+	numbers := make([]int, 0, len(s))
+	for number := range s {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	lines := make([]string, 0, len(numbers))
+	for _, number := range numbers {
+		line := fmt.Sprintf("$%d=%s", number, s[number])
+		if name, ok := GrblSettingNames[number]; ok {
+			line += " (" + name + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// GrblSetting changes one setting, given as "$100=250" or "100=250".
+func GrblSetting(assignment string) (Code, error) {
+	if !strings.HasPrefix(assignment, "$") {
+		assignment = "$" + assignment
+	}
+	number, value, ok := parseGrblSetting(assignment)
+	if !ok || value == "" {
+		return Code{}, fmt.Errorf("expected $<n>=<value>, not %s", assignment)
+	}
+	return NewCode(fmt.Sprintf("$%d=%s", number, value), GrblSettingNames[number]), nil
+}
+
+// Jog moves relative to the current position; GRBL cancels jogs with
+// RealtimeJogCancel rather than waiting for them to finish.
+func Jog(feed float64, params ...Param) Code {
+	return NewCode("$J=G91", "jog", append(params, FloatParam('F', feed))...)
+}
+
+// Realtime writes a real-time command straight to the port, ahead of
+// anything queued. A reset also discards what GRBL had buffered, so the
+// host aborts first, leaving nothing to follow it.
+func (p *Printer) Realtime(command byte) error {
+	if command == RealtimeReset {
+		p.Abort()
+	}
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	_, err := p.port.Write([]byte{command})
+	return err
+}
+
+// grblStop resets GRBL at once or, for a quick stop, once a feed hold
+// has brought it to rest so that it keeps its position. It resets
+// regardless if it can't tell.
+func (p *Printer) grblStop(hold bool) error {
+	var err error
+	if hold {
+		if err = p.Realtime(RealtimeHold); err != nil {
+			return err
+		}
+		err = p.grblAwaitRest()
+	}
+	if resetErr := p.Realtime(RealtimeReset); resetErr != nil {
+		return resetErr
+	}
+	return err
+}
+
+// grblAwaitRest polls status until the machine has stopped moving.
+func (p *Printer) grblAwaitRest() error {
+	deadline := time.Now().Add(p.Timeout)
+	for {
+		status, err := p.Status(p.Timeout)
+		if err != nil {
+			return err
+		}
+		switch status.State {
+		case "Run", "Jog", "Hold:1", "Home":
+		default:
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still moving after %v", p.Timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Status asks for a status report with the real-time '?'.
+func (p *Printer) Status(timeout time.Duration) (*GrblStatus, error) {
+	reports := make(chan struct{}, 1)
+	cancel := p.Watch(func(line string) {
+		if p.Dialect.Reply(line).Kind == ReplyStatus {
+			select {
+			case reports <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer cancel()
+	if err := p.Realtime(RealtimeStatus); err != nil {
+		return nil, err
+	}
+	select {
+	case <-reports:
+		return p.LastStatus(), nil
+	case <-p.done:
+		return nil, fmt.Errorf("Printer disconnected")
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("No status report within %v", timeout)
+	}
+}
+
+// LastStatus is the most recent status report, with the last work
+// coordinate offset reported filled in; nil if there hasn't been one.
+func (p *Printer) LastStatus() *GrblStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// updateStatus records a status report; the caller holds the mutex.
+func (p *Printer) updateStatus(line string) {
+	status, err := ParseGrblStatus(line)
+	if err != nil {
+		return
+	}
+	if status.WCO == nil && p.status != nil {
+		status.WCO = p.status.WCO
+	}
+	p.status = status
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGrblStatus(t *testing.T) {
+	status, err := ParseGrblStatus("<Run|MPos:10.000,5.000,-1.000|Bf:15,128|FS:500,8000|WCO:1.000,0.000,-2.000>")
+	assert.Nil(t, err)
+	assert.Equal(t, "Run", status.State)
+	assert.Equal(t, []float64{10, 5, -1}, status.MPos)
+	assert.Equal(t, []float64{9, 5, 1}, status.Position())
+	assert.Equal(t, 500.0, status.Feed)
+	assert.Equal(t, 8000.0, status.Speed)
+	assert.Equal(t, 15, status.Blocks)
+	assert.Equal(t, 128, status.Bytes)
+	assert.Equal(t, "Run MPos:10,5,-1 WPos:9,5,1 F:500 S:8000", status.String())
+
+	status, err = ParseGrblStatus("<Hold:0|WPos:1.500,2.000,0.000|F:0|Pn:XZ|Ov:100,100,100>")
+	assert.Nil(t, err)
+	assert.Equal(t, "Hold:0", status.State)
+	assert.Equal(t, []float64{1.5, 2, 0}, status.Position())
+	assert.Equal(t, "XZ", status.Pins)
+	assert.Equal(t, map[string]string{"Ov": "100,100,100"}, status.Unknown)
+
+	_, err = ParseGrblStatus("<Idle|MPos:a,b,c>")
+	assert.EqualError(t, err, "bad MPos in status report: a,b,c")
+	_, err = ParseGrblStatus("ok")
+	assert.EqualError(t, err, "not a status report: ok")
+}
+
+func TestGrblSettings(t *testing.T) {
+	settings, err := ParseGrblSettings([]string{"$110=5000.000", "$0=10", "[MSG:'$H'|'$X' to unlock]", "$100=250.000"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"$0=10 (step pulse, us)",
+		"$100=250.000 (X steps/mm)",
+		"$110=5000.000 (X max rate, mm/min)",
+	}, settings.Describe())
+	_, err = ParseGrblSettings([]string{"ok"})
+	assert.NotNil(t, err)
+
+	code, err := GrblSetting("100=80")
+	assert.Nil(t, err)
+	assert.Equal(t, "$100=80 ;X steps/mm", code.Emit(0))
+	_, err = GrblSetting("$X=1")
+	assert.EqualError(t, err, "expected $<n>=<value>, not $X=1")
+
+	jog := Jog(500, FloatParam('X', 10), FloatParam('Y', -2.5))
+	assert.Equal(t, "$J=G91 X10 Y-2.5 F500 ;jog", jog.Emit(0))
+}
+
+// simulateGrbl acts as GRBL on the far end of conn: real-time '?' gets a
+// status report at once, while lines are only acknowledged when ack is
+// signalled. The function returned gives the lines received so far.
+func simulateGrbl(conn net.Conn, ack chan struct{}) func() []string {
+	received := make([]string, 0, 16)
+	var mutex sync.Mutex
+	var writes sync.Mutex
+	write := func(line string) {
+		writes.Lock()
+		defer writes.Unlock()
+		conn.Write([]byte(line + "\n"))
+	}
+	go func() {
+		for range ack {
+			write("ok")
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 256)
+		line := ""
+		for {
+			count, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			for _, char := range buffer[:count] {
+				switch char {
+				case RealtimeStatus:
+					write("<Idle|MPos:1.000,2.000,3.000|FS:0,0|WCO:0.000,0.000,1.000>")
+				case RealtimeHold, RealtimeReset:
+					mutex.Lock()
+					received = append(received, fmt.Sprintf("0x%02x", char))
+					mutex.Unlock()
+				case '\n':
+					mutex.Lock()
+					received = append(received, line)
+					mutex.Unlock()
+					line = ""
+				default:
+					line += string(char)
+				}
+			}
+		}
+	}()
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func TestGrblStreaming(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	p.Dialect = Dialects["grbl"]
+	ack := make(chan struct{})
+	defer close(ack)
+	received := simulateGrbl(device, ack)
+	p.Start()
+	defer p.Close()
+
+	// three 60 byte lines: two fit in GRBL's 128 byte buffer
+	lines := []string{"G1 X1", "G1 X2", "G1 X3"}
+	for idx := range lines {
+		lines[idx] += strings.Repeat(" ", 59-len(lines[idx]))
+		remote <- lines[idx]
+	}
+	waitFor(t, func() bool { return len(received()) == 2 })
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, lines[:2], received())
+	assert.False(t, p.Idle())
+
+	ack <- struct{}{}
+	waitFor(t, func() bool { return len(received()) == 3 })
+	ack <- struct{}{}
+	ack <- struct{}{}
+	assert.Nil(t, p.WaitForIdle(time.Second))
+
+	status, err := p.Status(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "Idle MPos:1,2,3 WPos:1,2,2 F:0 S:0", status.String())
+
+	// a reset discards whatever GRBL had buffered
+	remote <- "G1 X4"
+	waitFor(t, func() bool { return len(received()) == 4 })
+	assert.False(t, p.Idle())
+	assert.Nil(t, p.Realtime(RealtimeReset))
+	assert.Nil(t, p.WaitForIdle(time.Second))
+	assert.Empty(t, ui.Errors())
+}
+
+func TestGrblQuickstop(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	p.Dialect = Dialects["grbl"]
+	ack := make(chan struct{})
+	defer close(ack)
+	received := simulateGrbl(device, ack)
+	p.Start()
+	defer p.Close()
+
+	remote <- "G1 X10"
+	waitFor(t, func() bool { return len(received()) == 1 })
+	assert.False(t, p.Idle())
+	// a feed hold first, so GRBL keeps its position through the reset
+	assert.Nil(t, p.Emergency(NewCode("M410", "")))
+	waitFor(t, func() bool { return len(received()) == 3 })
+	assert.Equal(t, []string{"G1 X10", "0x21", "0x18"}, received())
+	assert.True(t, p.Idle())
+
+	assert.Nil(t, p.Emergency(NewCode("M112", "")))
+	waitFor(t, func() bool { return len(received()) == 4 })
+	assert.Equal(t, "0x18", received()[3])
+	assert.Empty(t, ui.Errors())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"math"
+	"os"
+
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// LaserConfig describes how images are engraved; zero values take the
+// defaults below.
+type LaserConfig struct {
+	DPI        float64 `json:"dpi,omitempty"`       // image pixels per inch on the work
+	MinPower   float64 `json:"min_power,omitempty"` // S for the lightest pixel that burns
+	MaxPower   float64 `json:"max_power,omitempty"` // S for black, e.g. GRBL's $30
+	Feed       float64 `json:"feed,omitempty"`      // mm/min while burning
+	TravelFeed float64 `json:"travel_feed,omitempty"`
+	Overscan   float64 `json:"overscan,omitempty"` // mm run unpowered past each end of a line
+	X          float64 `json:"x,omitempty"`        // bottom left corner of the image
+	Y          float64 `json:"y,omitempty"`
+
+	Dither         bool `json:"dither,omitempty"`         // on/off dots rather than grey levels
+	Unidirectional bool `json:"unidirectional,omitempty"` // burn every line left to right
+	ConstantPower  bool `json:"constant_power,omitempty"` // M3, rather than M4 scaling power with speed
+}
+
+func (c LaserConfig) withDefaults() LaserConfig {
+	if c.DPI == 0 {
+		c.DPI = 254
+	}
+	if c.MaxPower == 0 {
+		c.MaxPower = 1000
+	}
+	if c.Feed == 0 {
+		c.Feed = 3000
+	}
+	if c.TravelFeed == 0 {
+		c.TravelFeed = 6000
+	}
+	if c.Overscan == 0 {
+		c.Overscan = 2
+	}
+	return c
+}
+
+// pitch is the size of a pixel in mm.
+func (c LaserConfig) pitch() float64 {
+	return 25.4 / c.DPI
+}
+
+// power is S for a level between 0 (white) and 1 (black).
+func (c LaserConfig) power(level float64) int {
+	if level <= 0 {
+		return 0
+	}
+	return int(math.Round(c.MinPower + level*(c.MaxPower-c.MinPower)))
+}
+
+// LoadImage reads a PNG or JPEG.
+func LoadImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// darkness converts an image to levels from 0 (white, or transparent) to
+// 1 (black), by row from the top.
+func darkness(img image.Image) [][]float64 {
+	bounds := img.Bounds()
+	levels := make([][]float64, bounds.Dy())
+	for row := range levels {
+		levels[row] = make([]float64, bounds.Dx())
+		for col := range levels[row] {
+			r, g, b, a := img.At(bounds.Min.X+col, bounds.Min.Y+row).RGBA()
+			// premultiplied, so composite onto white by adding what's missing
+			luminance := (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/0xffff + 1 - float64(a)/0xffff
+			levels[row][col] = math.Max(0, 1-luminance)
+		}
+	}
+	return levels
+}
+
+// dither reduces levels to on or off with Floyd-Steinberg error diffusion.
+func dither(levels [][]float64) {
+	spread := func(row, col int, amount float64) {
+		if row < len(levels) && col >= 0 && col < len(levels[row]) {
+			levels[row][col] += amount
+		}
+	}
+	for row := range levels {
+		for col, level := range levels[row] {
+			dot := 0.0
+			if level >= 0.5 {
+				dot = 1
+			}
+			levels[row][col] = dot
+			diff := level - dot
+			spread(row, col+1, diff*7/16)
+			spread(row+1, col-1, diff*3/16)
+			spread(row+1, col, diff*5/16)
+			spread(row+1, col+1, diff*1/16)
+		}
+	}
+}
+
+// Raster engraves an image line by line, one pixel per dot at the
+// configured DPI. Each line runs at constant speed from the first to the
+// last pixel that burns, accelerating and slowing down in the overscan,
+// and pixels of equal power are merged into single moves.
+func Raster(img image.Image, config LaserConfig) ([]Code, error) {
+	config = config.withDefaults()
+	levels := darkness(img)
+	if config.Dither {
+		dither(levels)
+	}
+	pitch := config.pitch()
+	mode := NewCode("M4", "laser on, dynamic power", IntParam('S', 0))
+	if config.ConstantPower {
+		mode = NewCode("M3", "laser on, constant power", IntParam('S', 0))
+	}
+	codes := []Code{
+		NewCode("G21", "millimetres"),
+		AbsolutePositioning(),
+		mode,
+	}
+	lines, forward := 0, true
+	for row, line := range levels {
+		powers := make([]int, len(line))
+		first, last := -1, -1
+		for col, level := range line {
+			if powers[col] = config.power(level); powers[col] > 0 {
+				if first < 0 {
+					first = col
+				}
+				last = col
+			}
+		}
+		if first < 0 {
+			continue
+		}
+		lines++
+		y := config.Y + float64(len(levels)-1-row)*pitch
+		edge := func(col int) float64 { return config.X + float64(col)*pitch }
+		start, end, step, overscan := first, last+1, 1, config.Overscan
+		if !forward {
+			start, end, step, overscan = last+1, first, -1, -overscan
+		}
+		codes = append(codes,
+			Travel(FloatParam('X', edge(start)-overscan), FloatParam('Y', y), FloatParam('F', config.TravelFeed)),
+			Move(FloatParam('X', edge(start)), IntParam('S', 0), FloatParam('F', config.Feed)),
+		)
+		// the pixel after an edge is to its right going forwards, but to
+		// its left coming back
+		pixel := func(col int) int {
+			if step < 0 {
+				return col - 1
+			}
+			return col
+		}
+		for col := start; col != end; {
+			power := powers[pixel(col)]
+			next := col + step
+			for next != end && powers[pixel(next)] == power {
+				next += step
+			}
+			codes = append(codes, Move(FloatParam('X', edge(next)), IntParam('S', power)))
+			col = next
+		}
+		codes = append(codes, Move(FloatParam('X', edge(end)+overscan), IntParam('S', 0)))
+		if !config.Unidirectional {
+			forward = !forward
+		}
+	}
+	if lines == 0 {
+		return nil, errors.New("nothing to engrave: the image is blank")
+	}
+	return append(codes, NewCode("M5", "laser off")), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testImage(rows ...[]uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, value := range row {
+			img.SetGray(x, y, color.Gray{value})
+		}
+	}
+	return img
+}
+
+func TestRaster(t *testing.T) {
+	config := LaserConfig{DPI: 25.4, MaxPower: 100, Overscan: 1}
+	img := testImage(
+		[]uint8{255, 0, 0, 128},
+		[]uint8{0, 255, 255, 255},
+		[]uint8{255, 255, 255, 255},
+	)
+	codes, err := Raster(img, config)
+	assert.Nil(t, err)
+	assert.Equal(t, `G21 ;millimetres
+G90 ;absolute positioning
+M4 S0 ;laser on, dynamic power
+G0 X0 Y2 F6000 ;travel
+G1 X1 S0 F3000 ;move
+G1 X3 S100 ;move
+G1 X4 S50 ;move
+G1 X5 S0 ;move
+G0 X2 Y1 F6000 ;travel
+G1 X1 S0 F3000 ;move
+G1 X0 S100 ;move
+G1 X-1 S0 ;move
+M5 ;laser off`, emitAll(codes))
+}
+
+func TestRasterDither(t *testing.T) {
+	config := LaserConfig{DPI: 25.4, MaxPower: 100, Dither: true, Unidirectional: true}
+	codes, err := Raster(testImage([]uint8{128, 128, 128, 128}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, `G21 ;millimetres
+G90 ;absolute positioning
+M4 S0 ;laser on, dynamic power
+G0 X-1 Y0 F6000 ;travel
+G1 X1 S0 F3000 ;move
+G1 X2 S100 ;move
+G1 X3 S0 ;move
+G1 X4 S100 ;move
+G1 X6 S0 ;move
+M5 ;laser off`, emitAll(codes))
+
+	_, err = Raster(testImage([]uint8{255, 255}), config)
+	assert.EqualError(t, err, "nothing to engrave: the image is blank")
+}
+
+func TestLoadImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logo.png")
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, png.Encode(file, testImage([]uint8{0, 255})))
+	assert.Nil(t, file.Close())
+
+	img, err := LoadImage(path)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float64{{1, 0}}, darkness(img))
+	_, err = LoadImage(filepath.Join(t.TempDir(), "missing.png"))
+	assert.NotNil(t, err)
+}
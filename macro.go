@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxMacroDepth = 16
+
+type MacroParam struct {
+	Name    string `json:"name"`
+	Default string `json:"default,omitempty"`
+}
+
+// Macro is a named sequence of REPL commands and raw G-code. Lines may
+// refer to parameters as {name}, or to simple arithmetic on them such as
+// {temp+5}.
+type Macro struct {
+	Params []MacroParam `json:"params,omitempty"`
+	Lines  []string     `json:"lines"`
+}
+
+// ParseMacro takes a definition of the form
+//
+//	param1 param2=default : line | line | ...
+func ParseMacro(definition string) (*Macro, error) {
+	colon := strings.Index(definition, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("missing ':' before macro body")
+	}
+	macro := &Macro{}
+	for _, field := range strings.Fields(definition[:colon]) {
+		param := MacroParam{Name: field}
+		if idx := strings.Index(field, "="); idx >= 0 {
+			param = MacroParam{Name: field[:idx], Default: field[idx+1:]}
+		}
+		if !isIdentifier(param.Name) {
+			return nil, fmt.Errorf("invalid parameter name: %s", param.Name)
+		}
+		macro.Params = append(macro.Params, param)
+	}
+	for _, line := range strings.Split(definition[colon+1:], "|") {
+		if line = strings.TrimSpace(line); line != "" {
+			macro.Lines = append(macro.Lines, line)
+		}
+	}
+	if len(macro.Lines) == 0 {
+		return nil, fmt.Errorf("macro has no body")
+	}
+	return macro, nil
+}
+
+func (m *Macro) String() string {
+	params := make([]string, 0, len(m.Params))
+	for _, param := range m.Params {
+		if param.Default != "" {
+			params = append(params, param.Name+"="+param.Default)
+		} else {
+			params = append(params, param.Name)
+		}
+	}
+	return strings.TrimLeft(strings.Join(params, " ")+" : "+strings.Join(m.Lines, " | "), " ")
+}
+
+// Bind matches positional and name=value arguments to parameters.
+func (m *Macro) Bind(argv []string) (map[string]string, error) {
+	values := make(map[string]string, len(m.Params))
+	positional := 0
+	for _, arg := range argv {
+		if idx := strings.Index(arg, "="); idx > 0 {
+			name := arg[:idx]
+			if !m.hasParam(name) {
+				return nil, fmt.Errorf("unknown parameter: %s", name)
+			}
+			values[name] = arg[idx+1:]
+			continue
+		}
+		if positional >= len(m.Params) {
+			return nil, fmt.Errorf("too many arguments")
+		}
+		values[m.Params[positional].Name] = arg
+		positional++
+	}
+	for _, param := range m.Params {
+		if _, ok := values[param.Name]; ok {
+			continue
+		}
+		if param.Default == "" {
+			return nil, fmt.Errorf("missing value for parameter: %s", param.Name)
+		}
+		values[param.Name] = param.Default
+	}
+	return values, nil
+}
+
+func (m *Macro) hasParam(name string) bool {
+	for _, param := range m.Params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand substitutes the parameter values into the macro body.
+func (m *Macro) Expand(values map[string]string) ([]string, error) {
+	lines := make([]string, 0, len(m.Lines))
+	for _, line := range m.Lines {
+		expanded, err := substitute(line, values)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, expanded)
+	}
+	return lines, nil
+}
+
+func substitute(line string, values map[string]string) (string, error) {
+	var out strings.Builder
+	for {
+		open := strings.Index(line, "{")
+		if open < 0 {
+			out.WriteString(line)
+			return out.String(), nil
+		}
+		end := strings.Index(line[open:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated '{' in: %s", line)
+		}
+		out.WriteString(line[:open])
+		expr := strings.TrimSpace(line[open+1 : open+end])
+		if value, ok := values[expr]; ok {
+			// plain substitution, which needn't be numeric
+			out.WriteString(value)
+		} else {
+			value, err := Evaluate(expr, values)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		}
+		line = line[open+end+1:]
+	}
+}
+
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for idx, c := range name {
+		if !(c == '_' || unicode.IsLetter(c) || (idx > 0 && unicode.IsDigit(c))) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGCode reports whether a macro line is G-code to send to the printer
+// rather than a REPL command, e.g. "G28" or "m104 S200".
+func isGCode(line string) bool {
+	return len(line) > 1 && strings.ContainsRune("GMTgmt", rune(line[0])) && unicode.IsDigit(rune(line[1]))
+}
+
+// Evaluate computes a simple arithmetic expression: numbers, variables,
+// + - * /, unary minus and parentheses.
+func Evaluate(expr string, values map[string]string) (float64, error) {
+	e := &evaluator{input: expr, values: values}
+	result, err := e.sum()
+	if err != nil {
+		return 0, err
+	}
+	if e.skipSpace(); e.pos < len(e.input) {
+		return 0, fmt.Errorf("unexpected '%s' in {%s}", e.input[e.pos:], expr)
+	}
+	return result, nil
+}
+
+type evaluator struct {
+	input  string
+	pos    int
+	values map[string]string
+}
+
+func (e *evaluator) skipSpace() {
+	for e.pos < len(e.input) && e.input[e.pos] == ' ' {
+		e.pos++
+	}
+}
+
+func (e *evaluator) peek() byte {
+	e.skipSpace()
+	if e.pos < len(e.input) {
+		return e.input[e.pos]
+	}
+	return 0
+}
+
+func (e *evaluator) sum() (float64, error) {
+	lhs, err := e.product()
+	for err == nil {
+		op := e.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		e.pos++
+		var rhs float64
+		if rhs, err = e.product(); op == '+' {
+			lhs += rhs
+		} else {
+			lhs -= rhs
+		}
+	}
+	return lhs, err
+}
+
+func (e *evaluator) product() (float64, error) {
+	lhs, err := e.unary()
+	for err == nil {
+		op := e.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		e.pos++
+		var rhs float64
+		if rhs, err = e.unary(); err != nil {
+			break
+		}
+		if op == '*' {
+			lhs *= rhs
+		} else if rhs == 0 {
+			err = fmt.Errorf("division by zero in {%s}", e.input)
+		} else {
+			lhs /= rhs
+		}
+	}
+	return lhs, err
+}
+
+func (e *evaluator) unary() (float64, error) {
+	switch e.peek() {
+	case '-':
+		e.pos++
+		value, err := e.unary()
+		return -value, err
+	case '(':
+		e.pos++
+		value, err := e.sum()
+		if err == nil && e.peek() != ')' {
+			err = fmt.Errorf("missing ')' in {%s}", e.input)
+		}
+		e.pos++
+		return value, err
+	}
+	return e.atom()
+}
+
+func (e *evaluator) atom() (float64, error) {
+	start := e.pos
+	for e.pos < len(e.input) {
+		c := rune(e.input[e.pos])
+		if !(c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			break
+		}
+		e.pos++
+	}
+	token := e.input[start:e.pos]
+	if token == "" {
+		return 0, fmt.Errorf("expected a value in {%s}", e.input)
+	}
+	if isIdentifier(token) {
+		value, ok := e.values[token]
+		if !ok {
+			return 0, fmt.Errorf("unknown parameter: %s", token)
+		}
+		token = value
+	}
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a number: %s", token)
+	}
+	return number, nil
+}
+
+// RunMacro expands a macro with the command's arguments and runs each
+// line, stopping at the first one that fails.
+func RunMacro(ctx Context, macro *Macro) error {
+	if ctx.MacroDepth >= maxMacroDepth {
+		return fmt.Errorf("macros nested too deeply")
+	}
+	values, err := macro.Bind(ctx.Argv)
+	if err != nil {
+		return err
+	}
+	lines, err := macro.Expand(values)
+	if err != nil {
+		return err
+	}
+	ctx.MacroDepth++
+	for _, line := range lines {
+		if isGCode(line) {
+			ctx.User.WriteString("> " + line)
+			err = sendRaw(ctx, line)
+		} else {
+			err = dispatch(ctx, line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMacro(t *testing.T) {
+	macro, err := ParseMacro("temp bed=60 : M104 S{temp} | M140 S{bed} | help")
+	assert.Nil(t, err)
+	assert.Equal(t, []MacroParam{{"temp", ""}, {"bed", "60"}}, macro.Params)
+	assert.Equal(t, []string{"M104 S{temp}", "M140 S{bed}", "help"}, macro.Lines)
+	assert.Equal(t, "temp bed=60 : M104 S{temp} | M140 S{bed} | help", macro.String())
+
+	macro, err = ParseMacro(": G28")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(macro.Params))
+	assert.Equal(t, ": G28", macro.String())
+
+	_, err = ParseMacro("G28")
+	assert.NotNil(t, err)
+	_, err = ParseMacro("x :")
+	assert.NotNil(t, err)
+	_, err = ParseMacro("1x : G28")
+	assert.NotNil(t, err)
+}
+
+func TestMacroBind(t *testing.T) {
+	macro, err := ParseMacro("temp bed=60 : M104 S{temp}")
+	assert.Nil(t, err)
+
+	values, err := macro.Bind([]string{"200"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"temp": "200", "bed": "60"}, values)
+
+	values, err = macro.Bind([]string{"bed=70", "210"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"temp": "210", "bed": "70"}, values)
+
+	_, err = macro.Bind(nil)
+	assert.EqualError(t, err, "missing value for parameter: temp")
+	_, err = macro.Bind([]string{"1", "2", "3"})
+	assert.EqualError(t, err, "too many arguments")
+	_, err = macro.Bind([]string{"nozzle=1"})
+	assert.EqualError(t, err, "unknown parameter: nozzle")
+}
+
+func TestMacroExpand(t *testing.T) {
+	macro, err := ParseMacro("temp : M104 S{temp} | M109 R{ temp + 5 } | echo {temp*2/(1+3)}")
+	assert.Nil(t, err)
+	lines, err := macro.Expand(map[string]string{"temp": "200"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"M104 S200", "M109 R205", "echo 100"}, lines)
+
+	_, err = macro.Expand(map[string]string{"temp": "hot"})
+	assert.EqualError(t, err, "not a number: hot")
+}
+
+func TestEvaluate(t *testing.T) {
+	values := map[string]string{"a": "2", "b": "0.5"}
+	for expr, expected := range map[string]float64{
+		"1":         1,
+		"-a":        -2,
+		"a+b*4":     4,
+		"(a+b)*4":   10,
+		"a - -b":    2.5,
+		"10/a/5":    1,
+		"1.25 * a ": 2.5,
+	} {
+		value, err := Evaluate(expr, values)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, expected, value, expr)
+	}
+	for _, expr := range []string{"", "a+", "(a", "a b", "c", "a/0"} {
+		_, err := Evaluate(expr, values)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestRunMacro(t *testing.T) {
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+
+	inner, err := ParseMacro("t : M104 S{t} | M109 S{t}")
+	assert.Nil(t, err)
+	outer, err := ParseMacro("temp=200 : G28 | heat {temp+10}")
+	assert.Nil(t, err)
+	ctx.Profile.Macros["heat"] = inner
+	ctx.Profile.Macros["prep"] = outer
+
+	assert.Nil(t, dispatch(ctx, "prep"))
+	close(ctx.Remote)
+	sent := []string{}
+	for raw := range ctx.Remote {
+		sent = append(sent, raw)
+	}
+	assert.Equal(t, []string{"G28", "M104 S210", "M109 S210"}, sent)
+	assert.Equal(t, []string{"> prep", "> G28", "> heat 210", "> M104 S210", "> M109 S210"}, ui.Lines())
+
+	ctx.Profile.Macros["loop"], _ = ParseMacro(": loop")
+	err = dispatch(ctx, "loop")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "macros nested too deeply")
+}
+
+func TestDefineMacro(t *testing.T) {
+	ctx := Context{User: newTestUserInterface(), Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+	assert.Nil(t, dispatch(ctx, "macro define warm t=200 : M104 S{t}"))
+	assert.Equal(t, "t=200 : M104 S{t}", ctx.Profile.Macros["warm"].String())
+
+	err := dispatch(ctx, "macro define wait : G4 S1")
+	assert.EqualError(t, err, "'macro': can't define wait: it's a built-in command, which would always run instead")
+	assert.Nil(t, ctx.Profile.Macros["wait"])
+
+	path := filepath.Join(t.TempDir(), "profile.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"macros": {"help": {"lines": ["G28"]}}}`), 0644))
+	_, err = LoadProfile(path)
+	assert.EqualError(t, err, "macro help: it's a built-in command, which would always run instead")
+}
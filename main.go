@@ -1,85 +1,264 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 )
 
 type Context struct {
-	UseTUI  bool
-	Timeout time.Duration
-	User    UserInterfacer
-	Remote  chan string
-	Cmd     string
-	Argv    []string
+	UseTUI   bool
+	Timeout  time.Duration
+	User     UserInterfacer
+	Host     UserInterfacer
+	Remote   chan string
+	Printer  *Printer
+	Profile  *Profile
+	Dialect  Dialect
+	Scripts  *Scripting
+	Tools    *ToolChangePlanner
+	Watchdog *Watchdog
+	Cmd      string
+	Argv     []string
+	Aborted  <-chan struct{} // closed by an emergency stop during the command
+
+	MacroDepth int
 }
 
 type CommandFn func(ctx Context) error
 
-var commands = map[string]CommandFn{
-	"q":    cmd_quit,
-	"quit": cmd_quit,
-	"exit": cmd_quit,
-	"help": cmd_help,
+// stringList lets a flag be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var commands map[string]CommandFn
+
+// The table is filled in at init because commands such as macros and
+// scripts dispatch other commands in turn.
+func init() {
+	commands = map[string]CommandFn{
+		"q":    cmd_quit,
+		"quit": cmd_quit,
+		"exit": cmd_quit,
+		"help": cmd_help,
+
+		"shutdown": cmd_shutdown,
+
+		"macro":     cmd_macro,
+		"profile":   cmd_profile,
+		"script":    cmd_script,
+		"wait":      cmd_wait,
+		"tool":      cmd_tool,
+		"mesh":      cmd_mesh,
+		"tram":      cmd_tram,
+		"calibrate": cmd_calibrate,
+		"autotune":  cmd_autotune,
+		"eeprom":    cmd_eeprom,
+		"firmware":  cmd_firmware,
+		"answer":    cmd_answer,
+		"grbl":      cmd_grbl,
+		"laser":     cmd_laser,
+		"plot":      cmd_plot,
+		"estop":     cmd_estop,
+		"quickstop": cmd_quickstop,
+		"kill":      cmd_kill,
+		"watchdog":  cmd_watchdog,
+		"sd":        cmd_sd,
+	}
+}
+
+// urgentCommands are run as soon as they're entered, rather than after
+// the command in progress, which may be the very thing to stop.
+var urgentCommands = map[string]bool{"estop": true, "quickstop": true, "kill": true}
+
+func runUrgent(ctx Context, cmd Command) bool {
+	argv := strings.Fields(strings.Split(cmd.Text, "#")[0])
+	if len(argv) == 0 || !urgentCommands[argv[0]] {
+		return false
+	}
+	ctx.User = cmd.User
+	parse(ctx, cmd.Text)
+	return true
 }
 
-func sendRaw(ctx Context, raw string) {
+func sendRaw(ctx Context, raw string) error {
 	raw = strings.TrimSpace(raw)
+	select {
+	case <-ctx.Aborted:
+		// don't carry on with the rest of a job after an emergency stop
+		return errAborted
+	default:
+	}
 	timeout := time.After(ctx.Timeout)
 	for {
 		select {
 		case ctx.Remote <- raw:
 			{
-				return
+				return nil
+			}
+		case <-ctx.Aborted:
+			{
+				return errAborted
 			}
 		case <-timeout:
 			{
-				ctx.User.Error(fmt.Sprintf("Unable to send command within %v", ctx.Timeout))
-				return
+				return fmt.Errorf("Unable to send command within %v", ctx.Timeout)
 			}
 		}
 	}
 }
 
+// remoteWriter lets a Run execute onto the printer queue.
+type remoteWriter struct {
+	ctx Context
+}
+
+func (w remoteWriter) Write(data []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if err := sendRaw(w.ctx, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// sendCodes queues codes for the printer, without their comments. Arcs
+// are linearised unless the firmware is known to support them.
+func sendCodes(ctx Context, codes ...Code) error {
+	if ctx.Printer != nil && !ctx.Printer.Features().Arcs {
+		var err error
+		if codes, err = LineariseArcs(codes, ArcSegment); err != nil {
+			return err
+		}
+	}
+	run := NewRun(false, false, remoteWriter{ctx})
+	run.Dialect = dialectOf(ctx)
+	return run.ExecuteImmediate(codes...)
+}
+
+// dialectOf is the firmware dialect in use, Marlin unless the profile
+// says otherwise.
+func dialectOf(ctx Context) Dialect {
+	if ctx.Dialect == nil {
+		return Marlin
+	}
+	return ctx.Dialect
+}
+
+// queryCode sends a code once everything queued ahead of it has gone
+// and returns the printer's reply.
+func queryCode(ctx Context, code Code, timeout time.Duration) ([]string, error) {
+	if ctx.Printer == nil {
+		return nil, errNoPrinter
+	}
+	code.Comment = ""
+	dialect := dialectOf(ctx)
+	translated := dialect.Translate(code)
+	if len(translated) != 1 {
+		return nil, fmt.Errorf("%s isn't supported by %s", code.GCode, dialect.Name())
+	}
+	return ctx.Printer.Query(translated[0].EmitAs(dialect, 0), timeout)
+}
+
 func parse(ctx Context, cmd string) {
+	if err := dispatch(ctx, cmd); err != nil {
+		ctx.User.Error(err.Error())
+	}
+}
+
+// dispatch runs one line of input: raw G-code, a command or a macro.
+func dispatch(ctx Context, cmd string) error {
 	cmd = strings.TrimSpace(cmd)
 	if cmd == "" {
-		return
+		return nil
 	}
 	ctx.User.WriteString("> " + cmd)
 	cmd = strings.Split(cmd, "#")[0]
 	if cmd == "" {
-		return
+		return nil
 	}
 	if cmd[0] == '"' || cmd[0] == '\'' {
-		sendRaw(ctx, cmd[1:])
-		return
+		return sendRaw(ctx, cmd[1:])
 	}
 	argv := strings.Fields(cmd)
+	ctx.Cmd, ctx.Argv = argv[0], argv[1:]
+	if ctx.Aborted == nil && ctx.Printer != nil {
+		// an estop stops this command, and any it runs, sending more
+		ctx.Aborted = ctx.Printer.Aborted()
+	}
 	cmdfn, ok := commands[argv[0]]
 	if !ok {
-		ctx.User.Error("No such command: " + argv[0])
-		return
+		macro, ok := ctx.Profile.Macros[argv[0]]
+		if !ok {
+			return errors.New("No such command: " + argv[0])
+		}
+		cmdfn = func(ctx Context) error { return RunMacro(ctx, macro) }
 	}
-	ctx.Cmd, ctx.Argv = argv[0], argv[1:]
 	if err := cmdfn(ctx); err != nil {
-		ctx.User.Error(fmt.Sprintf("'%s': %s", argv[0], err))
+		return fmt.Errorf("'%s': %s", argv[0], err)
 	}
+	return nil
 }
 
 func main() {
 	var ctx Context
+	var listen stringList
+	var port, daemon, attach, profile, script string
+	var baud int
 
 	flag.BoolVar(&ctx.UseTUI, "tui", false, "Use TUI for the user interface")
 	flag.DurationVar(&ctx.Timeout, "timeout", 60*time.Second, "Timeout sending remote commands (seconds)")
+	flag.Var(&listen, "listen", "Serve the console on tcp:host:port or unix:/path (repeatable)")
+	flag.StringVar(&port, "port", "", "Serial device the printer is connected to, or 'auto' to search for it")
+	flag.IntVar(&baud, "baud", 0, "Serial speed, probed for if not given")
+	flag.StringVar(&daemon, "daemon", "", "Run headless, accepting clients on this unix socket")
+	flag.StringVar(&attach, "attach", "", "Attach the console to a daemon's unix socket")
+	flag.StringVar(&profile, "profile", "", "Machine profile (JSON)")
+	flag.StringVar(&script, "script", "", "Run commands from a file ('-' for stdin) and exit")
 
 	flag.Parse()
 
+	ctx.Profile = NewProfile()
+	if profile != "" {
+		var err error
+		if ctx.Profile, err = LoadProfile(profile); err != nil {
+			log.Fatal(err)
+		}
+		if err = ctx.Profile.ApplyPrecision(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	dialect, err := LookupDialect(ctx.Profile.Dialect)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.Dialect = dialect
+
 	var ui UserInterfacer
-	if ctx.UseTUI {
+	var batch *BatchUserInterface
+	if script != "" {
+		batch = NewBatchUserInterface(os.Stdout, os.Stderr)
+		ui = batch
+	} else if daemon != "" {
+		log.Println("Launching daemon on " + daemon)
+		netui, err := NewDaemonUserInterface(daemon)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ui = netui
+	} else if ctx.UseTUI {
 		log.Println("Launching TUI")
 		ui = NewTUIUserInterface()
 	} else {
@@ -87,15 +266,101 @@ func main() {
 		ui = NewRawUserInterface()
 	}
 
+	if attach != "" {
+		if err := Attach(ui, attach); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(listen) > 0 {
+		netui, err := NewNetUserInterface(ui, listen...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ui = netui
+	}
+
 	ui.Start()
 
 	ctx.User = ui
+	ctx.Host = ui
 	ctx.User.WriteString("-- Starting")
 
 	ctx.Remote = make(chan string, 4)
 
+	if port == "" {
+		// where the printer was found last time
+		port = ctx.Profile.Port
+		if baud == 0 {
+			baud = ctx.Profile.Baud
+		}
+	}
+	if port != "" {
+		connection := NewConnection(port, baud, ctx.Dialect)
+		device, err := connection.Open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ui.WriteString(fmt.Sprintf("-- Connected to %s at %d baud", connection.Port, connection.Baud))
+		if err := connection.Remember(ctx.Profile); err != nil {
+			ui.Error("Saving the port in the profile: " + err.Error())
+		}
+		ctx.Printer = NewPrinter(device, ui, ctx.Remote, ctx.Timeout)
+		ctx.Printer.Dialect = ctx.Dialect
+		ctx.Printer.Reopen = connection.Open
+	}
+	ctx.Scripts = NewScripting(ctx)
+	ctx.Tools = NewToolChangePlanner(ctx.Profile.Tools, ctx.Profile.ToolChange)
+	if ctx.Printer != nil {
+		var err error
+		if ctx.Watchdog, err = NewWatchdog(ctx, ctx.Profile.Watchdog); err != nil {
+			log.Fatal(err)
+		}
+		ctx.Watchdog.Start()
+		defer ctx.Watchdog.Stop()
+
+		// detection runs on the event goroutine, so gets its own copy of
+		// the context, reporting to the host rather than whoever typed last
+		detectCtx := ctx
+		detectCtx.User = ctx.Host
+		ctx.Printer.OnEvent(func(event Event) {
+			if event.Kind != EventConnect || len(detectCtx.Dialect.Translate(NewCode("M115", ""))) == 0 {
+				return
+			}
+			// a restart while detecting aborts it, but then detects again
+			if _, err := DetectFirmware(detectCtx); err != nil && err != errAborted {
+				ui.Error("Firmware detection: " + err.Error())
+			}
+		})
+		ctx.Printer.Start()
+		defer ctx.Printer.Close()
+	}
+
+	if batch != nil {
+		input := os.Stdin
+		if script != "-" {
+			var err error
+			if input, err = os.Open(script); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := batch.Run(ctx, input); err != nil {
+			batch.Error(err.Error())
+			if ctx.Printer != nil {
+				ctx.Printer.Close()
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	urgentCtx := ctx
+	SetUrgent(func(cmd Command) bool { return runUrgent(urgentCtx, cmd) })
+
 	ui.WriteString("-- Ready")
 	for cmd := range ui.Commands() {
-		parse(ctx, cmd)
+		ctx.User = cmd.User
+		parse(ctx, cmd.Text)
 	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Mesh is a bed leveling grid of Z offsets, Points[y][x], as reported
+// by Marlin's bilinear, UBL or mesh bed leveling.
+type Mesh struct {
+	Points [][]float64 `json:"points"`
+}
+
+// meshJSON stores points that were never probed, NaN in Points, as
+// null, since JSON has no NaN.
+type meshJSON struct {
+	Points [][]*float64 `json:"points"`
+}
+
+func (m Mesh) MarshalJSON() ([]byte, error) {
+	stored := meshJSON{Points: make([][]*float64, len(m.Points))}
+	for y, row := range m.Points {
+		stored.Points[y] = make([]*float64, len(row))
+		for x := range row {
+			if !math.IsNaN(row[x]) {
+				stored.Points[y][x] = &row[x]
+			}
+		}
+	}
+	return json.Marshal(stored)
+}
+
+func (m *Mesh) UnmarshalJSON(data []byte) error {
+	var stored meshJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	m.Points = make([][]float64, len(stored.Points))
+	for y, row := range stored.Points {
+		m.Points[y] = make([]float64, len(row))
+		for x, value := range row {
+			m.Points[y][x] = math.NaN()
+			if value != nil {
+				m.Points[y][x] = *value
+			}
+		}
+	}
+	return nil
+}
+
+// MeshDisplayer is implemented by user interfaces that can draw a mesh
+// better than as plain text.
+type MeshDisplayer interface {
+	ShowMesh(mesh *Mesh)
+}
+
+// meshRowRe matches a row of the grid: the row index, an optional "|"
+// (UBL), then the values. UBL brackets the current point and shows
+// unprobed points as ".".
+var meshRowRe = regexp.MustCompile(`^\s*(\d+)\s*\|?((?:\s*\[?\s*(?:[+-]?\d+\.\d+|\.|nan)\s*\]?)+)\s*$`)
+
+// klipperMeshHeader starts the rows of Klipper's BED_MESH_OUTPUT, which
+// have no index, the first row being the front of the bed:
+//
+//	// Mesh Leveling Probed Z positions:
+//	//  0.012500 0.025000 0.037500
+//	//  -0.010000 0.000000 0.020000
+const klipperMeshHeader = "Mesh Leveling Probed Z positions:"
+
+// ParseMesh extracts the grid from a G29 / M420 V report, e.g.
+//
+//	Bilinear Leveling Grid:
+//	      0      1      2
+//	 0 +0.135 +0.090 +0.058
+//	 1 +0.073 +0.050 +0.010
+//
+// or from Klipper's BED_MESH_OUTPUT.
+func ParseMesh(lines []string) (*Mesh, error) {
+	rows := make(map[int][]float64)
+	width, klipperRow := -1, -1
+	for _, line := range lines {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "echo:")
+		var index int
+		var fields []string
+		if strings.HasPrefix(line, "//") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+			if line == klipperMeshHeader {
+				klipperRow = 0
+				continue
+			}
+			fields = strings.Fields(line)
+			if klipperRow < 0 || len(fields) == 0 || !numeric(fields) {
+				klipperRow = -1
+				continue
+			}
+			index = klipperRow
+			klipperRow++
+		} else {
+			match := meshRowRe.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			index, _ = strconv.Atoi(match[1])
+			fields = strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(match[2]))
+		}
+		row := make([]float64, 0, len(fields))
+		for _, field := range fields {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				value = math.NaN()
+			}
+			row = append(row, value)
+		}
+		if width >= 0 && len(row) != width {
+			return nil, fmt.Errorf("mesh row %d has %d points, expected %d", index, len(row), width)
+		}
+		width = len(row)
+		rows[index] = row
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no mesh found in the printer's reply")
+	}
+	mesh := &Mesh{Points: make([][]float64, len(rows))}
+	for index, row := range rows {
+		if index >= len(rows) {
+			return nil, fmt.Errorf("mesh is missing rows below %d", index)
+		}
+		mesh.Points[index] = row
+	}
+	return mesh, nil
+}
+
+func numeric(fields []string) bool {
+	for _, field := range fields {
+		if _, err := strconv.ParseFloat(field, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// MeshStats summarises a mesh; Deviation is the standard deviation and
+// Range the difference between the highest and lowest points.
+type MeshStats struct {
+	Min, Max, Mean, Range, Deviation float64
+}
+
+// width is the number of points in a row; a mesh loaded from a profile
+// may have none.
+func (m *Mesh) width() int {
+	if len(m.Points) == 0 {
+		return 0
+	}
+	return len(m.Points[0])
+}
+
+func (m *Mesh) values() []float64 {
+	values := make([]float64, 0, len(m.Points)*m.width())
+	for _, row := range m.Points {
+		for _, value := range row {
+			if !math.IsNaN(value) {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func (m *Mesh) Stats() MeshStats {
+	values := m.values()
+	if len(values) == 0 {
+		return MeshStats{}
+	}
+	stats := MeshStats{Min: values[0], Max: values[0]}
+	sum := 0.0
+	for _, value := range values {
+		stats.Min = math.Min(stats.Min, value)
+		stats.Max = math.Max(stats.Max, value)
+		sum += value
+	}
+	stats.Mean = sum / float64(len(values))
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - stats.Mean) * (value - stats.Mean)
+	}
+	stats.Deviation = math.Sqrt(variance / float64(len(values)))
+	stats.Range = stats.Max - stats.Min
+	return stats
+}
+
+func (s MeshStats) String() string {
+	return fmt.Sprintf("min %+.3f max %+.3f mean %+.3f range %.3f deviation %.3f", s.Min, s.Max, s.Mean, s.Range, s.Deviation)
+}
+
+// Codes restores the mesh to the printer with M421 and enables it.
+func (m *Mesh) Codes() []Code {
+	codes := make([]Code, 0, len(m.Points)*m.width()+1)
+	for y, row := range m.Points {
+		for x, value := range row {
+			if math.IsNaN(value) {
+				continue
+			}
+			codes = append(codes, NewCode("M421", "set mesh point", IntParam('I', x), IntParam('J', y), FloatParam('Z', value)))
+		}
+	}
+	return append(codes, NewCode("M420", "enable leveling", Param{'S', "1"}))
+}
+
+// MeshLevels is the number of colours in the heatmap.
+const MeshLevels = 5
+
+// Level places a value in the heatmap from 0 (lowest) to MeshLevels-1.
+func (s MeshStats) Level(value float64) int {
+	if math.IsNaN(value) || s.Range == 0 {
+		return MeshLevels / 2
+	}
+	level := int((value - s.Min) / s.Range * MeshLevels)
+	if level >= MeshLevels {
+		level = MeshLevels - 1
+	}
+	return level
+}
+
+// ansi colours from low (blue) to high (red)
+var meshColours = [MeshLevels]string{"\033[44m", "\033[46m", "\033[42m", "\033[43m", "\033[41m"}
+
+// Render draws the mesh as text with the back of the bed at the top,
+// optionally as an ANSI coloured heatmap.
+func (m *Mesh) Render(colour bool) []string {
+	stats := m.Stats()
+	lines := make([]string, 0, len(m.Points)+2)
+	header := "   "
+	for x := 0; x < m.width(); x++ {
+		header += fmt.Sprintf(" %6d ", x)
+	}
+	lines = append(lines, header)
+	for y := len(m.Points) - 1; y >= 0; y-- {
+		line := fmt.Sprintf("%2d ", y)
+		for _, value := range m.Points[y] {
+			cell := "    .   "
+			if !math.IsNaN(value) {
+				cell = fmt.Sprintf(" %+.3f ", value)
+			}
+			if colour {
+				cell = meshColours[stats.Level(value)] + cell + "\033[0m"
+			}
+			line += cell
+		}
+		lines = append(lines, line)
+	}
+	return append(lines, stats.String())
+}
+
+// showMesh uses the interface's own display if it has one.
+func showMesh(user UserInterfacer, mesh *Mesh) {
+	if displayer, ok := user.(MeshDisplayer); ok {
+		displayer.ShowMesh(mesh)
+		return
+	}
+	for _, line := range mesh.Render(false) {
+		user.WriteString(line)
+	}
+}
+
+// MeshNames lists the meshes saved in a profile.
+func (p *Profile) MeshNames() []string {
+	names := make([]string, 0, len(p.Meshes))
+	for name := range p.Meshes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
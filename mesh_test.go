@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMeshBilinear(t *testing.T) {
+	mesh, err := ParseMesh([]string{
+		"Bilinear Leveling Grid:",
+		"      0      1      2",
+		" 0 +0.135 +0.090 +0.058",
+		" 1 +0.073 +0.050 -0.010",
+		"echo:Bed Leveling ON",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float64{{0.135, 0.09, 0.058}, {0.073, 0.05, -0.01}}, mesh.Points)
+}
+
+func TestParseMeshUBL(t *testing.T) {
+	mesh, err := ParseMesh([]string{
+		"Bed Topography Report:",
+		"    (0,1)         (1,1)",
+		" 1 | +0.250 [-0.125]",
+		" 0 |    .    +0.000",
+		"    (0,0)         (1,0)",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mesh.Points))
+	assert.True(t, math.IsNaN(mesh.Points[0][0]))
+	assert.Equal(t, []float64{0.25, -0.125}, mesh.Points[1])
+
+	// unprobed points are saved in the profile as null
+	profile := NewProfile()
+	profile.Meshes["ubl"] = mesh
+	data, err := json.Marshal(profile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"points":[[null,0],[0.25,-0.125]]`)
+	loaded := NewProfile()
+	assert.Nil(t, json.Unmarshal(data, loaded))
+	assert.True(t, math.IsNaN(loaded.Meshes["ubl"].Points[0][0]))
+	assert.Equal(t, []float64{0.25, -0.125}, loaded.Meshes["ubl"].Points[1])
+}
+
+func TestParseMeshKlipper(t *testing.T) {
+	mesh, err := ParseMesh([]string{
+		"// Mesh Leveling Probed Z positions:",
+		"//  0.012500 0.025000 0.037500",
+		"//  -0.010000 0.000000 0.020000",
+		"// Mesh X,Y: 3,2",
+		"Measured points:",
+		"  -0.010000  0.000000  0.020000",
+		"  0.012500  0.025000  0.037500",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float64{{0.0125, 0.025, 0.0375}, {-0.01, 0, 0.02}}, mesh.Points)
+}
+
+func TestParseMeshErrors(t *testing.T) {
+	_, err := ParseMesh([]string{"ok"})
+	assert.NotNil(t, err)
+	_, err = ParseMesh([]string{"0 +0.1 +0.2", "1 +0.1"})
+	assert.NotNil(t, err)
+	_, err = ParseMesh([]string{"0 +0.1 +0.2", "2 +0.1 +0.2"})
+	assert.NotNil(t, err)
+}
+
+func TestMeshStatsAndCodes(t *testing.T) {
+	mesh := &Mesh{Points: [][]float64{{-0.1, 0.1}, {math.NaN(), 0.3}}}
+	stats := mesh.Stats()
+	assert.InDelta(t, -0.1, stats.Min, 1e-9)
+	assert.InDelta(t, 0.3, stats.Max, 1e-9)
+	assert.InDelta(t, 0.1, stats.Mean, 1e-9)
+	assert.InDelta(t, 0.4, stats.Range, 1e-9)
+	assert.Equal(t, 0, stats.Level(-0.1))
+	assert.Equal(t, MeshLevels-1, stats.Level(0.3))
+
+	var emitted []string
+	for _, code := range mesh.Codes() {
+		emitted = append(emitted, code.Emit(0))
+	}
+	assert.Equal(t, []string{
+		"M421 I0 J0 Z-0.1 ;set mesh point",
+		"M421 I1 J0 Z0.1 ;set mesh point",
+		"M421 I1 J1 Z0.3 ;set mesh point",
+		"M420 S1 ;enable leveling",
+	}, emitted)
+}
+
+func TestMeshRender(t *testing.T) {
+	mesh := &Mesh{Points: [][]float64{{0, 0.5}, {math.NaN(), 1}}}
+	lines := mesh.Render(false)
+	assert.Equal(t, []string{
+		"         0       1 ",
+		" 1     .    +1.000 ",
+		" 0  +0.000  +0.500 ",
+		"min +0.000 max +1.000 mean +0.500 range 1.000 deviation 0.408",
+	}, lines)
+}
+
+func TestMeshEmpty(t *testing.T) {
+	// as a hand-edited profile might have it
+	mesh := &Mesh{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"points": []}`), mesh))
+	assert.Equal(t, MeshStats{}, mesh.Stats())
+	assert.Equal(t, "M420 S1 ;enable leveling", emitAll(mesh.Codes()))
+	assert.Equal(t, []string{"   ", "min +0.000 max +0.000 mean +0.000 range 0.000 deviation 0.000"}, mesh.Render(true))
+}
+
+func TestMeshCommandKlipper(t *testing.T) {
+	ctx, _, received := newSimulatedContext(t, func(line string) []string {
+		if line == "BED_MESH_OUTPUT" {
+			return []string{"// Mesh Leveling Probed Z positions:", "//  0.0125 0.025", "//  -0.01 0", "ok"}
+		}
+		return []string{"ok"}
+	})
+	ctx.Dialect = Dialects["klipper"]
+	var err error
+	ctx.Profile, err = LoadProfile(filepath.Join(t.TempDir(), "profile.json"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, dispatch(ctx, "mesh probe"))
+	assert.Equal(t, [][]float64{{0.0125, 0.025}, {-0.01, 0}}, ctx.Profile.mesh.Points)
+	assert.Nil(t, dispatch(ctx, "mesh save front"))
+	assert.Nil(t, dispatch(ctx, "mesh load front"))
+	assert.Nil(t, ctx.Printer.WaitForIdle(time.Second))
+	assert.Equal(t, []string{"BED_MESH_CALIBRATE", "BED_MESH_OUTPUT", "BED_MESH_PROFILE SAVE=front", "BED_MESH_PROFILE LOAD=front"}, received())
+}
+
+func TestMeshCommandUnsupported(t *testing.T) {
+	ctx, _, received := newSimulatedContext(t, func(line string) []string { return []string{"ok"} })
+	ctx.Profile.Meshes["front"] = &Mesh{Points: [][]float64{{0}}}
+	for _, name := range []string{"prusa", "rrf", "smoothie"} {
+		ctx.Dialect = Dialects[name]
+		for _, cmd := range []string{"mesh probe", "mesh report", "mesh load front"} {
+			assert.EqualError(t, dispatch(ctx, cmd), "'mesh': meshes aren't supported by "+name)
+		}
+	}
+	assert.Empty(t, received())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NetUserInterface serves the console over TCP (telnet/netcat) and unix
+// domain sockets. Every attached session shares the same command stream,
+// output is broadcast to everyone, while errors only go to the session
+// that issued the command. An optional local Console is mirrored too.
+type NetUserInterface struct {
+	UserInterface
+	Console UserInterfacer
+
+	local     *consoleSession // the console, as the user of its commands
+	listeners []net.Listener
+	sessions  map[*netSession]bool
+	nextId    int
+	mutex     sync.Mutex
+	senders   sync.WaitGroup
+	done      chan struct{}
+	closed    bool
+}
+
+type netSession struct {
+	host    *NetUserInterface
+	conn    net.Conn
+	name    string
+	newline string
+	output  chan string
+}
+
+// netListen splits "tcp:host:port" or "unix:/path" into a listener;
+// a bare "host:port" is assumed to be tcp.
+func netListen(address string) (net.Listener, error) {
+	network := "tcp"
+	if idx := strings.Index(address, ":"); idx > 0 {
+		switch address[:idx] {
+		case "tcp", "tcp4", "tcp6", "unix":
+			network, address = address[:idx], address[idx+1:]
+		}
+	}
+	if network == "unix" {
+		// A socket left behind by a previous run will prevent us binding,
+		// but only remove it if nobody is answering on it.
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: already in use", address)
+		}
+		os.Remove(address)
+	}
+	return net.Listen(network, address)
+}
+
+func NewNetUserInterface(console UserInterfacer, addresses ...string) (*NetUserInterface, error) {
+	ui := &NetUserInterface{Console: console, sessions: make(map[*netSession]bool), done: make(chan struct{})}
+	ui.output = make(chan string, 200)
+	if console != nil {
+		ui.local = &consoleSession{console, ui}
+	}
+	for _, address := range addresses {
+		listener, err := netListen(address)
+		if err != nil {
+			ui.closeListeners()
+			return nil, err
+		}
+		ui.listeners = append(ui.listeners, listener)
+	}
+	return ui, nil
+}
+
+func (u *NetUserInterface) closeListeners() {
+	for _, listener := range u.listeners {
+		listener.Close()
+	}
+}
+
+func (u *NetUserInterface) Start() {
+	u.UserInterface.Start()
+
+	if u.Console != nil {
+		u.Console.Start()
+		go func() {
+			for cmd := range u.Console.Commands() {
+				u.submit(Command{cmd.Text, u.local})
+			}
+			// Closing the console takes the host down with it, e.g. quit
+			// typed locally; the console is closed already.
+			u.close(false)
+		}()
+	}
+
+	for _, listener := range u.listeners {
+		log.Printf("Listening on %s %s", listener.Addr().Network(), listener.Addr())
+		go u.accept(listener)
+	}
+}
+
+func (u *NetUserInterface) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go u.serve(conn)
+	}
+}
+
+func (u *NetUserInterface) serve(conn net.Conn) {
+	session := &netSession{host: u, conn: conn, newline: "\n", output: make(chan string, 200)}
+	if conn.LocalAddr().Network() == "tcp" {
+		// telnet wants carriage returns
+		session.newline = "\r\n"
+	}
+
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	u.nextId++
+	session.name = fmt.Sprintf("#%d", u.nextId)
+	if remote := conn.RemoteAddr(); remote != nil && remote.String() != "" {
+		session.name += " (" + remote.String() + ")"
+	}
+	u.sessions[session] = true
+	u.mutex.Unlock()
+
+	go func() {
+		for text := range session.output {
+			if _, err := conn.Write([]byte(text + session.newline)); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+
+	u.WriteString("-- Session " + session.name + " attached")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := Command{strings.TrimRight(scanner.Text(), "\r\n \t"), session}
+		if !handleUrgent(cmd) {
+			u.submit(cmd)
+		}
+	}
+	if u.detach(session) {
+		u.WriteString("-- Session " + session.name + " detached")
+	}
+}
+
+// submit forwards a command to the application unless we're shutting down.
+func (u *NetUserInterface) submit(cmd Command) {
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		return
+	}
+	u.senders.Add(1)
+	u.mutex.Unlock()
+	defer u.senders.Done()
+
+	select {
+	case *u.commands <- cmd:
+	case <-u.done:
+	}
+}
+
+// detach removes a session, returning false if it was already gone.
+func (u *NetUserInterface) detach(session *netSession) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if !u.sessions[session] {
+		return false
+	}
+	delete(u.sessions, session)
+	close(session.output)
+	return true
+}
+
+// deliver queues text for a session without blocking the application;
+// a session that can't keep up gets disconnected. Caller holds the mutex.
+func (u *NetUserInterface) deliver(session *netSession, text string) {
+	select {
+	case session.output <- text:
+	default:
+		delete(u.sessions, session)
+		close(session.output)
+	}
+}
+
+func (u *NetUserInterface) Close() {
+	u.close(true)
+}
+
+func (u *NetUserInterface) close(closeConsole bool) {
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		return
+	}
+	u.closed = true
+	close(u.done)
+	for session := range u.sessions {
+		delete(u.sessions, session)
+		close(session.output)
+	}
+	u.mutex.Unlock()
+
+	u.closeListeners()
+	if u.Console != nil && closeConsole {
+		u.Console.Close()
+	}
+	u.senders.Wait()
+	u.UserInterface.Close()
+}
+
+func (u *NetUserInterface) Write(text []byte) (count int, err error) {
+	u.mutex.Lock()
+	for session := range u.sessions {
+		u.deliver(session, string(text))
+	}
+	u.mutex.Unlock()
+	if u.Console != nil {
+		return u.Console.Write(text)
+	}
+	return len(text), nil
+}
+
+func (u *NetUserInterface) WriteString(text string) {
+	if _, err := u.Write([]byte(text)); err != nil {
+		log.Fatalf("Write Failed: %s", err)
+	}
+}
+
+func (u *NetUserInterface) Error(text string) {
+	u.WriteString("** Error: " + text)
+}
+
+// consoleSession is the console to the commands typed on it: their
+// output is broadcast as a session's would be, errors stay local.
+type consoleSession struct {
+	UserInterfacer
+	host *NetUserInterface
+}
+
+func (c *consoleSession) Write(text []byte) (count int, err error) {
+	return c.host.Write(text)
+}
+
+func (c *consoleSession) WriteString(text string) {
+	c.host.WriteString(text)
+}
+
+// Close detaches this session without affecting the host.
+func (s *netSession) Close() {
+	if s.host.detach(s) {
+		s.host.WriteString("-- Session " + s.name + " detached")
+	}
+}
+
+func (s *netSession) Commands() chan Command {
+	return s.host.Commands()
+}
+
+func (s *netSession) Start() {
+}
+
+// Write broadcasts, so everyone can follow what the session is doing.
+func (s *netSession) Write(text []byte) (count int, err error) {
+	return s.host.Write(text)
+}
+
+func (s *netSession) WriteString(text string) {
+	s.host.WriteString(text)
+}
+
+// Error is only reported back to the session that caused it.
+func (s *netSession) Error(text string) {
+	s.host.mutex.Lock()
+	defer s.host.mutex.Unlock()
+	if s.host.sessions[s] {
+		s.host.deliver(s, "** Error: "+text)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dialSession(t *testing.T, ui *NetUserInterface) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", ui.listeners[0].Addr().String())
+	assert.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	return conn, reader
+}
+
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	return line
+}
+
+func TestNetUserInterfaceSessions(t *testing.T) {
+	ui, err := NewNetUserInterface(nil, "tcp:127.0.0.1:0")
+	assert.Nil(t, err)
+	ui.Start()
+	defer ui.Close()
+
+	conn1, reader1 := dialSession(t, ui)
+	defer conn1.Close()
+	assert.Contains(t, readLine(t, reader1), "-- Session #1")
+
+	conn2, reader2 := dialSession(t, ui)
+	defer conn2.Close()
+	assert.Contains(t, readLine(t, reader1), "-- Session #2")
+	assert.Contains(t, readLine(t, reader2), "-- Session #2")
+
+	// Commands arrive tagged with the session that sent them.
+	_, err = conn2.Write([]byte("help\r\n"))
+	assert.Nil(t, err)
+	cmd := <-ui.Commands()
+	assert.Equal(t, "help", cmd.Text)
+
+	// Errors only go back to the originating session, output goes to all.
+	cmd.User.Error("oops")
+	cmd.User.WriteString("everyone")
+	assert.Equal(t, "** Error: oops\r\n", readLine(t, reader2))
+	assert.Equal(t, "everyone\r\n", readLine(t, reader2))
+	assert.Equal(t, "everyone\r\n", readLine(t, reader1))
+
+	// Closing a session only detaches it.
+	cmd.User.Close()
+	assert.Contains(t, readLine(t, reader1), "-- Session #2")
+	_, err = reader2.ReadString('\n')
+	assert.NotNil(t, err)
+}
+
+func TestNetUserInterfaceClose(t *testing.T) {
+	ui, err := NewNetUserInterface(nil, "tcp:127.0.0.1:0")
+	assert.Nil(t, err)
+	ui.Start()
+
+	conn, reader := dialSession(t, ui)
+	defer conn.Close()
+	readLine(t, reader)
+
+	ui.Close()
+	_, ok := <-ui.Commands()
+	assert.False(t, ok)
+	_, err = reader.ReadString('\n')
+	assert.NotNil(t, err)
+}
+
+func TestNetUserInterfaceConsoleQuit(t *testing.T) {
+	console := &testUserInterface{}
+	ui, err := NewNetUserInterface(console, "tcp:127.0.0.1:0")
+	assert.Nil(t, err)
+	ui.Start()
+
+	// quit typed on the console closes it, and so the host
+	console.Commands() <- Command{"quit", console}
+	cmd := <-ui.Commands()
+	assert.Nil(t, commands[cmd.Text](Context{User: cmd.User, Host: ui}))
+	_, ok := <-ui.Commands()
+	assert.False(t, ok)
+}
+
+func TestNetUserInterfaceConsoleOutput(t *testing.T) {
+	console := &testUserInterface{}
+	ui, err := NewNetUserInterface(console, "tcp:127.0.0.1:0")
+	assert.Nil(t, err)
+	ui.Start()
+	defer ui.Close()
+
+	conn, reader := dialSession(t, ui)
+	defer conn.Close()
+	assert.Contains(t, readLine(t, reader), "-- Session #1")
+
+	// what a command typed locally says is seen by the session too, but
+	// its errors aren't
+	console.Commands() <- Command{"help", console}
+	cmd := <-ui.Commands()
+	assert.Equal(t, "help", cmd.Text)
+	cmd.User.Error("oops")
+	assert.Nil(t, commands[cmd.Text](Context{User: cmd.User, Host: ui}))
+	assert.Equal(t, "There's no help yet.\r\n", readLine(t, reader))
+	assert.Contains(t, console.Lines(), "There's no help yet.")
+	assert.Equal(t, []string{"oops"}, console.Errors())
+}
+
+func TestNetUserInterfaceConsolePrompt(t *testing.T) {
+	console := &testUserInterface{}
+	ui, err := NewNetUserInterface(console, "tcp:127.0.0.1:0")
+	assert.Nil(t, err)
+	ui.Start()
+	defer ui.Close()
+
+	// the answer on the console goes through the forwarder, and another
+	// session's command waits for it
+	other := &testUserInterface{}
+	ui.Commands() <- Command{"help", other}
+	console.Commands() <- Command{"y", console}
+	answer, err := prompt(Context{User: ui.local, Host: ui}, "Sure?")
+	assert.Nil(t, err)
+	assert.Equal(t, "y", answer)
+	assert.Equal(t, Command{"help", other}, <-ui.Commands())
+	assert.Equal(t, []string{"Waiting for an answer from another session: 'help' will run after"}, other.Errors())
+}
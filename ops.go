@@ -4,18 +4,30 @@ import "strconv"
 
 type ToolId uint
 
+const (
+	T0 ToolId = iota
+	T1
+	T2
+	T3
+)
+
 func UintStr(value uint) string {
 	return strconv.Itoa(int(value))
 }
 
+// FloatStr gives a compact decimal, e.g. 12.5 rather than 12.500000;
+// prefer FloatParam, which knows the precision for each axis.
+func FloatStr(value float64) string {
+	return FormatFloat(value, DefaultPrecision)
+}
+
 func ToolIdx(toolidx ToolId) Code {
 	return NewCode("T"+UintStr(uint(toolidx)), "select tool")
 }
 
+// LineNo tells the firmware the number of the current line, so the next
+// is expected to be one more; M110 N0 starts again after a reset.
 func LineNo(lineNo uint) Code {
-	if lineNo < 1 {
-		panic("Cannot set line number less than 0")
-	}
 	code := NewCode("M110", "set line no", Param{'N', UintStr(lineNo)})
 	code.LineNo = lineNo
 	return code
@@ -31,3 +43,161 @@ func HotendTempMaxAuto(celcius uint, maxAuto uint) Code {
 	}
 	return NewCode("M104", "set hotend temp and max auto", Param{'S', UintStr(celcius)}, Param{'B', UintStr(maxAuto)}, Param{'F', ""})
 }
+
+func ToolTemp(tool ToolId, celcius uint) Code {
+	return NewCode("M104", "set tool temp", Param{'T', UintStr(uint(tool))}, Param{'S', UintStr(celcius)})
+}
+
+func ToolTempWait(tool ToolId, celcius uint) Code {
+	return NewCode("M109", "wait for tool temp", Param{'T', UintStr(uint(tool))}, Param{'S', UintStr(celcius)})
+}
+
+// ToolTempCoolWait waits for a tool to cool to a lower temperature as
+// well as heat, which M109 S doesn't do.
+func ToolTempCoolWait(tool ToolId, celcius uint) Code {
+	return NewCode("M109", "wait for tool to cool", Param{'T', UintStr(uint(tool))}, Param{'R', UintStr(celcius)})
+}
+
+func BedTemp(celcius uint) Code {
+	return NewCode("M140", "set bed temp", Param{'S', UintStr(celcius)})
+}
+
+func BedTempWait(celcius uint) Code {
+	return NewCode("M190", "wait for bed temp", Param{'S', UintStr(celcius)})
+}
+
+// Home homes the given axes, or all of them if none are given.
+func Home(axes ...rune) Code {
+	code := NewCode("G28", "home")
+	for _, axis := range axes {
+		code.Parameters = append(code.Parameters, FlagParam(axis))
+	}
+	return code
+}
+
+func AbsolutePositioning() Code {
+	return NewCode("G90", "absolute positioning")
+}
+
+func RelativePositioning() Code {
+	return NewCode("G91", "relative positioning")
+}
+
+func AbsoluteExtrusion() Code {
+	return NewCode("M82", "absolute extrusion")
+}
+
+func RelativeExtrusion() Code {
+	return NewCode("M83", "relative extrusion")
+}
+
+// Travel is a rapid (G0) move, Move a linear (G1) one; params are the
+// axes and feedrate to include, built with NewParamArray.
+func Travel(params ...Param) Code {
+	return NewCode("G0", "travel", params...)
+}
+
+func Move(params ...Param) Code {
+	return NewCode("G1", "move", params...)
+}
+
+// Arc is a circular (G2 clockwise, G3 counter-clockwise) move; params
+// give the end point and the centre's offset (I, J) from the start.
+func Arc(clockwise bool, params ...Param) Code {
+	if clockwise {
+		return NewCode("G2", "clockwise arc", params...)
+	}
+	return NewCode("G3", "counter-clockwise arc", params...)
+}
+
+// ProbeAt measures the bed height at a point with the Z probe (G30).
+func ProbeAt(x, y float64) Code {
+	return NewCode("G30", "single probe", FloatParam('X', x), FloatParam('Y', y))
+}
+
+func SetPosition(params ...Param) Code {
+	return NewCode("G92", "set position", params...)
+}
+
+func Dwell(milliseconds uint) Code {
+	return NewCode("G4", "dwell", Param{'P', UintStr(milliseconds)})
+}
+
+func FanSpeed(speed uint) Code {
+	return NewCode("M106", "set fan speed", Param{'S', UintStr(speed)})
+}
+
+func FanOff() Code {
+	return NewCode("M107", "fan off")
+}
+
+func FinishMoves() Code {
+	return NewCode("M400", "finish moves")
+}
+
+// AutoLevel probes the bed and builds a leveling mesh.
+func AutoLevel(params ...Param) Code {
+	return NewCode("G29", "auto bed leveling", params...)
+}
+
+// MeshReport has the firmware print its leveling mesh.
+func MeshReport() Code {
+	return NewCode("M420", "report mesh", FlagParam('V'))
+}
+
+// SDList lists the files on the SD card, with their long names too if
+// the firmware has LONG_FILENAME.
+func SDList(long bool) Code {
+	if long {
+		return NewCode("M20", "list SD files", FlagParam('L'))
+	}
+	return NewCode("M20", "list SD files")
+}
+
+// SDSelect opens a file on the SD card for printing. File names aren't
+// parameters, so they're carried in the code like Klipper's arguments.
+func SDSelect(name string) Code {
+	return NewCode("M23 "+name, "select SD file")
+}
+
+func SDStart() Code {
+	return NewCode("M24", "start or resume SD print")
+}
+
+func SDPause() Code {
+	return NewCode("M25", "pause SD print")
+}
+
+func SDProgress() Code {
+	return NewCode("M27", "report SD progress")
+}
+
+func SDCurrentFile() Code {
+	return NewCode("M27", "report SD file", FlagParam('C'))
+}
+
+// SDAutoReport has the firmware report its progress every so many
+// seconds while printing, or stop with 0.
+func SDAutoReport(seconds uint) Code {
+	return NewCode("M27", "auto-report SD progress", Param{'S', UintStr(seconds)})
+}
+
+// SDBeginWrite has the firmware write the lines that follow to a file,
+// until SDEndWrite, rather than run them.
+func SDBeginWrite(name string) Code {
+	return NewCode("M28 "+name, "begin SD write")
+}
+
+func SDEndWrite() Code {
+	return NewCode("M29", "end SD write")
+}
+
+func SDDelete(name string) Code {
+	return NewCode("M30 "+name, "delete SD file")
+}
+
+// SDBinaryMode switches Marlin built with BINARY_FILE_TRANSFER to
+// receiving packets rather than lines.
+func SDBinaryMode() Code {
+	return NewCode("M28", "binary transfer", IntParam('B', 1))
+}
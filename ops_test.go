@@ -20,6 +20,8 @@ func TestToolIdx999(t *testing.T) {
 
 func TestLineNo(t *testing.T) {
 	assert.Equal(t, Code{GCode: "M110", Comment: "set line no", Parameters: NewParamArray("N", "12995"), LineNo: 12995}, LineNo(12995))
+	reset := LineNo(0)
+	assert.Equal(t, "M110 N0 ;set line no", reset.Emit(0))
 }
 
 func TestHotendTemp(t *testing.T) {
@@ -30,3 +32,15 @@ func TestHotendTempMaxAuto(t *testing.T) {
 	expected := Code{GCode: "M104", Comment: "set hotend temp and max auto", Parameters: NewParamArray("S", "222", "B", "180", "F", "")}
 	assert.Equal(t, expected, HotendTempMaxAuto(222, 180))
 }
+
+func TestSDCodes(t *testing.T) {
+	list, longList := SDList(false), SDList(true)
+	assert.Equal(t, "M20 ;list SD files", list.Emit(0))
+	assert.Equal(t, "M20 L ;list SD files", longList.Emit(0))
+	selected := SDSelect("benchy.gco")
+	assert.Equal(t, "N3 M23 benchy.gco*111 ;select SD file", selected.Emit(3))
+	report := SDAutoReport(5)
+	assert.Equal(t, "M27 S5 ;auto-report SD progress", report.Emit(0))
+	write := SDBeginWrite("cube.gco")
+	assert.Equal(t, "M28 cube.gco ;begin SD write", write.Emit(0))
+}
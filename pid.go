@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PID holds a heater's control constants.
+type PID struct {
+	Kp, Ki, Kd float64
+}
+
+func (p PID) String() string {
+	return fmt.Sprintf("Kp %s Ki %s Kd %s", FormatFloat(p.Kp, 2), FormatFloat(p.Ki, 2), FormatFloat(p.Kd, 2))
+}
+
+var (
+	pidRe      = regexp.MustCompile(`Kp:\s*(-?[\d.]+)\s+Ki:\s*(-?[\d.]+)\s+Kd:\s*(-?[\d.]+)`)
+	autotuneRe = regexp.MustCompile(`bias:\s*(\d+)\s+d:\s*(\d+)\s+min:\s*(-?[\d.]+)\s+max:\s*(-?[\d.]+)`)
+)
+
+// autotuneTimeout is generous: a bed can take minutes per cycle.
+const autotuneTimeout = 30 * time.Minute
+
+// ParsePID finds the result of an M303 autotune, e.g.
+//
+//	Kp: 19.56 Ki: 0.71 Kd: 134.26
+//	PID Autotune finished! Put the last Kp, Ki and Kd constants from below into Configuration.h
+func ParsePID(lines []string) (PID, error) {
+	var pid PID
+	found := false
+	for _, line := range lines {
+		if strings.Contains(line, "Autotune failed") {
+			return PID{}, errors.New(strings.TrimSpace(strings.TrimPrefix(line, "echo:")))
+		}
+		if match := pidRe.FindStringSubmatch(line); match != nil {
+			pid.Kp, _ = strconv.ParseFloat(match[1], 64)
+			pid.Ki, _ = strconv.ParseFloat(match[2], 64)
+			pid.Kd, _ = strconv.ParseFloat(match[3], 64)
+			found = true
+		}
+	}
+	if !found {
+		return PID{}, errors.New("no PID constants in the printer's reply")
+	}
+	return pid, nil
+}
+
+// Autotune runs M303 on a hotend or, if bed is set, on the bed, showing
+// the oscillation as it goes, then offers to apply and save the result.
+func Autotune(ctx Context, bed bool, target uint, cycles int) error {
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	heater, apply := IntParam('E', int(ctx.Tools.Current())), NewCode("M301", "set hotend PID")
+	if bed {
+		heater, apply = IntParam('E', -1), NewCode("M304", "set bed PID")
+	} else {
+		apply.Set(heater)
+	}
+
+	cycle := 0
+	cancel := ctx.Printer.Watch(func(line string) {
+		if match := autotuneRe.FindStringSubmatch(line); match != nil {
+			cycle++
+			ctx.User.WriteString(fmt.Sprintf("Autotune cycle %d/%d: %s-%s°C, target %d°C", cycle, cycles, match[3], match[4], target))
+		}
+	})
+	defer cancel()
+
+	reply, err := queryCode(ctx, NewCode("M303", "PID autotune", heater, IntParam('S', int(target)), IntParam('C', cycles)), autotuneTimeout)
+	if err != nil {
+		return err
+	}
+	pid, err := ParsePID(reply)
+	if err != nil {
+		return err
+	}
+	ctx.User.WriteString("Autotune result: " + pid.String())
+	if ok, err := confirm(ctx, "Apply these constants?"); err != nil || !ok {
+		return err
+	}
+	apply.Set(FloatParam('P', pid.Kp), FloatParam('I', pid.Ki), FloatParam('D', pid.Kd))
+	if err := sendCodes(ctx, apply); err != nil {
+		return err
+	}
+	if save, err := confirm(ctx, "Save to EEPROM?"); err != nil || !save {
+		return err
+	}
+	return sendCodes(ctx, NewCode("M500", "save settings"))
+}
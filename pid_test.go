@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var autotuneReply = []string{
+	"PID Autotune start",
+	"T:205.12 /0.00 B:24.10 /0.00 @:127 B@:0",
+	" bias: 92 d: 92 min: 196.56 max: 203.75",
+	" bias: 90 d: 90 min: 197.02 max: 202.88 Ku: 39.02 Tu: 39.31",
+	" Classic PID ",
+	" Kp: 23.41 Ki: 1.19 Kd: 115.04",
+	"PID Autotune finished! Put the last Kp, Ki and Kd constants from below into Configuration.h",
+	"#define DEFAULT_Kp 23.41",
+}
+
+func TestParsePID(t *testing.T) {
+	pid, err := ParsePID(autotuneReply)
+	assert.Nil(t, err)
+	assert.Equal(t, PID{23.41, 1.19, 115.04}, pid)
+	assert.Equal(t, "Kp 23.41 Ki 1.19 Kd 115.04", pid.String())
+
+	_, err = ParsePID([]string{"PID Autotune start", "PID Autotune failed! Temperature too high"})
+	assert.Equal(t, "PID Autotune failed! Temperature too high", err.Error())
+	_, err = ParsePID([]string{"ok"})
+	assert.NotNil(t, err)
+}
+
+func TestAutotune(t *testing.T) {
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if strings.HasPrefix(line, "M303") {
+			return append(autotuneReply, "ok")
+		}
+		return []string{"ok"}
+	})
+	ctx.Tools = NewToolChangePlanner(nil, ToolChangeConfig{})
+
+	ui.Commands() <- Command{"y", ui}
+	ui.Commands() <- Command{"y", ui}
+	assert.Nil(t, dispatch(ctx, "autotune bed 70 2"))
+	assert.Contains(t, ui.Lines(), "Autotune cycle 1/2: 196.56-203.75°C, target 70°C")
+	assert.Contains(t, ui.Lines(), "Autotune result: Kp 23.41 Ki 1.19 Kd 115.04")
+	waitFor(t, func() bool { return len(received()) == 3 })
+	assert.Equal(t, []string{"M303 E-1 S70 C2", "M304 P23.41 I1.19 D115.04", "M500"}, received())
+	assert.Equal(t, 205.12, ctx.Printer.Temperatures()["T"].Actual)
+
+	assert.NotNil(t, dispatch(ctx, "autotune chamber"))
+}
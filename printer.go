@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventConnect   = "connect"
+	EventError     = "error"
+	EventPrintDone = "print_done"
+	EventPrompt    = "prompt"
+)
+
+// Event is something the printer told us that automation may care about.
+type Event struct {
+	Kind string
+	Text string
+}
+
+type Temperature struct {
+	Actual float64
+	Target float64
+}
+
+// Printer owns the connection to the machine: it drains the Remote
+// queue onto the port one line at a time, waiting for each "ok" before
+// sending the next, and relays everything the printer says to the user.
+type Printer struct {
+	Timeout      time.Duration
+	PollInterval time.Duration
+	User         UserInterfacer
+	Dialect      Dialect
+
+	// Reopen, if set, is used to reconnect when the port goes away, e.g.
+	// when the printer is unplugged or powered off.
+	Reopen func() (io.ReadWriteCloser, error)
+
+	port      io.ReadWriteCloser
+	remote    chan string
+	queries   chan *query
+	okays     chan struct{}
+	keepalive chan struct{}
+	wake      chan struct{} // the writer looks at the hold again
+	done      chan struct{}
+
+	writeMutex sync.Mutex // real-time commands bypass the writer
+
+	mutex     sync.Mutex
+	busy      bool
+	inflight  []string // streamed lines not yet acknowledged
+	status    *GrblStatus
+	abort     chan struct{} // closed by Abort
+	aborting  bool
+	held      bool
+	capture   *query
+	temps     map[string]Temperature
+	sd        SDStatus
+	listeners []func(Event)
+	watchers  map[int]func(string)
+	nextWatch int
+	firmware  *Firmware
+	prompt    []string
+	sent      []string // numbered lines sent lately, should they be asked for again
+	resend    uint     // the line the firmware asked for, if it did
+	resending bool
+}
+
+// resendHistory is how many numbered lines are kept for resending.
+const resendHistory = 32
+
+// query is a command whose reply we want to see, i.e. everything the
+// printer says between us sending it and the "ok".
+type query struct {
+	raw     string
+	lines   []string
+	reply   chan []string
+	aborted <-chan struct{}
+}
+
+// errAborted is returned by whatever was sending or waiting when the
+// host was told to stop.
+var errAborted = errors.New("aborted")
+
+// cancelled reports whether the host aborted after the query was made.
+func (q *query) cancelled() bool {
+	select {
+	case <-q.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewPrinter(port io.ReadWriteCloser, user UserInterfacer, remote chan string, timeout time.Duration) *Printer {
+	return &Printer{
+		Timeout:      timeout,
+		PollInterval: time.Second,
+		User:         user,
+		Dialect:      Marlin,
+		port:         port,
+		remote:       remote,
+		queries:      make(chan *query),
+		okays:        make(chan struct{}, 64),
+		keepalive:    make(chan struct{}, 1),
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		abort:        make(chan struct{}),
+		temps:        make(map[string]Temperature),
+		watchers:     make(map[int]func(string)),
+	}
+}
+
+func (p *Printer) Start() {
+	go p.read()
+	go p.write()
+	p.emit(Event{EventConnect, ""})
+}
+
+func (p *Printer) Close() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+		close(p.done)
+	}
+	p.mutex.Lock()
+	port := p.port
+	p.mutex.Unlock()
+	return port.Close()
+}
+
+// OnEvent registers a listener; listeners run on their own goroutine so
+// they are free to send more commands.
+func (p *Printer) OnEvent(listener func(Event)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners = append(p.listeners, listener)
+}
+
+func (p *Printer) emit(event Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, listener := range p.listeners {
+		go listener(event)
+	}
+}
+
+// Watch calls fn with every line the printer sends until cancelled. It
+// runs on the reader so must not block.
+func (p *Printer) Watch(fn func(line string)) (cancel func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	id := p.nextWatch
+	p.nextWatch++
+	p.watchers[id] = fn
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.watchers, id)
+	}
+}
+
+// Firmware is what M115 reported, or nil if we haven't asked.
+func (p *Printer) Firmware() *Firmware {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.firmware
+}
+
+func (p *Printer) SetFirmware(firmware *Firmware) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.firmware = firmware
+}
+
+// Features are those chosen for the firmware, or those the dialect
+// assumes until it's known.
+func (p *Printer) Features() Features {
+	if firmware := p.Firmware(); firmware != nil {
+		return firmware.Features()
+	}
+	return p.Dialect.Features()
+}
+
+// Temperatures returns the most recently reported heater states, keyed
+// by Marlin's names: T, T0, T1..., B, C.
+func (p *Printer) Temperatures() map[string]Temperature {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	temps := make(map[string]Temperature, len(p.temps))
+	for heater, temp := range p.temps {
+		temps[heater] = temp
+	}
+	return temps
+}
+
+// SDStatus is the progress of the print from the SD card, as last
+// reported, whether asked for (M27) or auto-reported (M27 S<seconds>).
+func (p *Printer) SDStatus() SDStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sd
+}
+
+// followSD keeps the SD status up to date from one line. The file only
+// comes with M27 C, so the progress reports keep the one last named.
+func (p *Printer) followSD(line string) {
+	line = sdLines([]string{line})[0]
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch {
+	case strings.HasPrefix(line, "Current file:"):
+		p.sd.File = parseSDCurrentFile(line)
+	case strings.HasPrefix(line, "SD printing byte"), line == "Not SD printing":
+		status, err := ParseSDStatus([]string{line})
+		if err != nil {
+			return
+		}
+		status.File.Name, status.File.LongName = p.sd.File.Name, p.sd.File.LongName
+		p.sd = status
+	}
+}
+
+var temperatureRe = regexp.MustCompile(`\b([TBCP]\d*):\s*(-?[\d.]+)\s*/\s*(-?[\d.]+)`)
+
+// ParseTemperatures extracts heater readings from an M105 reply or an
+// auto-report such as "ok T:210.0 /210.0 B:60.1 /60.0 @:127 B@:0".
+func ParseTemperatures(line string) map[string]Temperature {
+	matches := temperatureRe.FindAllStringSubmatch(line, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	temps := make(map[string]Temperature, len(matches))
+	for _, match := range matches {
+		actual, err1 := strconv.ParseFloat(match[2], 64)
+		target, err2 := strconv.ParseFloat(match[3], 64)
+		if err1 == nil && err2 == nil {
+			temps[match[1]] = Temperature{actual, target}
+		}
+	}
+	return temps
+}
+
+func (p *Printer) read() {
+	for {
+		p.mutex.Lock()
+		scanner := bufio.NewScanner(p.port)
+		p.mutex.Unlock()
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			p.User.WriteString("< " + line)
+			p.handle(line)
+		}
+		select {
+		case <-p.done:
+			return
+		default:
+			p.User.Error("Printer connection lost")
+			p.emit(Event{EventError, "Printer connection lost"})
+		}
+		if p.Reopen == nil || !p.reconnect() {
+			return
+		}
+	}
+}
+
+// reconnect tries to reopen the port every PollInterval until it
+// succeeds or the printer is closed. Nothing sent meanwhile survives.
+func (p *Printer) reconnect() bool {
+	p.Abort()
+	for {
+		select {
+		case <-p.done:
+			return false
+		case <-time.After(p.PollInterval):
+		}
+		port, err := p.Reopen()
+		if err != nil {
+			continue
+		}
+		p.writeMutex.Lock()
+		p.mutex.Lock()
+		old := p.port
+		p.port = port
+		p.mutex.Unlock()
+		p.writeMutex.Unlock()
+		old.Close()
+		select {
+		case <-p.done:
+			port.Close()
+			return false
+		default:
+		}
+		p.User.WriteString("-- Printer reconnected")
+		p.emit(Event{EventConnect, ""})
+		return true
+	}
+}
+
+// restarted resets the host when the firmware (re)starts: whatever was
+// queued for it is gone, and it expects line numbers from zero again.
+func (p *Printer) restarted(line string) {
+	p.Abort()
+	if p.Dialect.Numbered() {
+		for _, code := range p.Dialect.Translate(LineNo(0)) {
+			code.Comment = ""
+			select {
+			case p.remote <- code.EmitAs(p.Dialect, 0):
+			default:
+			}
+		}
+	}
+	p.User.WriteString("-- Printer restarted")
+	p.emit(Event{EventConnect, line})
+}
+
+// handle updates our view of the printer from one line it sent.
+func (p *Printer) handle(line string) {
+	reply := p.Dialect.Reply(line)
+	p.mutex.Lock()
+	if reply.Kind == ReplyStatus {
+		p.updateStatus(line)
+	} else if p.capture != nil && reply.Kind != ReplyOk {
+		p.capture.lines = append(p.capture.lines, line)
+	} else if p.capture != nil && reply.Text != "" {
+		// some firmware answers on the "ok" itself, e.g. Klipper's M115
+		p.capture.lines = append(p.capture.lines, reply.Text)
+	}
+	watchers := make([]func(string), 0, len(p.watchers))
+	for _, watcher := range p.watchers {
+		watchers = append(watchers, watcher)
+	}
+	p.mutex.Unlock()
+	for _, watcher := range watchers {
+		watcher(line)
+	}
+
+	if temps := p.Dialect.ParseTemperatures(line); temps != nil {
+		p.mutex.Lock()
+		for heater, temp := range temps {
+			p.temps[heater] = temp
+		}
+		p.mutex.Unlock()
+		if reply.Kind != ReplyOk {
+			// reports while heating (M109, M303...) show it's still working
+			p.alive()
+		}
+	}
+	p.followSD(line)
+	switch reply.Kind {
+	case ReplyRejected:
+		p.emit(Event{EventError, reply.Text})
+		p.acknowledge()
+	case ReplyOk:
+		p.acknowledge()
+	case ReplyBusy:
+		// long running commands (G29, M109, M303...) keep us waiting
+		p.alive()
+	case ReplyStart:
+		p.restarted(line)
+	case ReplyError:
+		p.emit(Event{EventError, reply.Text})
+	case ReplyResend:
+		if lineNo, ok := resendFrom(p.Dialect, []string{line}); ok {
+			p.mutex.Lock()
+			p.resend, p.resending = lineNo, true
+			p.mutex.Unlock()
+		}
+	case ReplyPrintDone:
+		p.emit(Event{EventPrintDone, line})
+	case ReplyInfo:
+		if strings.HasPrefix(line, "//action:prompt_") && p.Features().HostPrompts {
+			p.hostPrompt(strings.TrimPrefix(line, "//action:prompt_"))
+		}
+	}
+}
+
+// acknowledge completes the oldest line streamed, or else the command
+// being sent.
+func (p *Printer) acknowledge() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.inflight) > 0 {
+		p.inflight = p.inflight[1:]
+	} else if p.capture != nil {
+		p.capture.reply <- p.capture.lines
+		p.capture = nil
+	}
+	select {
+	case p.okays <- struct{}{}:
+	default:
+	}
+}
+
+// clearInflight forgets streamed lines after the firmware reset.
+func (p *Printer) clearInflight() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inflight = nil
+	select {
+	case p.okays <- struct{}{}:
+	default:
+	}
+}
+
+// Aborted is closed by the next Abort, so anything that started before
+// it can give up.
+func (p *Printer) Aborted() <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.abort
+}
+
+// Abort resets the host after an emergency stop: queued lines are
+// dropped, streamed ones forgotten, and whatever is sending, querying or
+// waiting on the printer returns errAborted.
+func (p *Printer) Abort() {
+	// stop the senders before making room for them, and have the writer
+	// drop whatever it picks up meanwhile
+	p.mutex.Lock()
+	p.aborting = true
+	p.held = false
+	close(p.abort)
+	p.abort = make(chan struct{})
+	p.inflight = nil
+	p.capture = nil
+	p.prompt = nil
+	p.resending = false
+	p.mutex.Unlock()
+	for len(p.remote) > 0 {
+		select {
+		case <-p.remote:
+		default:
+		}
+	}
+	p.mutex.Lock()
+	p.aborting = false
+	p.mutex.Unlock()
+	for len(p.okays) > 0 {
+		select {
+		case <-p.okays:
+		default:
+		}
+	}
+	p.rouse()
+}
+
+// Hold stops the writer taking lines from the remote channel, leaving
+// them queued until Release; queries still go through. Abort releases
+// the hold, as there's nothing left to resume.
+func (p *Printer) Hold() {
+	p.mutex.Lock()
+	p.held = true
+	p.mutex.Unlock()
+	p.rouse()
+}
+
+// Release resumes sending what was queued before and during the hold.
+func (p *Printer) Release() {
+	p.mutex.Lock()
+	p.held = false
+	p.mutex.Unlock()
+	p.rouse()
+}
+
+func (p *Printer) Held() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.held
+}
+
+func (p *Printer) rouse() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Emergency aborts, so nothing more follows, then sends M112 or M410
+// straight to the port without waiting for room or an "ok". GRBL has
+// real-time commands for the purpose instead.
+func (p *Printer) Emergency(code Code) error {
+	if p.Dialect.Name() == "grbl" {
+		return p.grblStop(code.GCode == "M410")
+	}
+	code.Comment = ""
+	translated := p.Dialect.Translate(code)
+	if len(translated) != 1 {
+		return fmt.Errorf("%s isn't supported by %s", code.GCode, p.Dialect.Name())
+	}
+	p.Abort()
+	return p.writeLine(translated[0].EmitAs(p.Dialect, 0))
+}
+
+// unacknowledged is the number of bytes streamed that the firmware may
+// still be holding, and the oldest line.
+func (p *Printer) unacknowledged() (int, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	size := 0
+	for _, raw := range p.inflight {
+		size += len(raw) + 1
+	}
+	if len(p.inflight) == 0 {
+		return 0, ""
+	}
+	return size, p.inflight[0]
+}
+
+// hostPrompt collects a host action prompt and, once complete, asks the
+// user to answer it with M876.
+func (p *Printer) hostPrompt(action string) {
+	parts := strings.SplitN(action, " ", 2)
+	text := ""
+	if len(parts) == 2 {
+		text = parts[1]
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch parts[0] {
+	case "begin":
+		p.prompt = []string{text}
+	case "button", "choice":
+		if p.prompt != nil {
+			p.prompt = append(p.prompt, fmt.Sprintf("[%d] %s", len(p.prompt)-1, text))
+		}
+	case "show":
+		if p.prompt != nil {
+			question := strings.Join(p.prompt, " ")
+			p.User.WriteString("?? Printer asks: " + question + " (answer <n>)")
+			for _, listener := range p.listeners {
+				go listener(Event{EventPrompt, question})
+			}
+		}
+	case "end":
+		p.prompt = nil
+	}
+}
+
+// alive restarts the timeout on the command being sent.
+func (p *Printer) alive() {
+	select {
+	case p.keepalive <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Printer) write() {
+	for {
+		remote := p.remote
+		if p.Held() {
+			remote = nil
+		}
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case raw := <-remote:
+			p.setBusy(true)
+			p.sendQueued(raw)
+			p.setBusy(false)
+		case q := <-p.queries:
+			p.setBusy(true)
+			// honour anything queued ahead of the query, unless held;
+			// Abort may empty the queue meanwhile
+		drain:
+			for !p.Held() {
+				select {
+				case raw := <-p.remote:
+					p.sendQueued(raw)
+				default:
+					break drain
+				}
+			}
+			if q.cancelled() {
+				p.setBusy(false)
+				continue
+			}
+			if err := p.awaitRoom(0); err != nil && err != errAborted {
+				p.User.Error(err.Error())
+			}
+			p.mutex.Lock()
+			p.capture = q
+			p.mutex.Unlock()
+			if err := p.send(q.raw); err != nil {
+				if err != errAborted {
+					p.User.Error(err.Error())
+				}
+				p.mutex.Lock()
+				p.capture = nil
+				p.mutex.Unlock()
+			}
+			p.setBusy(false)
+		}
+	}
+}
+
+func (p *Printer) sendQueued(raw string) {
+	if p.isAborting() {
+		return
+	}
+	send := p.sendChecked
+	if p.Dialect.ReceiveBuffer() > 0 {
+		send = p.stream
+	}
+	if err := send(raw); err != nil && err != errAborted {
+		p.User.Error(err.Error())
+		p.emit(Event{EventError, err.Error()})
+	}
+}
+
+// Query sends a command after anything already queued and returns the
+// lines the printer replied with before acknowledging it.
+func (p *Printer) Query(raw string, timeout time.Duration) ([]string, error) {
+	aborted := p.Aborted()
+	q := &query{raw: raw, reply: make(chan []string, 1), aborted: aborted}
+	expired := time.After(timeout)
+	select {
+	case p.queries <- q:
+	case <-aborted:
+		return nil, errAborted
+	case <-expired:
+		return nil, fmt.Errorf("Unable to send '%s' within %v", raw, timeout)
+	}
+	select {
+	case lines := <-q.reply:
+		return lines, nil
+	case <-p.done:
+		return nil, fmt.Errorf("Printer disconnected")
+	case <-aborted:
+		return nil, errAborted
+	case <-expired:
+		return nil, fmt.Errorf("No reply to '%s' within %v", raw, timeout)
+	}
+}
+
+func (p *Printer) isAborting() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.aborting
+}
+
+func (p *Printer) setBusy(busy bool) {
+	p.mutex.Lock()
+	p.busy = busy
+	p.mutex.Unlock()
+}
+
+// Idle reports whether everything queued has been sent and acknowledged.
+func (p *Printer) Idle() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return !p.busy && len(p.remote) == 0 && len(p.inflight) == 0
+}
+
+// send writes one line and blocks until the printer acknowledges it;
+// "busy" messages from the printer restart the timeout.
+func (p *Printer) send(raw string) error {
+	// forget acknowledgements of lines streamed earlier
+	for len(p.okays) > 0 {
+		<-p.okays
+	}
+	aborted := p.Aborted()
+	if err := p.writeLine(raw); err != nil {
+		return err
+	}
+	timer := time.NewTimer(p.Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.okays:
+			return nil
+		case <-p.done:
+			return nil
+		case <-aborted:
+			return errAborted
+		case <-p.keepalive:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(p.Timeout)
+		case <-timer.C:
+			return fmt.Errorf("No response to '%s' within %v", raw, p.Timeout)
+		}
+	}
+}
+
+// sendChecked sends a line, and sends it again with those that followed
+// if the firmware asks for a resend, e.g. when noise corrupted it.
+// Queries are left to handle resends themselves, as uploads do.
+func (p *Printer) sendChecked(raw string) error {
+	p.remember(raw)
+	pending := []string{raw}
+	for resends := 0; len(pending) > 0; {
+		p.takeResend()
+		if err := p.send(pending[0]); err != nil {
+			return err
+		}
+		lineNo, again := p.takeResend()
+		if again == nil {
+			resends = 0
+			pending = pending[1:]
+			continue
+		}
+		if resends++; resends > maxResends || len(again) == 0 {
+			return fmt.Errorf("Unable to resend line %d", lineNo)
+		}
+		pending = again
+	}
+	return nil
+}
+
+// remember keeps a numbered line for resending, in place of any with the
+// same or later numbers, which were from before they were reset.
+func (p *Printer) remember(raw string) {
+	lineNo, ok := lineNumber(raw)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, sent := range p.sent {
+		if n, _ := lineNumber(sent); n >= lineNo {
+			p.sent = p.sent[:i]
+			break
+		}
+	}
+	p.sent = append(p.sent, raw)
+	if len(p.sent) > resendHistory {
+		p.sent = p.sent[len(p.sent)-resendHistory:]
+	}
+}
+
+// takeResend returns the lines from the one the firmware asked for, which
+// is nil if it didn't and empty if that's no longer known.
+func (p *Printer) takeResend() (uint, []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.resending {
+		return 0, nil
+	}
+	p.resending = false
+	lines := []string{}
+	for i, sent := range p.sent {
+		if n, _ := lineNumber(sent); n == p.resend {
+			lines = append(lines, p.sent[i:]...)
+			break
+		}
+	}
+	return p.resend, lines
+}
+
+// lineNumber reads the number a line such as "N12 G28*18" starts with.
+func lineNumber(raw string) (uint, bool) {
+	if !strings.HasPrefix(raw, "N") {
+		return 0, false
+	}
+	end := strings.IndexAny(raw, " *")
+	if end < 0 {
+		end = len(raw)
+	}
+	lineNo, err := strconv.ParseUint(raw[1:end], 10, 32)
+	return uint(lineNo), err == nil
+}
+
+func (p *Printer) writeLine(raw string) error {
+	return p.writeRaw([]byte(raw + "\n"))
+}
+
+// writeRaw writes straight to the port, e.g. the packets of a binary
+// file transfer.
+func (p *Printer) writeRaw(data []byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	_, err := p.port.Write(data)
+	return err
+}
+
+// stream writes a line as soon as the firmware's receive buffer has room
+// for it, counting the characters of the lines it hasn't acknowledged,
+// rather than waiting for each "ok".
+func (p *Printer) stream(raw string) error {
+	if err := p.awaitRoom(p.Dialect.ReceiveBuffer() - len(raw) - 1); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.inflight = append(p.inflight, raw)
+	p.mutex.Unlock()
+	if err := p.writeLine(raw); err != nil {
+		p.clearInflight()
+		return err
+	}
+	return nil
+}
+
+// awaitRoom blocks until no more than limit bytes are unacknowledged;
+// each acknowledgement or "busy" restarts the timeout.
+func (p *Printer) awaitRoom(limit int) error {
+	aborted := p.Aborted()
+	timer := time.NewTimer(p.Timeout)
+	defer timer.Stop()
+	for {
+		size, oldest := p.unacknowledged()
+		if size == 0 || size <= limit {
+			return nil
+		}
+		select {
+		case <-p.done:
+			return nil
+		case <-aborted:
+			return errAborted
+		case <-p.okays:
+		case <-p.keepalive:
+		case <-timer.C:
+			p.clearInflight()
+			return fmt.Errorf("No response to '%s' within %v", oldest, p.Timeout)
+		}
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(p.Timeout)
+	}
+}
+
+// WaitForIdle blocks until the queue has drained.
+func (p *Printer) WaitForIdle(timeout time.Duration) error {
+	aborted := p.Aborted()
+	deadline := time.Now().Add(timeout)
+	for !p.Idle() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Queue still busy after %v", timeout)
+		}
+		select {
+		case <-aborted:
+			return errAborted
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// WaitForTemperatures polls with M105, or the dialect's equivalent,
+// unless the firmware reports them itself, until every heater that has
+// a target is within tolerance.
+func (p *Printer) WaitForTemperatures(tolerance float64, timeout time.Duration) error {
+	aborted := p.Aborted()
+	deadline := time.Now().Add(timeout)
+	polls := p.Dialect.Translate(NewCode("M105", ""))
+	for {
+		if !p.Features().AutoReport {
+			for _, poll := range polls {
+				select {
+				case p.remote <- poll.EmitAs(p.Dialect, 0):
+				default:
+				}
+			}
+		}
+		select {
+		case <-aborted:
+			return errAborted
+		case <-time.After(p.PollInterval):
+		}
+
+		reached := true
+		for _, temp := range p.Temperatures() {
+			if temp.Target > 0 && math.Abs(temp.Actual-temp.Target) > tolerance {
+				reached = false
+			}
+		}
+		if reached {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Temperatures not reached after %v", timeout)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testUserInterface records everything written to it so tests can
+// check what the user would have seen.
+type testUserInterface struct {
+	UserInterface
+	mutex  sync.Mutex
+	lines  []string
+	errors []string
+}
+
+func newTestUserInterface() *testUserInterface {
+	ui := &testUserInterface{}
+	ui.Start()
+	return ui
+}
+
+func (u *testUserInterface) Write(text []byte) (int, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.lines = append(u.lines, string(text))
+	return len(text), nil
+}
+
+func (u *testUserInterface) WriteString(text string) {
+	u.Write([]byte(text))
+}
+
+func (u *testUserInterface) Error(text string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.errors = append(u.errors, text)
+}
+
+func (u *testUserInterface) Lines() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string{}, u.lines...)
+}
+
+func (u *testUserInterface) Errors() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string{}, u.errors...)
+}
+
+// simulate pretends to be a printer on the far end of conn, calling
+// respond for every line received and sending back what it returns. The
+// function returned gives the lines received so far.
+func simulate(conn io.ReadWriter, respond func(line string) []string) func() []string {
+	received := make([]string, 0, 16)
+	var mutex sync.Mutex
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			mutex.Lock()
+			received = append(received, scanner.Text())
+			mutex.Unlock()
+			for _, reply := range respond(scanner.Text()) {
+				if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+// newConnectedContext gives a context whose printer is connected to the
+// device started on the far end of a pipe, and closed after the test.
+func newConnectedContext(t *testing.T, device func(conn net.Conn)) (Context, *testUserInterface) {
+	host, conn := net.Pipe()
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 8), Timeout: time.Second, Profile: NewProfile()}
+	ctx.Printer = NewPrinter(host, ui, ctx.Remote, time.Second)
+	device(conn)
+	ctx.Printer.Start()
+	t.Cleanup(func() { ctx.Printer.Close() })
+	return ctx, ui
+}
+
+// newSimulatedContext connects to a printer simulated by respond. The
+// function returned gives the lines it has received.
+func newSimulatedContext(t *testing.T, respond func(line string) []string) (Context, *testUserInterface, func() []string) {
+	var received func() []string
+	ctx, ui := newConnectedContext(t, func(conn net.Conn) { received = simulate(conn, respond) })
+	return ctx, ui, received
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrinterSendsAndRelays(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	received := simulate(device, func(line string) []string {
+		return []string{"echo:" + line, "ok"}
+	})
+	p.Start()
+	defer p.Close()
+
+	remote <- "M105"
+	remote <- "G28"
+	waitFor(t, func() bool { return len(ui.Lines()) == 4 })
+	assert.Equal(t, []string{"< echo:M105", "< ok", "< echo:G28", "< ok"}, ui.Lines())
+	assert.Equal(t, []string{"M105", "G28"}, received())
+	assert.Equal(t, 0, len(ui.Errors()))
+}
+
+func TestPrinterTimeout(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, 10*time.Millisecond)
+	simulate(device, func(line string) []string { return nil })
+	p.Start()
+	defer p.Close()
+
+	remote <- "G4 S10"
+	waitFor(t, func() bool { return len(ui.Errors()) == 1 })
+	assert.True(t, strings.HasPrefix(ui.Errors()[0], "No response to 'G4 S10'"))
+}
+
+func TestParseTemperatures(t *testing.T) {
+	assert.Nil(t, ParseTemperatures("ok"))
+	assert.Equal(t, map[string]Temperature{
+		"T": {210.1, 210},
+		"B": {59.5, 60},
+	}, ParseTemperatures("ok T:210.1 /210.0 B:59.5 /60.0 @:127 B@:0"))
+	assert.Equal(t, map[string]Temperature{
+		"T0": {20, 0},
+		"T1": {-15, 0},
+	}, ParseTemperatures(" T0:20.00 /0.00 T1:-15.00 /0.00"))
+}
+
+func TestPrinterStateAndEvents(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	p.PollInterval = time.Millisecond
+	events := make(chan Event, 8)
+	p.OnEvent(func(event Event) { events <- event })
+
+	heated := false
+	simulate(device, func(line string) []string {
+		switch line {
+		case "M104 S200":
+			heated = true
+			return []string{"ok"}
+		case "M105":
+			if heated {
+				return []string{"ok T:199.0 /200.0"}
+			}
+			return []string{"ok T:20.0 /0.0"}
+		}
+		return []string{"Error:Unknown command: \"" + line + "\"", "ok"}
+	})
+	p.Start()
+	defer p.Close()
+	assert.Equal(t, Event{EventConnect, ""}, <-events)
+
+	remote <- "M104 S200"
+	assert.Nil(t, p.WaitForTemperatures(2, time.Second))
+	assert.Equal(t, map[string]Temperature{"T": {199, 200}}, p.Temperatures())
+
+	remote <- "M999999"
+	assert.Equal(t, Event{EventError, "Unknown command: \"M999999\""}, <-events)
+	assert.Nil(t, p.WaitForIdle(time.Second))
+	assert.True(t, p.Idle())
+}
+
+func TestPrinterQuery(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, time.Second)
+	received := simulate(device, func(line string) []string {
+		if line == "M420 V" {
+			return []string{"busy: processing", " 0 +0.100 +0.200", " 1 +0.300 +0.400", "ok"}
+		}
+		return []string{"ok"}
+	})
+	p.Start()
+	defer p.Close()
+
+	remote <- "G28"
+	lines, err := p.Query("M420 V", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"busy: processing", "0 +0.100 +0.200", "1 +0.300 +0.400"}, lines)
+	assert.Equal(t, []string{"G28", "M420 V"}, received())
+}
+
+func TestPrinterResend(t *testing.T) {
+	corrupted := false
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		switch {
+		case strings.HasPrefix(line, "N3 ") && !corrupted:
+			// line 2 went missing, and 3 didn't follow it
+			corrupted = true
+			return []string{"Error:Line Number is not Last Line Number+1, Last Line: 1", "Resend: 2", "ok"}
+		case strings.HasPrefix(line, "N4 "):
+			return []string{"Error:checksum mismatch, Last Line: 3", "Resend: 4", "ok"}
+		}
+		return []string{"ok"}
+	})
+
+	lines := make([]string, 0, 4)
+	for idx, code := range []Code{NewCode("G28", ""), Move(IntParam('X', 10)), Move(IntParam('Y', 10)), Move(IntParam('Z', 10))} {
+		code.Comment = ""
+		lines = append(lines, code.EmitAs(Marlin, uint(idx+1)))
+	}
+	for _, line := range lines[:3] {
+		ctx.Remote <- line
+	}
+	waitFor(t, func() bool { return len(received()) == 5 })
+	assert.Nil(t, ctx.Printer.WaitForIdle(time.Second))
+	assert.Equal(t, []string{lines[0], lines[1], lines[2], lines[1], lines[2]}, received())
+	assert.Empty(t, ui.Errors())
+
+	// a line that's corrupted whenever it's sent is given up on
+	ctx.Remote <- lines[3]
+	waitFor(t, func() bool { return len(ui.Errors()) > 0 })
+	assert.Len(t, received(), 5+maxResends+1)
+	assert.Equal(t, []string{"Unable to resend line 4"}, ui.Errors())
+}
+
+func TestPrinterEmergency(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, 5*time.Second)
+	received := simulate(device, func(line string) []string {
+		if line == "G28" || line == "M112" {
+			// homing that never finishes, then a dead printer
+			return nil
+		}
+		return []string{"ok"}
+	})
+	p.Start()
+	defer p.Close()
+	ctx := Context{Timeout: 5 * time.Second, User: ui, Remote: remote, Printer: p, Aborted: p.Aborted()}
+
+	queried := make(chan error)
+	go func() {
+		_, err := p.Query("G28", 5*time.Second)
+		queried <- err
+	}()
+	waitFor(t, func() bool { return len(received()) == 1 })
+	for idx := 1; idx <= cap(remote); idx++ {
+		remote <- fmt.Sprintf("G1 X%d", idx)
+	}
+	sent := make(chan error)
+	go func() { sent <- sendCodes(ctx, Move(IntParam('X', 5))) }()
+
+	assert.False(t, runUrgent(ctx, Command{"G28", ui}))
+	assert.True(t, runUrgent(ctx, Command{"estop # now!", ui}))
+	assert.Equal(t, errAborted, <-queried)
+	assert.Equal(t, errAborted, <-sent)
+	assert.Nil(t, p.WaitForIdle(time.Second))
+	assert.Equal(t, []string{"G28", "M112"}, received())
+	assert.Empty(t, ui.Errors())
+
+	// the host carries on afresh once the printer is reset
+	lines, err := p.Query("M105", time.Second)
+	assert.Nil(t, err)
+	assert.Empty(t, lines)
+	assert.Equal(t, []string{"G28", "M112", "M105"}, received())
+}
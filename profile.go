@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"unicode"
+)
+
+// Profile holds the per-machine configuration, loaded from and saved to
+// a JSON file.
+type Profile struct {
+	Name   string            `json:"name,omitempty"`
+	Macros map[string]*Macro `json:"macros,omitempty"`
+
+	// Dialect is the firmware family: marlin (the default), prusa,
+	// klipper, rrf, smoothie or grbl.
+	Dialect string `json:"dialect,omitempty"`
+
+	// Port and Baud are where the printer was last found.
+	Port string `json:"port,omitempty"`
+	Baud int    `json:"baud,omitempty"`
+
+	// Precision overrides ParamPrecision, e.g. {"E": 4}
+	Precision map[string]int `json:"precision,omitempty"`
+
+	Tools      []ToolConfig     `json:"tools,omitempty"`
+	ToolChange ToolChangeConfig `json:"tool_change"`
+
+	Meshes   map[string]*Mesh `json:"meshes,omitempty"`
+	Tramming TrammingConfig   `json:"tramming"`
+
+	Calibration CalibrationConfig `json:"calibration"`
+	Laser       LaserConfig       `json:"laser"`
+	Plot        PlotConfig        `json:"plot"`
+	Watchdog    WatchdogConfig    `json:"watchdog"`
+
+	path string
+	mesh *Mesh // last probed or loaded
+}
+
+func NewProfile() *Profile {
+	return &Profile{Macros: make(map[string]*Macro), Meshes: make(map[string]*Mesh)}
+}
+
+// LoadProfile reads a profile; a file that doesn't exist yet gives an
+// empty profile which will be created when saved.
+func LoadProfile(path string) (*Profile, error) {
+	profile := NewProfile()
+	profile.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return profile, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, err
+	}
+	if profile.Macros == nil {
+		profile.Macros = make(map[string]*Macro)
+	}
+	for name := range profile.Macros {
+		if _, ok := commands[name]; ok {
+			return nil, fmt.Errorf("macro %s: it's a built-in command, which would always run instead", name)
+		}
+	}
+	if profile.Meshes == nil {
+		profile.Meshes = make(map[string]*Mesh)
+	}
+	return profile, nil
+}
+
+func (p *Profile) Save() error {
+	if p.path == "" {
+		return errors.New("no profile file was specified")
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, append(data, '\n'), 0644)
+}
+
+// ApplyPrecision installs the profile's parameter precision overrides.
+func (p *Profile) ApplyPrecision() error {
+	for key, precision := range p.Precision {
+		if len(key) != 1 || !unicode.IsLetter(rune(key[0])) {
+			return fmt.Errorf("invalid precision key: %s", key)
+		}
+		if precision < 0 {
+			return fmt.Errorf("invalid precision for %s: %d", key, precision)
+		}
+		ParamPrecision[unicode.ToUpper(rune(key[0]))] = precision
+	}
+	return nil
+}
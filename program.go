@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MinExtrudeTemp matches Marlin's default cold extrusion prevention.
+const MinExtrudeTemp = 170
+
+// Program builds a sequence of codes fluently, e.g.
+//
+//	NewProgram().Home().Heat(T0, 210).Wait().MoveTo(10, 10).Extrude(5)
+//
+// tracking positioning mode, position, tool and temperatures so that
+// nonsense (moving before homing, extruding cold, ...) is rejected as the
+// program is built. The first error sticks and later steps are ignored.
+type Program struct {
+	codes []Code
+	err   error
+
+	homed     bool
+	relative  bool
+	relativeE bool
+	position  map[rune]float64
+	feedrate  float64
+	tool      ToolId
+	hotends   map[ToolId]uint
+	bed       uint
+	pending   []Code
+	waiting   []ToolId
+	hotTools  map[ToolId]bool
+}
+
+func NewProgram() *Program {
+	return &Program{
+		position: map[rune]float64{'X': 0, 'Y': 0, 'Z': 0, 'E': 0},
+		hotends:  make(map[ToolId]uint),
+		hotTools: make(map[ToolId]bool),
+	}
+}
+
+func (p *Program) fail(format string, args ...interface{}) *Program {
+	if p.err == nil {
+		p.err = fmt.Errorf("step %d: %s", len(p.codes)+1, fmt.Sprintf(format, args...))
+	}
+	return p
+}
+
+func (p *Program) emit(codes ...Code) *Program {
+	p.codes = append(p.codes, codes...)
+	return p
+}
+
+// Err returns the first error encountered while building.
+func (p *Program) Err() error {
+	return p.err
+}
+
+// Codes returns the program, or the error that invalidated it.
+func (p *Program) Codes() ([]Code, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return append([]Code{}, p.codes...), nil
+}
+
+// Into queues the program on a Run.
+func (p *Program) Into(run *Run) error {
+	codes, err := p.Codes()
+	if err == nil {
+		run.Queue(codes...)
+	}
+	return err
+}
+
+// Position reports where the program will have left the machine.
+func (p *Program) Position() (x, y, z, e float64) {
+	return p.position['X'], p.position['Y'], p.position['Z'], p.position['E']
+}
+
+// Code appends an arbitrary code; the program can't track its effects.
+func (p *Program) Code(codes ...Code) *Program {
+	if p.err != nil {
+		return p
+	}
+	return p.emit(codes...)
+}
+
+// Home homes all axes; homing a subset still leaves the others unknown.
+func (p *Program) Home(axes ...rune) *Program {
+	if p.err != nil {
+		return p
+	}
+	if len(axes) == 0 {
+		p.homed = true
+		axes = []rune{'X', 'Y', 'Z'}
+		p.emit(Home())
+	} else {
+		p.emit(Home(axes...))
+	}
+	for _, axis := range axes {
+		p.position[axis] = 0
+	}
+	return p
+}
+
+// Assume declares the current position without moving, using G92.
+func (p *Program) Assume(x, y, z float64) *Program {
+	if p.err != nil {
+		return p
+	}
+	p.homed = true
+	p.position['X'], p.position['Y'], p.position['Z'] = x, y, z
+	return p.emit(SetPosition(FloatParam('X', x), FloatParam('Y', y), FloatParam('Z', z)))
+}
+
+func (p *Program) Absolute() *Program {
+	if p.err != nil || !p.relative {
+		return p
+	}
+	p.relative = false
+	return p.emit(AbsolutePositioning())
+}
+
+func (p *Program) Relative() *Program {
+	if p.err != nil || p.relative {
+		return p
+	}
+	p.relative = true
+	return p.emit(RelativePositioning())
+}
+
+func (p *Program) RelativeExtrusion() *Program {
+	if p.err != nil || p.relativeE {
+		return p
+	}
+	p.relativeE = true
+	return p.emit(RelativeExtrusion())
+}
+
+func (p *Program) AbsoluteExtrusion() *Program {
+	if p.err != nil || !p.relativeE {
+		return p
+	}
+	p.relativeE = false
+	return p.emit(AbsoluteExtrusion())
+}
+
+// Feed sets the feedrate (mm/min) used by subsequent moves.
+func (p *Program) Feed(rate float64) *Program {
+	if p.err != nil {
+		return p
+	}
+	if rate <= 0 {
+		return p.fail("feedrate must be positive, got %v", rate)
+	}
+	p.feedrate = rate
+	return p
+}
+
+func (p *Program) Tool(tool ToolId) *Program {
+	if p.err != nil || tool == p.tool {
+		return p
+	}
+	p.tool = tool
+	return p.emit(ToolIdx(tool))
+}
+
+// Heat sets a hotend temperature without waiting; see Wait.
+func (p *Program) Heat(tool ToolId, celcius uint) *Program {
+	if p.err != nil {
+		return p
+	}
+	wait := ToolTempWait(tool, celcius)
+	if previous, ok := p.hotends[tool]; ok && celcius < previous {
+		wait = ToolTempCoolWait(tool, celcius)
+	}
+	p.hotends[tool] = celcius
+	p.hotTools[tool] = false
+	p.pending = append(p.pending, wait)
+	p.waiting = append(p.waiting, tool)
+	return p.emit(ToolTemp(tool, celcius))
+}
+
+func (p *Program) HeatBed(celcius uint) *Program {
+	if p.err != nil {
+		return p
+	}
+	p.bed = celcius
+	p.pending = append(p.pending, BedTempWait(celcius))
+	return p.emit(BedTemp(celcius))
+}
+
+// Wait blocks until every heater set since the last Wait is at temperature.
+func (p *Program) Wait() *Program {
+	if p.err != nil {
+		return p
+	}
+	if len(p.pending) == 0 {
+		return p.fail("wait without anything heating")
+	}
+	for _, tool := range p.waiting {
+		p.hotTools[tool] = true
+	}
+	p.emit(p.pending...)
+	p.pending, p.waiting = nil, nil
+	return p
+}
+
+// Cool turns off all the heaters.
+func (p *Program) Cool() *Program {
+	if p.err != nil {
+		return p
+	}
+	tools := make([]int, 0, len(p.hotends))
+	for tool := range p.hotends {
+		tools = append(tools, int(tool))
+	}
+	sort.Ints(tools)
+	for _, tool := range tools {
+		p.emit(ToolTemp(ToolId(tool), 0))
+	}
+	p.hotends = make(map[ToolId]uint)
+	p.hotTools = make(map[ToolId]bool)
+	if p.bed != 0 {
+		p.bed = 0
+		p.emit(BedTemp(0))
+	}
+	p.pending, p.waiting = nil, nil
+	return p
+}
+
+func (p *Program) Dwell(milliseconds uint) *Program {
+	if p.err != nil {
+		return p
+	}
+	return p.emit(Dwell(milliseconds))
+}
+
+func (p *Program) Fan(speed uint) *Program {
+	if p.err != nil {
+		return p
+	}
+	if speed > 255 {
+		return p.fail("fan speed must be 0-255, got %d", speed)
+	}
+	if speed == 0 {
+		return p.emit(FanOff())
+	}
+	return p.emit(FanSpeed(speed))
+}
+
+// axisParams converts target positions into parameters for the current
+// positioning mode, updating the tracked position.
+func (p *Program) axisParams(targets map[rune]float64) []Param {
+	params := make([]Param, 0, len(targets)+1)
+	for _, axis := range []rune{'X', 'Y', 'Z', 'E'} {
+		target, ok := targets[axis]
+		if !ok {
+			continue
+		}
+		value := target
+		relative := p.relative
+		if axis == 'E' {
+			relative = p.relativeE
+		}
+		if relative {
+			value = target - p.position[axis]
+		}
+		p.position[axis] = target
+		params = append(params, FloatParam(axis, value))
+	}
+	if p.feedrate > 0 {
+		params = append(params, FloatParam('F', p.feedrate))
+	}
+	return params
+}
+
+func (p *Program) canMove() bool {
+	if !p.homed {
+		p.fail("move before homing")
+		return false
+	}
+	return true
+}
+
+func (p *Program) canExtrude(amount float64) bool {
+	if amount == 0 {
+		return true
+	}
+	celcius, heated := p.hotends[p.tool]
+	if !heated || celcius < MinExtrudeTemp {
+		p.fail("cold extrusion: tool %d is set to %d°C", p.tool, celcius)
+		return false
+	}
+	if !p.hotTools[p.tool] {
+		p.fail("extrusion before waiting for tool %d to heat", p.tool)
+		return false
+	}
+	return true
+}
+
+// MoveTo travels (G0) to x, y without extruding.
+func (p *Program) MoveTo(x, y float64) *Program {
+	if p.err != nil || !p.canMove() {
+		return p
+	}
+	return p.emit(Travel(p.axisParams(map[rune]float64{'X': x, 'Y': y})...))
+}
+
+// MoveZ travels (G0) to the given height.
+func (p *Program) MoveZ(z float64) *Program {
+	if p.err != nil || !p.canMove() {
+		return p
+	}
+	return p.emit(Travel(p.axisParams(map[rune]float64{'Z': z})...))
+}
+
+// Extrude pushes (or, if negative, retracts) filament without moving.
+func (p *Program) Extrude(amount float64) *Program {
+	if p.err != nil || !p.canExtrude(amount) {
+		return p
+	}
+	return p.emit(Move(p.axisParams(map[rune]float64{'E': p.position['E'] + amount})...))
+}
+
+// LineTo prints (G1) a line to x, y extruding amount of filament.
+func (p *Program) LineTo(x, y, amount float64) *Program {
+	if p.err != nil || !p.canMove() || !p.canExtrude(amount) {
+		return p
+	}
+	return p.emit(Move(p.axisParams(map[rune]float64{'X': x, 'Y': y, 'E': p.position['E'] + amount})...))
+}
+
+// Distance from the current position to x, y, handy for working out
+// how much to extrude along a line.
+func (p *Program) Distance(x, y float64) float64 {
+	return math.Hypot(x-p.position['X'], y-p.position['Y'])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func emitAll(codes []Code) string {
+	lines := make([]string, 0, len(codes))
+	for _, code := range codes {
+		lines = append(lines, code.Emit(0))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestFloatStr(t *testing.T) {
+	assert.Equal(t, "12.5", FloatStr(12.5))
+	assert.Equal(t, "0.3", FloatStr(0.1+0.2))
+	assert.Equal(t, "100", FloatStr(100))
+	assert.Equal(t, "0", FloatStr(-0.000001))
+	assert.Equal(t, "-1.25", FloatStr(-1.25))
+}
+
+func TestProgram(t *testing.T) {
+	codes, err := NewProgram().
+		Home().
+		Heat(T0, 210).HeatBed(60).Wait().
+		Feed(3000).MoveTo(10, 20).
+		Feed(1200).LineTo(30, 20, 1.5).
+		Extrude(-0.8).
+		Cool().
+		Codes()
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"G28 ;home",
+		"M104 T0 S210 ;set tool temp",
+		"M140 S60 ;set bed temp",
+		"M109 T0 S210 ;wait for tool temp",
+		"M190 S60 ;wait for bed temp",
+		"G0 X10 Y20 F3000 ;travel",
+		"G1 X30 Y20 E1.5 F1200 ;move",
+		"G1 E0.7 F1200 ;move",
+		"M104 T0 S0 ;set tool temp",
+		"M140 S0 ;set bed temp",
+	}, "\n"), emitAll(codes))
+}
+
+func TestProgramRelative(t *testing.T) {
+	p := NewProgram().Assume(100, 100, 5).Heat(T1, 200).Wait().Tool(T1).Relative().RelativeExtrusion()
+	p.MoveTo(110, 95).MoveZ(5.2).LineTo(120, 95, 0.4).Absolute().MoveTo(0, 0)
+	codes, err := p.Codes()
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"G92 X100 Y100 Z5 ;set position",
+		"M104 T1 S200 ;set tool temp",
+		"M109 T1 S200 ;wait for tool temp",
+		"T1 ;select tool",
+		"G91 ;relative positioning",
+		"M83 ;relative extrusion",
+		"G0 X10 Y-5 ;travel",
+		"G0 Z0.2 ;travel",
+		"G1 X10 Y0 E0.4 ;move",
+		"G90 ;absolute positioning",
+		"G0 X0 Y0 ;travel",
+	}, "\n"), emitAll(codes))
+
+	x, y, z, e := p.Position()
+	assert.Equal(t, []float64{0, 0, 5.2, 0.4}, []float64{x, y, z, e})
+}
+
+func TestProgramRejects(t *testing.T) {
+	for expected, p := range map[string]*Program{
+		"step 1: move before homing":                          NewProgram().MoveTo(1, 1),
+		"step 2: move before homing":                          NewProgram().Home('X').MoveZ(1),
+		"step 2: cold extrusion: tool 0 is set to 0°C":        NewProgram().Home().Extrude(1),
+		"step 4: cold extrusion: tool 0 is set to 150°C":      NewProgram().Home().Heat(T0, 150).Wait().Extrude(1),
+		"step 3: extrusion before waiting for tool 0 to heat": NewProgram().Home().Heat(T0, 200).LineTo(1, 1, 1),
+		"step 5: cold extrusion: tool 1 is set to 0°C":        NewProgram().Home().Heat(T0, 200).Wait().Tool(T1).Extrude(1),
+		"step 1: wait without anything heating":               NewProgram().Wait().Home(),
+		"step 2: feedrate must be positive, got -5":           NewProgram().Home().Feed(-5),
+		"step 1: fan speed must be 0-255, got 256":            NewProgram().Fan(256),
+	} {
+		codes, err := p.Codes()
+		assert.Nil(t, codes)
+		assert.EqualError(t, err, expected)
+		assert.Equal(t, p.Into(&Run{}), err)
+	}
+}
+
+func TestProgramInto(t *testing.T) {
+	r, writer := tearUp(t)
+	assert.Nil(t, NewProgram().Home().Fan(255).Dwell(500).Into(&r))
+	assert.Nil(t, r.Execute())
+	assert.Equal(t, "G28\nM106 S255\nG4 P500\n", writer.String())
+}
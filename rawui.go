@@ -22,9 +22,7 @@ func (u *RawUserInterface) Start() {
 			if err != nil {
 				break
 			}
-			if u.commands != nil {
-				*u.commands <- strings.TrimRight(text, "\r\n 	")
-			}
+			u.submit(Command{strings.TrimRight(text, "\r\n 	"), u})
 		}
 	}()
 	go func() {
@@ -55,3 +53,10 @@ func NewRawUserInterface() *RawUserInterface {
 func (u RawUserInterface) Error(text string) {
 	u.WriteString("** Error: " + text)
 }
+
+// ShowMesh draws the mesh as an ANSI coloured heatmap.
+func (u RawUserInterface) ShowMesh(mesh *Mesh) {
+	for _, line := range mesh.Render(true) {
+		u.WriteString(line)
+	}
+}
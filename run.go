@@ -5,6 +5,7 @@ import "io"
 type Run struct {
 	Checksum bool
 	Comments bool
+	Dialect  Dialect
 	writer   io.Writer
 
 	LineNo     uint
@@ -14,7 +15,7 @@ type Run struct {
 
 func NewRun(checksum bool, comments bool, writer io.Writer) Run {
 	history, queue := make([]Code, 0, 1024), make([]Code, 0, 1024)
-	return Run{Checksum: checksum, Comments: comments, writer: writer, cmdHistory: &history, cmdQueue: &queue}
+	return Run{Checksum: checksum, Comments: comments, Dialect: Marlin, writer: writer, cmdHistory: &history, cmdQueue: &queue}
 }
 
 func (r *Run) Reset() {
@@ -28,22 +29,28 @@ func (r *Run) Queue(codes ...Code) {
 }
 
 func (r *Run) executeCode(cmds ...Code) error {
+	numbered := r.Checksum && r.Dialect.Numbered()
 	lineNo := uint(0)
-	if r.Checksum {
+	if numbered {
 		lineNo = r.LineNo + 1
 	}
+	translated := make([]Code, 0, len(cmds))
 	for _, code := range cmds {
+		translated = append(translated, r.Dialect.Translate(code)...)
+	}
+	for _, code := range translated {
 		if !r.Comments && code.Comment != "" {
 			code.Comment = ""
 		}
-		if !r.Checksum || code.GCode == "M110" {
+		setsLineNo := r.Dialect.SetsLineNumber(code)
+		if !numbered || setsLineNo {
 			code.HideChecksum = true
 		}
-		if _, err := r.writer.Write([]byte(code.Emit(lineNo) + "\n")); err != nil {
+		if _, err := r.writer.Write([]byte(code.EmitAs(r.Dialect, lineNo) + "\n")); err != nil {
 			return err
 		}
 		if lineNo > 0 {
-			if code.GCode != "M110" {
+			if !setsLineNo {
 				code.LineNo = lineNo
 			} else {
 				code.LineNo = 0
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Scripts are written in Starlark (a Python dialect). A script can drive
+// the printer directly and can define hook functions which are called
+// when the printer reports the corresponding event:
+//
+//	on_connect()        printer connected or reset
+//	on_print_done()     a print finished
+//	on_error(message)   the printer or host reported an error
+var scriptHooks = map[string]string{
+	EventConnect:   "on_connect",
+	EventPrintDone: "on_print_done",
+	EventError:     "on_error",
+}
+
+// Scripting keeps the hooks registered by loaded scripts.
+type Scripting struct {
+	mutex sync.Mutex
+	hooks map[string][]starlark.Callable
+	ctx   Context
+}
+
+func NewScripting(ctx Context) *Scripting {
+	s := &Scripting{hooks: make(map[string][]starlark.Callable), ctx: ctx}
+	if ctx.Printer != nil {
+		ctx.Printer.OnEvent(s.dispatchEvent)
+	}
+	return s
+}
+
+func (s *Scripting) dispatchEvent(event Event) {
+	s.mutex.Lock()
+	hooks := append([]starlark.Callable{}, s.hooks[event.Kind]...)
+	s.mutex.Unlock()
+	for _, hook := range hooks {
+		args := starlark.Tuple{}
+		if event.Kind == EventError {
+			args = starlark.Tuple{starlark.String(event.Text)}
+		}
+		if _, err := starlark.Call(s.thread(s.ctx, hook.Name()), hook, args, nil); err != nil {
+			s.ctx.User.Error(fmt.Sprintf("%s: %s", hook.Name(), err))
+		}
+	}
+}
+
+// Hooks lists the registered hooks by event.
+func (s *Scripting) Hooks() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hooks := make([]string, 0, len(s.hooks))
+	for event, fns := range s.hooks {
+		for _, fn := range fns {
+			hooks = append(hooks, event+": "+fn.Name())
+		}
+	}
+	sort.Strings(hooks)
+	return hooks
+}
+
+func (s *Scripting) ClearHooks() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = make(map[string][]starlark.Callable)
+}
+
+func (s *Scripting) thread(ctx Context, name string) *starlark.Thread {
+	return &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { ctx.User.WriteString(msg) },
+	}
+}
+
+// Exec runs a script, registering any hooks it defines.
+func (s *Scripting) Exec(ctx Context, filename string, src interface{}) error {
+	// each call from the script, or its hooks later, checks for aborts afresh
+	ctx.Aborted = nil
+	globals, err := starlark.ExecFile(s.thread(ctx, filename), filename, src, scriptBuiltins(ctx))
+	if err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			return errors.New(evalErr.Backtrace())
+		}
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for event, name := range scriptHooks {
+		if fn, ok := globals[name].(starlark.Callable); ok {
+			s.hooks[event] = append(s.hooks[event], fn)
+		}
+	}
+	return nil
+}
+
+// ExecFile loads and runs a script from disk.
+func (s *Scripting) ExecFile(ctx Context, filename string) error {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return s.Exec(ctx, filename, src)
+}
+
+// current is ctx for one call from a script, stopped by an abort during
+// the call but not by one before it, e.g. the reset that runs on_connect.
+func current(ctx Context) Context {
+	ctx.Aborted = nil
+	if ctx.Printer != nil {
+		ctx.Aborted = ctx.Printer.Aborted()
+	}
+	return ctx
+}
+
+func scriptBuiltins(ctx Context) starlark.StringDict {
+	builtin := func(name string, fn func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return fn(current(ctx), args, kwargs)
+		})
+	}
+	codeBuiltin := func(name string, fn func(args starlark.Tuple, kwargs []starlark.Tuple) (Code, error)) *starlark.Builtin {
+		return builtin(name, func(_ Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			code, err := fn(args, kwargs)
+			return &scriptCode{code}, err
+		})
+	}
+
+	ops := starlarkstruct.FromStringDict(starlark.String("ops"), starlark.StringDict{
+		"code": codeBuiltin("code", func(args starlark.Tuple, kwargs []starlark.Tuple) (Code, error) {
+			// code("G1", "comment", X=10, Y=20)
+			var gcode, comment string
+			if err := starlark.UnpackPositionalArgs("code", args, nil, 1, &gcode, &comment); err != nil {
+				return Code{}, err
+			}
+			code := NewCode(gcode, comment)
+			for _, kwarg := range kwargs {
+				key, value := string(kwarg[0].(starlark.String)), kwarg[1]
+				if len(key) != 1 {
+					return code, fmt.Errorf("code: parameter key must be a letter: %s", key)
+				}
+				var param Param
+				switch typed := value.(type) {
+				case starlark.Bool:
+					if !typed {
+						continue
+					}
+					param = FlagParam(getRune(key))
+				case starlark.Float:
+					param = FloatParam(getRune(key), float64(typed))
+				case starlark.String:
+					param = StringParam(getRune(key), string(typed))
+				default:
+					param = StringParam(getRune(key), value.String())
+				}
+				if err := code.Override(param.Key, param.Value); err != nil {
+					return code, err
+				}
+			}
+			return code, nil
+		}),
+		"tool": codeBuiltin("tool", func(args starlark.Tuple, kwargs []starlark.Tuple) (Code, error) {
+			var tool int
+			err := starlark.UnpackArgs("tool", args, kwargs, "index", &tool)
+			return ToolIdx(ToolId(tool)), err
+		}),
+		"line_no": codeBuiltin("line_no", func(args starlark.Tuple, kwargs []starlark.Tuple) (Code, error) {
+			var lineNo int
+			if err := starlark.UnpackArgs("line_no", args, kwargs, "line", &lineNo); err != nil {
+				return Code{}, err
+			}
+			if lineNo < 1 {
+				return Code{}, fmt.Errorf("line_no: line must be positive")
+			}
+			return LineNo(uint(lineNo)), nil
+		}),
+		"hotend_temp": codeBuiltin("hotend_temp", func(args starlark.Tuple, kwargs []starlark.Tuple) (Code, error) {
+			var celcius, maxAuto int
+			err := starlark.UnpackArgs("hotend_temp", args, kwargs, "celcius", &celcius, "max_auto?", &maxAuto)
+			return HotendTempMaxAuto(uint(celcius), uint(maxAuto)), err
+		}),
+	})
+
+	return starlark.StringDict{
+		"ops": ops,
+		"Run": builtin("Run", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var checksum, comments bool
+			if err := starlark.UnpackArgs("Run", args, kwargs, "checksum?", &checksum, "comments?", &comments); err != nil {
+				return nil, err
+			}
+			run := NewRun(checksum, comments, remoteWriter{ctx})
+			run.Dialect = dialectOf(ctx)
+			r := &scriptRun{run: run, ctx: ctx}
+			if ctx.Tools != nil && len(ctx.Tools.Tools) > 0 {
+				r.tools = ctx.Tools
+			}
+			return r, nil
+		}),
+		"send": builtin("send", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var raw string
+			if err := starlark.UnpackArgs("send", args, kwargs, "raw", &raw); err != nil {
+				return nil, err
+			}
+			return starlark.None, sendRaw(ctx, raw)
+		}),
+		"command": builtin("command", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var line string
+			if err := starlark.UnpackArgs("command", args, kwargs, "line", &line); err != nil {
+				return nil, err
+			}
+			return starlark.None, dispatch(ctx, line)
+		}),
+		"temperatures": builtin("temperatures", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs("temperatures", args, kwargs); err != nil {
+				return nil, err
+			}
+			temps := starlark.NewDict(4)
+			if ctx.Printer != nil {
+				for heater, temp := range ctx.Printer.Temperatures() {
+					temps.SetKey(starlark.String(heater), starlark.Tuple{starlark.Float(temp.Actual), starlark.Float(temp.Target)})
+				}
+			}
+			return temps, nil
+		}),
+		"wait_temperatures": builtin("wait_temperatures", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			tolerance, timeout := 2.0, 600.0
+			if err := starlark.UnpackArgs("wait_temperatures", args, kwargs, "tolerance?", &tolerance, "timeout?", &timeout); err != nil {
+				return nil, err
+			}
+			if ctx.Printer == nil {
+				return nil, errNoPrinter
+			}
+			return starlark.None, ctx.Printer.WaitForTemperatures(tolerance, time.Duration(timeout*float64(time.Second)))
+		}),
+		"wait_idle": builtin("wait_idle", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			timeout := 600.0
+			if err := starlark.UnpackArgs("wait_idle", args, kwargs, "timeout?", &timeout); err != nil {
+				return nil, err
+			}
+			if ctx.Printer == nil {
+				return nil, errNoPrinter
+			}
+			return starlark.None, ctx.Printer.WaitForIdle(time.Duration(timeout * float64(time.Second)))
+		}),
+		"sleep": builtin("sleep", func(ctx Context, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var seconds float64
+			if err := starlark.UnpackArgs("sleep", args, kwargs, "seconds", &seconds); err != nil {
+				return nil, err
+			}
+			select {
+			case <-time.After(time.Duration(seconds * float64(time.Second))):
+				return starlark.None, nil
+			case <-ctx.Aborted:
+				return nil, errAborted
+			}
+		}),
+	}
+}
+
+var errNoPrinter = errors.New("no printer connected")
+
+// scriptCode exposes a Code to scripts.
+type scriptCode struct {
+	code Code
+}
+
+func (c *scriptCode) String() string        { return c.code.Emit(0) }
+func (c *scriptCode) Type() string          { return "code" }
+func (c *scriptCode) Freeze()               {}
+func (c *scriptCode) Truth() starlark.Bool  { return starlark.True }
+func (c *scriptCode) Hash() (uint32, error) { return starlark.String(c.String()).Hash() }
+
+func (c *scriptCode) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "gcode":
+		return starlark.String(c.code.GCode), nil
+	case "comment":
+		return starlark.String(c.code.Comment), nil
+	case "params":
+		params := starlark.NewDict(len(c.code.Parameters))
+		for _, param := range c.code.Parameters {
+			params.SetKey(starlark.String(string(param.Key)), starlark.String(param.Value))
+		}
+		return params, nil
+	}
+	return nil, nil
+}
+
+func (c *scriptCode) AttrNames() []string {
+	return []string{"comment", "gcode", "params"}
+}
+
+// scriptRun exposes a Run, writing to the printer, to scripts. On a
+// machine with tools configured, the tool changes queued are planned
+// before they're executed.
+type scriptRun struct {
+	run   Run
+	ctx   Context
+	tools *ToolChangePlanner
+}
+
+func (r *scriptRun) String() string        { return "<Run>" }
+func (r *scriptRun) Type() string          { return "Run" }
+func (r *scriptRun) Freeze()               {}
+func (r *scriptRun) Truth() starlark.Bool  { return starlark.True }
+func (r *scriptRun) Hash() (uint32, error) { return 0, errors.New("unhashable type: Run") }
+
+func (r *scriptRun) codes(name string, args starlark.Tuple) ([]Code, error) {
+	codes := make([]Code, 0, len(args))
+	for _, arg := range args {
+		code, ok := arg.(*scriptCode)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected code, got %s", name, arg.Type())
+		}
+		codes = append(codes, code.code)
+	}
+	return codes, nil
+}
+
+func (r *scriptRun) Attr(name string) (starlark.Value, error) {
+	method := func(fn func(args starlark.Tuple) error) starlark.Value {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(kwargs) > 0 {
+				return nil, fmt.Errorf("%s: unexpected keyword arguments", name)
+			}
+			return starlark.None, fn(args)
+		})
+	}
+	switch name {
+	case "queue":
+		return method(func(args starlark.Tuple) error {
+			codes, err := r.codes(name, args)
+			if err == nil {
+				r.run.Queue(codes...)
+			}
+			return err
+		}), nil
+	case "execute":
+		return method(func(args starlark.Tuple) error {
+			if r.tools != nil {
+				if err := r.tools.Apply(&r.run); err != nil {
+					r.run.Reset()
+					return err
+				}
+			}
+			r.run.writer = remoteWriter{current(r.ctx)}
+			return r.run.Execute()
+		}), nil
+	case "execute_immediate":
+		return method(func(args starlark.Tuple) error {
+			codes, err := r.codes(name, args)
+			if err == nil {
+				r.run.writer = remoteWriter{current(r.ctx)}
+				err = r.run.ExecuteImmediate(codes...)
+			}
+			return err
+		}), nil
+	case "reset":
+		return method(func(args starlark.Tuple) error { r.run.Reset(); return nil }), nil
+	case "line_no":
+		return starlark.MakeUint(r.run.LineNo), nil
+	}
+	return nil, nil
+}
+
+func (r *scriptRun) AttrNames() []string {
+	return []string{"execute", "execute_immediate", "line_no", "queue", "reset"}
+}
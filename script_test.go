@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drainRemote(ctx Context) []string {
+	sent := []string{}
+	for {
+		select {
+		case raw := <-ctx.Remote:
+			sent = append(sent, raw)
+		default:
+			return sent
+		}
+	}
+}
+
+func TestScriptOps(t *testing.T) {
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 16), Timeout: time.Second, Profile: NewProfile()}
+	scripts := NewScripting(ctx)
+
+	err := scripts.Exec(ctx, "test.star", `
+run = Run(checksum=True)
+run.queue(ops.tool(1), ops.hotend_temp(200, max_auto=210))
+run.queue(ops.code("G1", "move", X=10, y="2.5", E=True, F=False))
+run.execute()
+send("M400")
+print(ops.code("G28").gcode, run.line_no)
+command("help")
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"N1 T1*58", "N2 M104 S200 B210 F*82", "N3 G1 X10 Y2.5 E*103", "M400"}, drainRemote(ctx))
+	assert.Equal(t, []string{"G28 3", "> help", "There's no help yet."}, ui.Lines())
+
+	err = scripts.Exec(ctx, "bad.star", `run = Run()
+run.queue("G28")`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "queue: expected code, got string")
+}
+
+func TestScriptToolChanges(t *testing.T) {
+	ctx := Context{User: newTestUserInterface(), Remote: make(chan string, 16), Timeout: time.Second, Profile: NewProfile()}
+	ctx.Tools = NewToolChangePlanner([]ToolConfig{{Active: 210, Standby: 170}, {Active: 230, Standby: 180}}, ToolChangeConfig{Lookahead: 1})
+	scripts := NewScripting(ctx)
+
+	err := scripts.Exec(ctx, "tools.star", `
+run = Run()
+run.queue(ops.code("G1", X=1), ops.code("G1", X=2), ops.tool(1), ops.code("G1", X=3))
+run.execute()
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"G1 X1", "M104 T1 S230", "G1 X2", "M104 T0 S170", "T1", "M109 T1 S230", "G1 X3"}, drainRemote(ctx))
+	assert.Equal(t, T1, ctx.Tools.Current())
+
+	err = scripts.Exec(ctx, "bad.star", `
+run = Run()
+run.queue(ops.code("G1", X=1), ops.tool(3))
+run.execute()
+`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "execute: tool 3 is not configured")
+	assert.Empty(t, drainRemote(ctx))
+}
+
+func TestScriptHooks(t *testing.T) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 16), Timeout: time.Second, Profile: NewProfile()}
+	ctx.Printer = NewPrinter(host, ui, ctx.Remote, time.Second)
+	simulate(device, func(line string) []string {
+		if line == "M24" {
+			return []string{"ok", "Done printing file"}
+		}
+		return []string{"ok"}
+	})
+	scripts := NewScripting(ctx)
+
+	assert.Nil(t, scripts.Exec(ctx, "hooks.star", `
+def on_connect():
+    send("M115")
+
+def on_print_done():
+    print("finished")
+
+def on_error(message):
+    print("oh no: " + message)
+`))
+	assert.Equal(t, []string{"connect: on_connect", "error: on_error", "print_done: on_print_done"}, scripts.Hooks())
+
+	ctx.Printer.Start()
+	defer ctx.Printer.Close()
+	assert.Nil(t, sendRaw(ctx, "M24"))
+	waitFor(t, func() bool {
+		for _, line := range ui.Lines() {
+			if line == "finished" {
+				return true
+			}
+		}
+		return false
+	})
+	assert.Contains(t, ui.Lines(), "< ok")
+
+	scripts.ClearHooks()
+	assert.Equal(t, 0, len(scripts.Hooks()))
+}
+
+func TestScriptHooksAfterRestart(t *testing.T) {
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if line == "M999" {
+			return []string{"ok", "start"}
+		}
+		return []string{"ok"}
+	})
+	path := filepath.Join(t.TempDir(), "hooks.star")
+	assert.Nil(t, os.WriteFile(path, []byte("def on_connect():\n    sleep(0.01)\n    send(\"M115\")\n"), 0644))
+	ctx.Scripts = NewScripting(ctx)
+	assert.Nil(t, dispatch(ctx, "script run "+path))
+
+	// the reset aborts what the script run command started with, but
+	// not the hook
+	assert.Nil(t, sendRaw(ctx, "M999"))
+	waitFor(t, func() bool { return len(received()) == 3 })
+	assert.Equal(t, []string{"M999", "M110 N0", "M115"}, received())
+	assert.Empty(t, ui.Errors())
+}
+
+func TestScriptCodeParams(t *testing.T) {
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 16), Timeout: time.Second, Profile: NewProfile()}
+	assert.Nil(t, NewScripting(ctx).Exec(ctx, "params.star", `send(str(ops.code("G1", X=0.1+0.2, E=1.0/3, F=1500, Z="abc")))`))
+	assert.Equal(t, []string{"G1 X0.3 E0.33333 F1500 Zabc"}, drainRemote(ctx))
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SDFile is a file on the printer's SD card. Name is its 8.3 name, which
+// the other commands take; LongName is only known if it was listed with
+// long names.
+type SDFile struct {
+	Name     string
+	Size     int64
+	LongName string
+}
+
+func (f SDFile) String() string {
+	if f.LongName == "" || f.LongName == f.Name {
+		return fmt.Sprintf("%-14s %10d", f.Name, f.Size)
+	}
+	return fmt.Sprintf("%-14s %10d  %s", f.Name, f.Size, f.LongName)
+}
+
+// SDStatus is the progress of a print from the SD card.
+type SDStatus struct {
+	Printing bool
+	File     SDFile // if asked with M27 C
+	Done     int64  // bytes
+	Size     int64
+}
+
+func (s SDStatus) String() string {
+	if !s.Printing {
+		return "Not printing from SD"
+	}
+	name := s.File.LongName
+	if name == "" {
+		name = s.File.Name
+	}
+	if name != "" {
+		name += ": "
+	}
+	percent := 0.0
+	if s.Size > 0 {
+		percent = 100 * float64(s.Done) / float64(s.Size)
+	}
+	return fmt.Sprintf("Printing %s%.1f%% (%d/%d bytes)", name, percent, s.Done, s.Size)
+}
+
+// sdLines strips the "echo:" Marlin puts in front of some replies.
+func sdLines(lines []string) []string {
+	stripped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		stripped = append(stripped, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "echo:")))
+	}
+	return stripped
+}
+
+// sdFailure finds the reason an SD command failed in its reply, e.g.
+// "open failed, File: benchy.gco." or "No media".
+func sdFailure(lines []string) error {
+	for _, line := range sdLines(lines) {
+		lower := strings.ToLower(line)
+		for _, failure := range []string{"failed", "no media", "no sd card", "error"} {
+			if strings.Contains(lower, failure) {
+				return errors.New(strings.TrimSuffix(strings.TrimPrefix(line, "Error:"), "."))
+			}
+		}
+	}
+	return nil
+}
+
+// ParseSDList reads an M20 listing, e.g.
+//
+//	Begin file list
+//	BENCHY~1.GCO 1234567 3DBenchy.gcode
+//	CALIB/CUBE.GCO 20480
+//	End file list
+func ParseSDList(lines []string) ([]SDFile, error) {
+	files, listing := make([]SDFile, 0, len(lines)), false
+	for _, line := range sdLines(lines) {
+		switch {
+		case line == "Begin file list":
+			listing = true
+		case line == "End file list":
+			return files, nil
+		case listing && line != "":
+			fields := strings.SplitN(line, " ", 3)
+			file := SDFile{Name: fields[0]}
+			if len(fields) > 1 {
+				size, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad size in SD listing: %s", line)
+				}
+				file.Size = size
+			}
+			if len(fields) > 2 {
+				file.LongName = strings.TrimSpace(fields[2])
+			}
+			files = append(files, file)
+		}
+	}
+	if err := sdFailure(lines); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no file list in the printer's reply")
+}
+
+// ParseSDSelect reads the reply to M23, e.g. "File opened: BENCHY~1.GCO
+// Size: 1234567" then "File selected".
+func ParseSDSelect(lines []string) (SDFile, error) {
+	for _, line := range sdLines(lines) {
+		if !strings.HasPrefix(line, "File opened:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "File opened:"))
+		if len(fields) != 3 || fields[1] != "Size:" {
+			return SDFile{}, fmt.Errorf("bad reply to SD select: %s", line)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return SDFile{}, fmt.Errorf("bad size in reply to SD select: %s", line)
+		}
+		return SDFile{Name: fields[0], Size: size}, nil
+	}
+	if err := sdFailure(lines); err != nil {
+		return SDFile{}, err
+	}
+	return SDFile{}, errors.New("the printer didn't open the file")
+}
+
+// ParseSDStatus reads the replies to M27 and M27 C, or an auto-report:
+//
+//	Current file: BENCHY~1.GCO 3DBenchy.gcode
+//	SD printing byte 2048/1234567
+//
+// or "Not SD printing".
+func ParseSDStatus(lines []string) (SDStatus, error) {
+	var status SDStatus
+	found := false
+	for _, line := range sdLines(lines) {
+		switch {
+		case strings.HasPrefix(line, "Current file:"):
+			status.File = parseSDCurrentFile(line)
+		case strings.HasPrefix(line, "SD printing byte"):
+			progress := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "SD printing byte")), "/", 2)
+			if len(progress) != 2 {
+				return SDStatus{}, fmt.Errorf("bad SD progress: %s", line)
+			}
+			done, err1 := strconv.ParseInt(progress[0], 10, 64)
+			size, err2 := strconv.ParseInt(progress[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				return SDStatus{}, fmt.Errorf("bad SD progress: %s", line)
+			}
+			status.Printing, status.Done, status.Size = true, done, size
+			status.File.Size = size
+			found = true
+		case line == "Not SD printing":
+			found = true
+		}
+	}
+	if !found {
+		if err := sdFailure(lines); err != nil {
+			return SDStatus{}, err
+		}
+		return SDStatus{}, errors.New("no SD progress in the printer's reply")
+	}
+	return status, nil
+}
+
+// parseSDCurrentFile reads "Current file: BENCHY~1.GCO 3DBenchy.gcode",
+// or "Current file: (no file)".
+func parseSDCurrentFile(line string) SDFile {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "Current file:")), " ", 2)
+	if fields[0] == "(no" {
+		return SDFile{}
+	}
+	file := SDFile{Name: fields[0]}
+	if len(fields) == 2 {
+		file.LongName = strings.TrimSpace(fields[1])
+	}
+	return file
+}
+
+// ListSD asks for the files on the SD card.
+func ListSD(ctx Context) ([]SDFile, error) {
+	if ctx.Printer == nil {
+		return nil, errNoPrinter
+	}
+	reply, err := queryCode(ctx, SDList(ctx.Printer.Firmware().Has(CapLongFilename)), ctx.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSDList(reply)
+}
+
+// PrintSD selects a file on the SD card and starts printing it.
+func PrintSD(ctx Context, name string) (SDFile, error) {
+	reply, err := queryCode(ctx, SDSelect(name), ctx.Timeout)
+	if err != nil {
+		return SDFile{}, err
+	}
+	file, err := ParseSDSelect(reply)
+	if err != nil {
+		return SDFile{}, err
+	}
+	return file, sendCodes(ctx, SDStart())
+}
+
+// ReadSDStatus asks which file is printing and how far it's got.
+func ReadSDStatus(ctx Context) (SDStatus, error) {
+	reply, err := queryCode(ctx, SDCurrentFile(), ctx.Timeout)
+	if err != nil {
+		return SDStatus{}, err
+	}
+	progress, err := queryCode(ctx, SDProgress(), ctx.Timeout)
+	if err != nil {
+		return SDStatus{}, err
+	}
+	return ParseSDStatus(append(reply, progress...))
+}
+
+// DeleteSD removes a file from the SD card.
+func DeleteSD(ctx Context, name string) error {
+	reply, err := queryCode(ctx, SDDelete(name), ctx.Timeout)
+	if err != nil {
+		return err
+	}
+	return sdFailure(reply)
+}
+
+// sdName makes an 8.3 name for a file uploaded without one, e.g.
+// "3DBenchy.gcode" becomes "3dbenchy.gco", as the firmware can't
+// create files with long names.
+func sdName(path string) string {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	clean := func(text string, length int) string {
+		text = strings.Map(func(r rune) rune {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, text)
+		if len(text) > length {
+			text = text[:length]
+		}
+		return text
+	}
+	name := clean(strings.TrimSuffix(base, ext), 8)
+	if name == "" {
+		name = "upload"
+	}
+	if ext = clean(ext, 3); ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// uploadLines reads G-code to upload, without the comments and blank
+// lines, which would only take up space on the card.
+func uploadLines(reader io.Reader) ([]string, error) {
+	lines := make([]string, 0, 1024)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexRune(line, ';'); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// maxResends is how many times in a row a line is sent again before
+// giving up.
+const maxResends = 10
+
+// UploadSD writes lines to a file on the SD card with M28 and M29. Each
+// line waits for its "ok", and is numbered and checksummed if the
+// dialect is, so that the firmware can ask for it again if it was
+// corrupted. Anything else sent meanwhile would end up in the file too.
+func UploadSD(ctx Context, name string, lines []string) error {
+	if ctx.Printer == nil {
+		return errNoPrinter
+	}
+	dialect := dialectOf(ctx)
+	numbered := dialect.Numbered()
+	if numbered {
+		if _, err := queryCode(ctx, LineNo(0), ctx.Timeout); err != nil {
+			return err
+		}
+	}
+	reply, err := queryCode(ctx, SDBeginWrite(name), ctx.Timeout)
+	if err != nil {
+		return err
+	}
+	if err := sdFailure(reply); err != nil {
+		return err
+	}
+	end := SDEndWrite()
+	end.Comment = ""
+	resends := 0
+	for idx := 0; idx <= len(lines); {
+		code := end
+		if idx < len(lines) {
+			code = Code{GCode: lines[idx]}
+		}
+		raw := code.EmitAs(dialect, 0)
+		if numbered {
+			raw = code.EmitAs(dialect, uint(idx+1))
+		}
+		reply, err := ctx.Printer.Query(raw, ctx.Timeout)
+		if err != nil {
+			if err != errAborted && idx < len(lines) {
+				// close the file, so the firmware runs what follows
+				ctx.Printer.Query(end.EmitAs(dialect, 0), ctx.Timeout)
+			}
+			return err
+		}
+		resend, ok := resendFrom(dialect, reply)
+		if !ok {
+			resends = 0
+			idx++
+			continue
+		}
+		if resends++; resends > maxResends || resend < 1 || int(resend) > idx+1 {
+			ctx.Printer.Query(end.EmitAs(dialect, 0), ctx.Timeout)
+			return fmt.Errorf("upload failed at line %d: %s", idx+1, strings.Join(reply, ", "))
+		}
+		idx = int(resend) - 1
+	}
+	return nil
+}
+
+// resendFrom finds the line number the firmware asked to resend from.
+func resendFrom(dialect Dialect, reply []string) (uint, bool) {
+	for _, line := range reply {
+		if r := dialect.Reply(line); r.Kind == ReplyResend {
+			lineNo, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(r.Text), "N"), 10, 32)
+			return uint(lineNo), err == nil
+		}
+	}
+	return 0, false
+}
+
+// UploadFileSD uploads a local file, as packets with the binary file
+// transfer or else line by line, reporting how long it took.
+func UploadFileSD(ctx Context, path, name string, packets bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	lines, err := uploadLines(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = sdName(path)
+	}
+	started := time.Now()
+	if !packets {
+		if err := UploadSD(ctx, name, lines); err != nil {
+			return err
+		}
+		ctx.User.WriteString(fmt.Sprintf("-- Uploaded %d lines to %s in %v", len(lines), name, time.Since(started).Round(time.Second)))
+		return nil
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	sent, err := UploadBinarySD(ctx, name, data)
+	if err != nil {
+		return err
+	}
+	ctx.User.WriteString(fmt.Sprintf("-- Uploaded %d bytes, %d sent, to %s in %v", len(data), sent, name, time.Since(started).Round(time.Second)))
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSDReplies(t *testing.T) {
+	files, err := ParseSDList([]string{"Begin file list", "BENCHY~1.GCO 1234567 3DBenchy.gcode", "CALIB/CUBE.GCO 20480", "End file list"})
+	assert.Nil(t, err)
+	assert.Equal(t, []SDFile{{"BENCHY~1.GCO", 1234567, "3DBenchy.gcode"}, {"CALIB/CUBE.GCO", 20480, ""}}, files)
+	_, err = ParseSDList([]string{"echo:No media"})
+	assert.EqualError(t, err, "No media")
+
+	file, err := ParseSDSelect([]string{"echo:File opened: CUBE.GCO Size: 20480", "File selected"})
+	assert.Nil(t, err)
+	assert.Equal(t, SDFile{Name: "CUBE.GCO", Size: 20480}, file)
+	_, err = ParseSDSelect([]string{"echo:open failed, File: nope.gco."})
+	assert.EqualError(t, err, "open failed, File: nope.gco")
+
+	status, err := ParseSDStatus([]string{"Current file: BENCHY~1.GCO 3DBenchy.gcode", "SD printing byte 2048/8192"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Printing 3DBenchy.gcode: 25.0% (2048/8192 bytes)", status.String())
+	status, err = ParseSDStatus([]string{"Current file: (no file)", "Not SD printing"})
+	assert.Nil(t, err)
+	assert.False(t, status.Printing)
+
+	assert.Equal(t, "3dbenchy.gco", sdName("/tmp/3D Benchy.gcode"))
+	lines, err := uploadLines(strings.NewReader("; header\nG28 ;home\n\n  G1 X10\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"G28", "G1 X10"}, lines)
+}
+
+// simulateSDWrite acts as Marlin writing to its SD card, corrupting the
+// second line the first time it's sent.
+func simulateSDWrite(written *[]string) func(line string) []string {
+	corrupted, saving := false, false
+	return func(line string) []string {
+		code, err := ParseCode(line)
+		if err != nil {
+			return []string{"Error:" + err.Error(), "ok"}
+		}
+		if idx := strings.IndexRune(line, '*'); idx >= 0 {
+			if fmt.Sprint(GCodeChecksum(line[:idx])) != line[idx+1:] {
+				return []string{"Error:checksum mismatch, Last Line: " + fmt.Sprint(code.LineNo-1), fmt.Sprintf("Resend: %d", code.LineNo), "ok"}
+			}
+			if code.LineNo == 2 && !corrupted {
+				corrupted = true
+				return []string{"Error:checksum mismatch, Last Line: 1", "Resend: 2", "ok"}
+			}
+		}
+		switch {
+		case code.GCode == "M28":
+			saving = true
+			return []string{"Writing to file: " + strings.Fields(line)[1], "ok"}
+		case code.GCode == "M29":
+			saving = false
+			return []string{"Done saving file.", "ok"}
+		case saving:
+			*written = append(*written, strings.Join(strings.Fields(strings.Split(line, "*")[0])[1:], " "))
+		}
+		return []string{"ok"}
+	}
+}
+
+func TestUploadSD(t *testing.T) {
+	written := []string{}
+	ctx, _, received := newSimulatedContext(t, simulateSDWrite(&written))
+
+	assert.Nil(t, UploadSD(ctx, "cube.gco", []string{"G28", "G1 X10", "G1 Y10"}))
+	assert.Equal(t, []string{"G28", "G1 X10", "G1 Y10"}, written)
+	assert.Equal(t, []string{"M110 N0", "M28 cube.gco", "N1 G28*18", "N2 G1 X10*83", "N2 G1 X10*83", "N3 G1 Y10*83", "N4 M29*28"}, received())
+}
+
+func TestSDAutoReport(t *testing.T) {
+	ctx, _, _ := newSimulatedContext(t, func(line string) []string {
+		switch line {
+		case "M27 C":
+			return []string{"echo:Current file: CUBE.GCO cube.gcode", "ok"}
+		case "M27 S2":
+			return []string{"ok", "SD printing byte 100/400", "SD printing byte 200/400"}
+		}
+		return []string{"ok"}
+	})
+
+	assert.False(t, ctx.Printer.SDStatus().Printing)
+	_, err := queryCode(ctx, SDCurrentFile(), ctx.Timeout)
+	assert.Nil(t, err)
+	assert.Nil(t, sendCodes(ctx, SDAutoReport(2)))
+	waitFor(t, func() bool { return ctx.Printer.SDStatus().Done == 200 })
+	assert.Equal(t, "Printing cube.gcode: 50.0% (200/400 bytes)", ctx.Printer.SDStatus().String())
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PortPatterns are where USB serial adapters and boards appear.
+var PortPatterns = []string{"/dev/ttyUSB*", "/dev/ttyACM*"}
+
+// Bauds are tried in turn when probing, most common first.
+var Bauds = []int{115200, 250000, 230400, 57600, 38400, 19200, 9600}
+
+// ScanPorts lists the devices matching the patterns.
+func ScanPorts(patterns ...string) []string {
+	ports := make([]string, 0, 4)
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		ports = append(ports, matches...)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// OpenPort opens a serial device in raw mode at the given speed, or
+// leaving the speed alone if it's 0.
+func OpenPort(device string, baud int) (*os.File, error) {
+	file, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRaw(file, baud); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", device, err)
+	}
+	return file, nil
+}
+
+// understood reports whether a line is one the firmware would send,
+// rather than the noise of talking at the wrong speed.
+func understood(dialect Dialect, line string) bool {
+	switch dialect.Reply(line).Kind {
+	case ReplyOk, ReplyStart, ReplyBusy, ReplyRejected:
+		return true
+	}
+	return strings.Contains(line, "FIRMWARE_NAME:")
+}
+
+// probe asks for M110 and M115, once a second until the timeout, and
+// waits for a reply the dialect understands. Boards that reset when the
+// port is opened will announce themselves too, once they've booted.
+func probe(file *os.File, dialect Dialect, timeout time.Duration) error {
+	query := ""
+	for _, code := range []Code{LineNo(0), NewCode("M115", "")} {
+		for _, translated := range dialect.Translate(code) {
+			translated.Comment = ""
+			query += translated.EmitAs(dialect, 0) + "\n"
+		}
+	}
+	if query == "" {
+		// an empty line still gets an "ok"
+		query = "\n"
+	}
+	defer file.SetReadDeadline(time.Time{})
+	buffer, pending := make([]byte, 256), ""
+	deadline := time.Now().Add(timeout)
+	for next := time.Now(); ; {
+		if !time.Now().Before(next) {
+			if _, err := file.WriteString(query); err != nil {
+				return err
+			}
+			next = next.Add(time.Second)
+		}
+		wake := next
+		if deadline.Before(wake) {
+			wake = deadline
+		}
+		if err := file.SetReadDeadline(wake); err != nil {
+			return err
+		}
+		count, err := file.Read(buffer)
+		pending += string(buffer[:count])
+		for {
+			idx := strings.IndexByte(pending, '\n')
+			if idx < 0 {
+				break
+			}
+			line := strings.TrimSpace(pending[:idx])
+			pending = pending[idx+1:]
+			if understood(dialect, line) {
+				// the rest of the replies would be taken for answers to
+				// what's sent next
+				return drain(file, 250*time.Millisecond, deadline)
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("no reply within %v", timeout)
+		}
+	}
+}
+
+// drain discards input until there's been none for the quiet period, or
+// the deadline.
+func drain(file *os.File, quiet time.Duration, deadline time.Time) error {
+	buffer := make([]byte, 256)
+	for time.Now().Before(deadline) {
+		if err := file.SetReadDeadline(time.Now().Add(quiet)); err != nil {
+			return err
+		}
+		if _, err := file.Read(buffer); errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connection finds the printer, opening its port at the speed it
+// answers to. Port may be "auto" to scan PortPatterns, and Baud 0 to
+// try each of Bauds.
+type Connection struct {
+	Port    string
+	Baud    int
+	Dialect Dialect
+	Timeout time.Duration // for each port and speed tried
+
+	auto bool
+}
+
+func NewConnection(port string, baud int, dialect Dialect) *Connection {
+	return &Connection{Port: port, Baud: baud, Dialect: dialect, Timeout: 3 * time.Second, auto: port == "auto"}
+}
+
+// Open opens the port, probing for it and its speed as needed; those
+// found are kept, so reopening after a disconnect goes straight back to
+// them unless the device has gone.
+func (c *Connection) Open() (io.ReadWriteCloser, error) {
+	if c.Port != "auto" && c.Baud != 0 {
+		port, err := OpenPort(c.Port, c.Baud)
+		if err == nil {
+			return port, nil
+		}
+		if !c.auto {
+			return nil, err
+		}
+		// it may have come back as another device
+		c.Port = "auto"
+	}
+	devices := []string{c.Port}
+	if c.Port == "auto" {
+		if devices = ScanPorts(PortPatterns...); len(devices) == 0 {
+			return nil, fmt.Errorf("no serial ports found (%s)", strings.Join(PortPatterns, ", "))
+		}
+	}
+	bauds := Bauds
+	if c.Baud != 0 {
+		bauds = []int{c.Baud}
+	}
+	tried := make([]string, 0, len(devices))
+	for _, device := range devices {
+		for _, baud := range bauds {
+			port, err := OpenPort(device, baud)
+			if err != nil {
+				tried = append(tried, err.Error())
+				break
+			}
+			if err = probe(port, c.Dialect, c.Timeout); err == nil {
+				c.Port, c.Baud = device, baud
+				return port, nil
+			}
+			port.Close()
+			tried = append(tried, fmt.Sprintf("%s at %d: %s", device, baud, err))
+		}
+	}
+	return nil, fmt.Errorf("no printer found: %s", strings.Join(tried, "; "))
+}
+
+// Remember saves where the printer was found in the profile, if it
+// has changed and the profile has a file.
+func (c *Connection) Remember(profile *Profile) error {
+	if profile.Port == c.Port && profile.Baud == c.Baud {
+		return nil
+	}
+	profile.Port, profile.Baud = c.Port, c.Baud
+	if profile.path == "" {
+		return nil
+	}
+	return profile.Save()
+}
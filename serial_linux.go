@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setRaw turns off the terminal's line editing and translation, and sets
+// any speed, not just the standard ones, as Marlin often runs at 250000.
+// It goes through SyscallConn as Fd would stop read deadlines working.
+func setRaw(file *os.File, baud int) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS2)
+		if err != nil {
+			ioctlErr = err
+			return
+		}
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS
+		termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL
+		termios.Cc[unix.VMIN], termios.Cc[unix.VTIME] = 1, 0
+		if baud != 0 {
+			termios.Cflag &^= unix.CBAUD
+			termios.Cflag |= unix.BOTHER
+			termios.Ispeed, termios.Ospeed = uint32(baud), uint32(baud)
+		}
+		ioctlErr = unix.IoctlSetTermios(int(fd), unix.TCSETS2, termios)
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
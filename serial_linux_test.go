@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master side of a new pseudo-terminal and the path
+// of its slave. The slave is held open too, so the master doesn't see a
+// hang up while the port is closed between probes.
+func openPty(t *testing.T) (*os.File, string, *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo-terminals: " + err.Error())
+	}
+	var number int
+	conn, _ := master.SyscallConn()
+	conn.Control(func(fd uintptr) {
+		if err = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); err == nil {
+			number, err = unix.IoctlGetInt(int(fd), unix.TIOCGPTN)
+		}
+	})
+	assert.Nil(t, err)
+	path := fmt.Sprintf("/dev/pts/%d", number)
+	slave, err := OpenPort(path, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+	return master, path, slave
+}
+
+// ptySpeed is the baud rate the port was last set to.
+func ptySpeed(slave *os.File) int {
+	var speed uint32
+	conn, _ := slave.SyscallConn()
+	conn.Control(func(fd uintptr) {
+		if termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS2); err == nil {
+			speed = termios.Ospeed
+		}
+	})
+	return int(speed)
+}
+
+func TestScanPorts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ttyUSB1", "ttyACM0", "ttyS0"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	assert.Equal(t, []string{filepath.Join(dir, "ttyACM0"), filepath.Join(dir, "ttyUSB1")},
+		ScanPorts(filepath.Join(dir, "ttyUSB*"), filepath.Join(dir, "ttyACM*")))
+}
+
+func TestConnectionProbes(t *testing.T) {
+	master, path, slave := openPty(t)
+	received := simulate(master, func(line string) []string {
+		if ptySpeed(slave) != 250000 {
+			return []string{"\x8f\xfe\x13"}
+		}
+		if line == "M115" {
+			return []string{"FIRMWARE_NAME:Marlin 2.1.2", "ok"}
+		}
+		return []string{"ok"}
+	})
+
+	saved := PortPatterns
+	defer func() { PortPatterns = saved }()
+	PortPatterns = []string{"/dev/nothing*", path}
+	connection := NewConnection("auto", 0, Marlin)
+	connection.Timeout = 300 * time.Millisecond
+	port, err := connection.Open()
+	assert.Nil(t, err)
+	defer port.Close()
+	assert.Equal(t, path, connection.Port)
+	assert.Equal(t, 250000, connection.Baud)
+	assert.Equal(t, []string{"M110 N0", "M115"}, received()[len(received())-2:])
+
+	profile := NewProfile()
+	assert.Nil(t, connection.Remember(profile))
+	assert.Equal(t, path, profile.Port)
+	assert.Equal(t, 250000, profile.Baud)
+
+	// nothing answers at the wrong speed
+	bauds := Bauds
+	defer func() { Bauds = bauds }()
+	Bauds = []int{9600}
+	connection = NewConnection(path, 0, Marlin)
+	connection.Timeout = 100 * time.Millisecond
+	_, err = connection.Open()
+	assert.EqualError(t, err, fmt.Sprintf("no printer found: %s at 9600: no reply within 100ms", path))
+}
+
+func TestPrinterReconnects(t *testing.T) {
+	master, path, _ := openPty(t)
+	simulate(master, func(line string) []string { return []string{"ok"} })
+	replacement, replacementPath, _ := openPty(t)
+	received := simulate(replacement, func(line string) []string { return []string{"ok"} })
+
+	port, err := OpenPort(path, 0)
+	assert.Nil(t, err)
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(port, ui, remote, time.Second)
+	p.PollInterval = 10 * time.Millisecond
+	p.Reopen = func() (io.ReadWriteCloser, error) { return OpenPort(replacementPath, 0) }
+	p.Start()
+	defer p.Close()
+	remote <- "M105"
+	assert.Nil(t, p.WaitForIdle(time.Second))
+
+	// unplugged, then back as another device, which has restarted
+	master.Close()
+	waitFor(t, func() bool { return contains(ui.Lines(), "-- Printer reconnected") })
+	replacement.Write([]byte("start\n"))
+	waitFor(t, func() bool { return len(received()) == 1 })
+	assert.Equal(t, []string{"M110 N0"}, received())
+	assert.True(t, contains(ui.Lines(), "-- Printer restarted"))
+	assert.Equal(t, []string{"Printer connection lost"}, ui.Errors())
+
+	remote <- "M105"
+	waitFor(t, func() bool { return len(received()) == 2 })
+	assert.Nil(t, p.WaitForIdle(time.Second))
+}
+
+func contains(lines []string, wanted string) bool {
+	for _, line := range lines {
+		if strings.Contains(line, wanted) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// setRaw leaves the port as it is: only Linux is supported for now.
+func setRaw(file *os.File, baud int) error {
+	if baud != 0 {
+		return errors.New("setting the baud rate is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathLexer reads the numbers and commands of SVG path data, where
+// separators are optional: "M10-5.5.5" is M 10 -5.5 .5.
+type pathLexer struct {
+	data string
+	pos  int
+}
+
+func (l *pathLexer) skip() {
+	for l.pos < len(l.data) && strings.IndexByte(" \t\r\n,", l.data[l.pos]) >= 0 {
+		l.pos++
+	}
+}
+
+func (l *pathLexer) done() bool {
+	l.skip()
+	return l.pos >= len(l.data)
+}
+
+// more reports whether a number comes next, continuing the last command.
+func (l *pathLexer) more() bool {
+	return !l.done() && strings.IndexByte("+-.0123456789", l.data[l.pos]) >= 0
+}
+
+func (l *pathLexer) command() (byte, error) {
+	if l.done() {
+		return 0, io.EOF
+	}
+	command := l.data[l.pos]
+	if !strings.ContainsRune("MmLlHhVvCcSsQqTtAaZz", rune(command)) {
+		return 0, fmt.Errorf("unexpected %q at %d in path data", command, l.pos)
+	}
+	l.pos++
+	return command, nil
+}
+
+func (l *pathLexer) number() (float64, error) {
+	if !l.more() {
+		return 0, fmt.Errorf("expected a number at %d in path data", l.pos)
+	}
+	start, dot := l.pos, false
+	if l.data[l.pos] == '+' || l.data[l.pos] == '-' {
+		l.pos++
+	}
+	for ; l.pos < len(l.data); l.pos++ {
+		char := l.data[l.pos]
+		if char == '.' && !dot {
+			dot = true
+		} else if char == 'e' || char == 'E' {
+			l.pos++
+			if l.pos < len(l.data) && (l.data[l.pos] == '+' || l.data[l.pos] == '-') {
+				l.pos++
+			}
+			dot = true
+		} else if char < '0' || char > '9' {
+			break
+		}
+	}
+	return strconv.ParseFloat(l.data[start:l.pos], 64)
+}
+
+func (l *pathLexer) numbers(count int) ([]float64, error) {
+	values := make([]float64, count)
+	for idx := range values {
+		value, err := l.number()
+		if err != nil {
+			return nil, err
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+// flag reads an arc flag, which may be run together with what follows.
+func (l *pathLexer) flag() (bool, error) {
+	if l.done() || (l.data[l.pos] != '0' && l.data[l.pos] != '1') {
+		return false, fmt.Errorf("expected an arc flag at %d in path data", l.pos)
+	}
+	l.pos++
+	return l.data[l.pos-1] == '1', nil
+}
+
+// vectorAngle is the signed angle from u to v.
+func vectorAngle(u, v Point) float64 {
+	return math.Atan2(u.X*v.Y-u.Y*v.X, u.X*v.X+u.Y*v.Y)
+}
+
+// svgArc adds an SVG elliptical arc, given by its end points, to path;
+// circular arcs are kept as arcs.
+func svgArc(path *VectorPath, from Point, rx, ry, degrees float64, large, sweep bool, to Point) {
+	if from == to {
+		return
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		path.lineTo(to)
+		return
+	}
+	// centre parameterisation, as in the SVG specification's appendix
+	phi := degrees * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (from.X-to.X)/2, (from.Y-to.Y)/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		rx, ry = rx*math.Sqrt(lambda), ry*math.Sqrt(lambda)
+	}
+	numerator := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, numerator/(rx*rx*y1*y1+ry*ry*x1*x1)))
+	if large == sweep {
+		coef = -coef
+	}
+	cx, cy := coef*rx*y1/ry, -coef*ry*x1/rx
+	centre := Point{cos*cx - sin*cy + (from.X+to.X)/2, sin*cx + cos*cy + (from.Y+to.Y)/2}
+	start := vectorAngle(Point{1, 0}, Point{(x1 - cx) / rx, (y1 - cy) / ry})
+	delta := vectorAngle(Point{(x1 - cx) / rx, (y1 - cy) / ry}, Point{(-x1 - cx) / rx, (-y1 - cy) / ry})
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	if math.Abs(rx-ry) <= 1e-9*math.Max(rx, ry) {
+		path.arcTo(centre, delta, to)
+		return
+	}
+	path.ellipseTo(centre, rx, ry, phi, start, delta)
+	path.Segments[len(path.Segments)-1].to = to
+}
+
+// ParsePathData reads the d attribute of an SVG path into subpaths.
+func ParsePathData(data string) ([]VectorPath, error) {
+	lexer := &pathLexer{data: data}
+	paths := make([]VectorPath, 0, 1)
+	var path *VectorPath
+	var current, control Point
+	var last byte
+	for {
+		command, err := lexer.command()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		relative := command >= 'a'
+		upper := command &^ 0x20
+		at := func(x, y float64) Point {
+			if relative {
+				return Point{current.X + x, current.Y + y}
+			}
+			return Point{x, y}
+		}
+		for first := true; first || (upper != 'Z' && lexer.more()); first = false {
+			if path == nil && upper != 'M' {
+				return nil, fmt.Errorf("path data must start with a move, not %c", command)
+			}
+			next := current
+			switch upper {
+			case 'M':
+				values, err := lexer.numbers(2)
+				if err != nil {
+					return nil, err
+				}
+				next = at(values[0], values[1])
+				if first {
+					paths = append(paths, VectorPath{Start: next})
+					path = &paths[len(paths)-1]
+				} else {
+					// further pairs are lines
+					path.lineTo(next)
+				}
+			case 'L', 'H', 'V':
+				count := 2
+				if upper != 'L' {
+					count = 1
+				}
+				values, err := lexer.numbers(count)
+				if err != nil {
+					return nil, err
+				}
+				switch upper {
+				case 'L':
+					next = at(values[0], values[1])
+				case 'H':
+					next.X = values[0]
+					if relative {
+						next.X += current.X
+					}
+				case 'V':
+					next.Y = values[0]
+					if relative {
+						next.Y += current.Y
+					}
+				}
+				path.lineTo(next)
+			case 'C', 'S':
+				count := 6
+				if upper == 'S' {
+					count = 4
+				}
+				values, err := lexer.numbers(count)
+				if err != nil {
+					return nil, err
+				}
+				// S reflects the last control of a previous C or S
+				c1 := current
+				if last == 'C' || last == 'S' {
+					c1 = current.add(current.sub(control))
+				}
+				if upper == 'C' {
+					c1, values = at(values[0], values[1]), values[2:]
+				}
+				control, next = at(values[0], values[1]), at(values[2], values[3])
+				path.cubicTo(c1, control, next)
+			case 'Q', 'T':
+				count := 4
+				if upper == 'T' {
+					count = 2
+				}
+				values, err := lexer.numbers(count)
+				if err != nil {
+					return nil, err
+				}
+				q := current
+				if last == 'Q' || last == 'T' {
+					q = current.add(current.sub(control))
+				}
+				if upper == 'Q' {
+					q, values = at(values[0], values[1]), values[2:]
+				}
+				control, next = q, at(values[0], values[1])
+				// a quadratic is a cubic with controls two thirds of the way to q
+				path.cubicTo(current.lerp(q, 2.0/3), next.lerp(q, 2.0/3), next)
+			case 'A':
+				radii, err := lexer.numbers(3)
+				if err != nil {
+					return nil, err
+				}
+				large, err := lexer.flag()
+				if err != nil {
+					return nil, err
+				}
+				sweep, err := lexer.flag()
+				if err != nil {
+					return nil, err
+				}
+				values, err := lexer.numbers(2)
+				if err != nil {
+					return nil, err
+				}
+				next = at(values[0], values[1])
+				svgArc(path, current, radii[0], radii[1], radii[2], large, sweep, next)
+			case 'Z':
+				if current != path.Start {
+					path.lineTo(path.Start)
+				}
+				path.Closed = true
+				next = path.Start
+				// drawing on from here starts a new subpath
+				paths = append(paths, VectorPath{Start: next})
+				path = &paths[len(paths)-1]
+			}
+			current, last = next, upper
+		}
+	}
+	drawn := paths[:0]
+	for _, path := range paths {
+		if len(path.Segments) > 0 {
+			drawn = append(drawn, path)
+		}
+	}
+	return drawn, nil
+}
+
+var transformRe = regexp.MustCompile(`(\w+)\s*\(([^)]*)\)`)
+
+// parseTransform reads an SVG transform attribute, such as
+// "translate(10 20) rotate(45)", whose last transform applies first.
+func parseTransform(text string) (affine, error) {
+	m := identity
+	for _, match := range transformRe.FindAllStringSubmatch(text, -1) {
+		args := make([]float64, 0, 6)
+		for _, field := range strings.FieldsFunc(match[2], func(r rune) bool { return r == ',' || r == ' ' }) {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return m, fmt.Errorf("bad transform %s: %s", match[0], err)
+			}
+			args = append(args, value)
+		}
+		arg := func(idx int, fallback float64) float64 {
+			if idx < len(args) {
+				return args[idx]
+			}
+			return fallback
+		}
+		var t affine
+		switch match[1] {
+		case "matrix":
+			if len(args) != 6 {
+				return m, fmt.Errorf("bad transform %s", match[0])
+			}
+			copy(t[:], args)
+		case "translate":
+			t = affine{1, 0, 0, 1, arg(0, 0), arg(1, 0)}
+		case "scale":
+			t = affine{arg(0, 1), 0, 0, arg(1, arg(0, 1)), 0, 0}
+		case "rotate":
+			angle := arg(0, 0) * math.Pi / 180
+			cx, cy := arg(1, 0), arg(2, 0)
+			t = affine{1, 0, 0, 1, -cx, -cy}.
+				then(affine{math.Cos(angle), math.Sin(angle), -math.Sin(angle), math.Cos(angle), 0, 0}).
+				then(affine{1, 0, 0, 1, cx, cy})
+		case "skewX":
+			t = affine{1, 0, math.Tan(arg(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			t = affine{1, math.Tan(arg(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return m, fmt.Errorf("unknown transform %s", match[1])
+		}
+		m = t.then(m)
+	}
+	return m, nil
+}
+
+// svgLength reads a coordinate, ignoring any units.
+func svgLength(attrs map[string]string, name string) float64 {
+	value, _ := strconv.ParseFloat(strings.TrimRight(attrs[name], "abcdefghijklmnopqrstuvwxyz%"), 64)
+	return value
+}
+
+// svgPoints reads the points of a polyline or polygon.
+func svgPoints(text string) ([]Point, error) {
+	lexer := &pathLexer{data: text}
+	points := make([]Point, 0, 8)
+	for lexer.more() {
+		values, err := lexer.numbers(2)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, Point{values[0], values[1]})
+	}
+	return points, nil
+}
+
+// svgShape converts an element to paths.
+func svgShape(name string, attrs map[string]string) ([]VectorPath, error) {
+	length := func(name string) float64 { return svgLength(attrs, name) }
+	switch name {
+	case "path":
+		return ParsePathData(attrs["d"])
+	case "line":
+		path := VectorPath{Start: Point{length("x1"), length("y1")}}
+		path.lineTo(Point{length("x2"), length("y2")})
+		return []VectorPath{path}, nil
+	case "polyline", "polygon":
+		points, err := svgPoints(attrs["points"])
+		if err != nil || len(points) < 2 {
+			return nil, err
+		}
+		path := VectorPath{Start: points[0], Closed: name == "polygon"}
+		for _, point := range points[1:] {
+			path.lineTo(point)
+		}
+		if path.Closed && path.End() != path.Start {
+			path.lineTo(path.Start)
+		}
+		return []VectorPath{path}, nil
+	case "rect":
+		x, y, width, height := length("x"), length("y"), length("width"), length("height")
+		path := VectorPath{Start: Point{x, y}, Closed: true}
+		for _, corner := range []Point{{x + width, y}, {x + width, y + height}, {x, y + height}, {x, y}} {
+			path.lineTo(corner)
+		}
+		return []VectorPath{path}, nil
+	case "circle", "ellipse":
+		centre := Point{length("cx"), length("cy")}
+		rx, ry := length("r"), length("r")
+		if name == "ellipse" {
+			rx, ry = length("rx"), length("ry")
+		}
+		start := Point{centre.X + rx, centre.Y}
+		path := VectorPath{Start: start, Closed: true}
+		if rx == ry {
+			path.arcTo(centre, 2*math.Pi, start)
+		} else {
+			path.ellipseTo(centre, rx, ry, 0, 0, 2*math.Pi)
+		}
+		return []VectorPath{path}, nil
+	}
+	return nil, nil
+}
+
+// ParseSVG reads the shapes of an SVG document, applying their
+// transforms; definitions that aren't drawn directly are skipped.
+func ParseSVG(reader io.Reader) (*Drawing, error) {
+	decoder := xml.NewDecoder(reader)
+	drawing := &Drawing{YDown: true}
+	transforms := []affine{identity}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "defs", "clipPath", "mask", "marker", "pattern", "symbol", "metadata":
+				if err := decoder.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			attrs := make(map[string]string, len(element.Attr))
+			for _, attr := range element.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+			own, err := parseTransform(attrs["transform"])
+			if err != nil {
+				return nil, err
+			}
+			m := own.then(transforms[len(transforms)-1])
+			transforms = append(transforms, m)
+			paths, err := svgShape(element.Name.Local, attrs)
+			if err != nil {
+				return nil, fmt.Errorf("<%s>: %s", element.Name.Local, err)
+			}
+			for _, path := range paths {
+				drawing.Paths = append(drawing.Paths, path.transform(m))
+			}
+		case xml.EndElement:
+			transforms = transforms[:len(transforms)-1]
+		}
+	}
+	if len(drawing.Paths) == 0 {
+		return nil, fmt.Errorf("no shapes in the SVG")
+	}
+	return drawing, nil
+}
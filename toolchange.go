@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ToolConfig describes one extruder of a multi-tool machine.
+type ToolConfig struct {
+	Active  uint       `json:"active"`            // printing temperature
+	Standby uint       `json:"standby"`           // temperature while parked
+	Retract float64    `json:"retract,omitempty"` // mm pulled back before leaving the tool
+	Prime   float64    `json:"prime,omitempty"`   // mm pushed out after selecting it
+	Purge   float64    `json:"purge,omitempty"`   // mm extruded at the purge position
+	Offset  [3]float64 `json:"offset,omitempty"`  // X, Y, Z hotend offset from T0
+}
+
+// ToolChangeConfig holds the settings shared by all tool changes.
+type ToolChangeConfig struct {
+	ZHop        float64 `json:"z_hop,omitempty"`
+	PurgeX      float64 `json:"purge_x,omitempty"`
+	PurgeY      float64 `json:"purge_y,omitempty"`
+	UsePurge    bool    `json:"use_purge,omitempty"`
+	RetractFeed float64 `json:"retract_feed,omitempty"` // mm/min
+	TravelFeed  float64 `json:"travel_feed,omitempty"`  // mm/min
+	Lookahead   int     `json:"lookahead,omitempty"`    // codes before a change to start preheating
+}
+
+// ToolChangePlanner expands bare "Tn" codes into complete tool change
+// sequences: retract, park the old tool at standby, hop, select and heat
+// the new tool, purge, prime and return. When planning a whole queue it
+// also starts heating the next tool Lookahead codes before it's needed.
+type ToolChangePlanner struct {
+	Tools []ToolConfig
+	ToolChangeConfig
+
+	current   ToolId
+	relative  bool
+	relativeE bool
+	x, y      float64
+	known     bool
+}
+
+var toolCodeRe = regexp.MustCompile(`^T(\d+)$`)
+
+func NewToolChangePlanner(tools []ToolConfig, config ToolChangeConfig) *ToolChangePlanner {
+	return &ToolChangePlanner{Tools: tools, ToolChangeConfig: config}
+}
+
+// Current is the tool the planner believes is selected.
+func (p *ToolChangePlanner) Current() ToolId {
+	return p.current
+}
+
+func (p *ToolChangePlanner) tool(id ToolId) (ToolConfig, error) {
+	if int(id) >= len(p.Tools) {
+		return ToolConfig{}, fmt.Errorf("tool %d is not configured", id)
+	}
+	return p.Tools[id], nil
+}
+
+// Setup tells the firmware about each tool's offset (M218).
+func (p *ToolChangePlanner) Setup() []Code {
+	codes := make([]Code, 0, len(p.Tools))
+	for idx, tool := range p.Tools {
+		if idx == 0 {
+			// offsets are relative to the first tool
+			continue
+		}
+		codes = append(codes, NewCode("M218", "set hotend offset", IntParam('T', idx),
+			FloatParam('X', tool.Offset[0]), FloatParam('Y', tool.Offset[1]), FloatParam('Z', tool.Offset[2])))
+	}
+	return codes
+}
+
+func (p *ToolChangePlanner) feed(rate float64) []Param {
+	if rate > 0 {
+		return []Param{FloatParam('F', rate)}
+	}
+	return nil
+}
+
+// extrude works in relative extrusion, restoring the program's mode.
+func (p *ToolChangePlanner) extrude(amount float64, comment string) []Code {
+	if amount == 0 {
+		return nil
+	}
+	move := Move(append([]Param{FloatParam('E', amount)}, p.feed(p.RetractFeed)...)...)
+	move.Comment = comment
+	if p.relativeE {
+		return []Code{move}
+	}
+	return []Code{RelativeExtrusion(), move, AbsoluteExtrusion()}
+}
+
+func (p *ToolChangePlanner) hop(height float64) []Code {
+	if p.ZHop == 0 {
+		return nil
+	}
+	move := Travel(append([]Param{FloatParam('Z', height)}, p.feed(p.TravelFeed)...)...)
+	if p.relative {
+		return []Code{move}
+	}
+	return []Code{RelativePositioning(), move, AbsolutePositioning()}
+}
+
+// Change generates the sequence to switch from the current tool.
+func (p *ToolChangePlanner) Change(to ToolId) ([]Code, error) {
+	if to == p.current {
+		return nil, nil
+	}
+	from, err := p.tool(p.current)
+	if err != nil {
+		return nil, err
+	}
+	next, err := p.tool(to)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]Code, 0, 16)
+	codes = append(codes, p.extrude(-from.Retract, "retract")...)
+	codes = append(codes, ToolTemp(p.current, from.Standby))
+	codes = append(codes, p.hop(p.ZHop)...)
+	codes = append(codes, ToolIdx(to), ToolTempWait(to, next.Active))
+	if p.UsePurge && !p.relative {
+		codes = append(codes, Travel(append([]Param{FloatParam('X', p.PurgeX), FloatParam('Y', p.PurgeY)}, p.feed(p.TravelFeed)...)...))
+		codes = append(codes, p.extrude(next.Purge, "purge")...)
+	}
+	codes = append(codes, p.extrude(next.Prime, "prime")...)
+	if p.UsePurge && !p.relative && p.known {
+		codes = append(codes, Travel(append([]Param{FloatParam('X', p.x), FloatParam('Y', p.y)}, p.feed(p.TravelFeed)...)...))
+	}
+	codes = append(codes, p.hop(-p.ZHop)...)
+	p.current = to
+	return codes, nil
+}
+
+// track follows the modes and position of a program so the change
+// sequences fit in with it.
+func (p *ToolChangePlanner) track(code Code) {
+	switch code.GCode {
+	case "G90":
+		p.relative = false
+	case "G91":
+		p.relative = true
+	case "M82":
+		p.relativeE = false
+	case "M83":
+		p.relativeE = true
+	case "G28":
+		p.x, p.y, p.known = 0, 0, !p.relative
+	case "G0", "G1", "G92":
+		if p.relative && code.GCode != "G92" {
+			p.known = false
+			return
+		}
+		x, hasX := code.Float('X')
+		y, hasY := code.Float('Y')
+		if hasX {
+			p.x = x
+		}
+		if hasY {
+			p.y = y
+		}
+		p.known = p.known || (hasX && hasY)
+	}
+}
+
+// toolOf returns the tool a bare "Tn" code selects.
+func toolOf(code Code) (ToolId, bool) {
+	match := toolCodeRe.FindStringSubmatch(code.GCode)
+	if match == nil || len(code.Parameters) > 0 {
+		return 0, false
+	}
+	tool, err := strconv.Atoi(match[1])
+	return ToolId(tool), err == nil
+}
+
+// Plan rewrites a program, expanding each tool change and preheating
+// the incoming tool ahead of time.
+func (p *ToolChangePlanner) Plan(codes []Code) ([]Code, error) {
+	// Work out where to start heating each tool: Lookahead codes before
+	// it's needed, but not before it was last parked at standby.
+	preheats := make(map[int][]Code)
+	if p.Lookahead > 0 {
+		current, lastChange := p.current, -1
+		for idx, code := range codes {
+			to, ok := toolOf(code)
+			if !ok || to == current {
+				continue
+			}
+			tool, err := p.tool(to)
+			if err != nil {
+				return nil, err
+			}
+			at := idx - p.Lookahead
+			if at <= lastChange {
+				at = lastChange + 1
+			}
+			if at < idx {
+				preheats[at] = append(preheats[at], ToolTemp(to, tool.Active))
+			}
+			current, lastChange = to, idx
+		}
+	}
+
+	// a program that can't be planned leaves the planner as it found it
+	saved := *p
+	planned := make([]Code, 0, len(codes)+len(codes)/4)
+	for idx, code := range codes {
+		planned = append(planned, preheats[idx]...)
+		if to, ok := toolOf(code); ok {
+			change, err := p.Change(to)
+			if err != nil {
+				*p = saved
+				return nil, fmt.Errorf("code %d: %s", idx+1, err)
+			}
+			planned = append(planned, change...)
+			continue
+		}
+		p.track(code)
+		planned = append(planned, code)
+	}
+	return planned, nil
+}
+
+// Apply plans everything queued on a Run.
+func (p *ToolChangePlanner) Apply(run *Run) error {
+	planned, err := p.Plan(*run.cmdQueue)
+	if err != nil {
+		return err
+	}
+	*run.cmdQueue = append((*run.cmdQueue)[:0], planned...)
+	return nil
+}
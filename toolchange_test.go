@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPlanner() *ToolChangePlanner {
+	return NewToolChangePlanner([]ToolConfig{
+		{Active: 210, Standby: 170, Retract: 2, Prime: 1},
+		{Active: 230, Standby: 180, Retract: 3, Prime: 1.5, Purge: 10, Offset: [3]float64{20, 0.5, -0.1}},
+	}, ToolChangeConfig{ZHop: 0.4, PurgeX: 5, PurgeY: 200, UsePurge: true, RetractFeed: 2400, Lookahead: 2})
+}
+
+func TestToolChangeSetup(t *testing.T) {
+	assert.Equal(t, "M218 T1 X20 Y0.5 Z-0.1 ;set hotend offset", emitAll(newTestPlanner().Setup()))
+	assert.Equal(t, 0, len(NewToolChangePlanner(nil, ToolChangeConfig{}).Setup()))
+}
+
+func TestToolChange(t *testing.T) {
+	p := newTestPlanner()
+	codes, err := p.Change(T0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(codes))
+
+	_, err = p.Change(T2)
+	assert.EqualError(t, err, "tool 2 is not configured")
+
+	p.track(NewCode("G1", "", NewParamArray('x', 50.0, 'y', 60.0)...))
+	codes, err = p.Change(T1)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"M83 ;relative extrusion",
+		"G1 E-2 F2400 ;retract",
+		"M82 ;absolute extrusion",
+		"M104 T0 S170 ;set tool temp",
+		"G91 ;relative positioning",
+		"G0 Z0.4 ;travel",
+		"G90 ;absolute positioning",
+		"T1 ;select tool",
+		"M109 T1 S230 ;wait for tool temp",
+		"G0 X5 Y200 ;travel",
+		"M83 ;relative extrusion",
+		"G1 E10 F2400 ;purge",
+		"M82 ;absolute extrusion",
+		"M83 ;relative extrusion",
+		"G1 E1.5 F2400 ;prime",
+		"M82 ;absolute extrusion",
+		"G0 X50 Y60 ;travel",
+		"G91 ;relative positioning",
+		"G0 Z-0.4 ;travel",
+		"G90 ;absolute positioning",
+	}, "\n"), emitAll(codes))
+	assert.Equal(t, T1, p.Current())
+}
+
+func TestToolChangePlan(t *testing.T) {
+	p := newTestPlanner()
+	p.UsePurge, p.ZHop = false, 0
+	program := []Code{
+		AbsolutePositioning(), RelativeExtrusion(),
+		NewCode("G1", "", Param{'X', "1"}),
+		NewCode("G1", "", Param{'X', "2"}),
+		NewCode("G1", "", Param{'X', "3"}),
+		ToolIdx(T1),
+		NewCode("G1", "", Param{'X', "4"}),
+		ToolIdx(T0),
+		ToolIdx(T0),
+	}
+	planned, err := p.Plan(program)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"G90 ;absolute positioning",
+		"M83 ;relative extrusion",
+		"G1 X1",
+		"M104 T1 S230 ;set tool temp",
+		"G1 X2",
+		"G1 X3",
+		"G1 E-2 F2400 ;retract",
+		"M104 T0 S170 ;set tool temp",
+		"T1 ;select tool",
+		"M109 T1 S230 ;wait for tool temp",
+		"G1 E1.5 F2400 ;prime",
+		// T0 can't be preheated before it was parked
+		"M104 T0 S210 ;set tool temp",
+		"G1 X4",
+		"G1 E-3 F2400 ;retract",
+		"M104 T1 S180 ;set tool temp",
+		"T0 ;select tool",
+		"M109 T0 S210 ;wait for tool temp",
+		"G1 E1 F2400 ;prime",
+	}, "\n"), emitAll(planned))
+
+	_, err = newTestPlanner().Plan([]Code{ToolIdx(3)})
+	assert.EqualError(t, err, "tool 3 is not configured")
+
+	// a failed plan forgets the tools and modes it went through
+	p = newTestPlanner()
+	p.Lookahead = 0
+	before := *p
+	_, err = p.Plan([]Code{RelativeExtrusion(), NewCode("G1", "", Param{'X', "1"}, Param{'Y', "2"}), ToolIdx(T1), ToolIdx(3)})
+	assert.EqualError(t, err, "code 4: tool 3 is not configured")
+	assert.Equal(t, before, *p)
+	assert.Equal(t, T0, p.Current())
+}
+
+func TestToolChangeApply(t *testing.T) {
+	r, writer := tearUp(t)
+	p := newTestPlanner()
+	p.UsePurge, p.ZHop, p.Lookahead = false, 0, 0
+	r.Queue(RelativeExtrusion(), ToolIdx(T1))
+	assert.Nil(t, p.Apply(&r))
+	assert.Nil(t, r.Execute())
+	assert.Equal(t, "M83\nG1 E-2 F2400\nM104 T0 S170\nT1\nM109 T1 S230\nG1 E1.5 F2400\n", writer.String())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// TramScrew is a bed adjustment screw and the point above it to measure.
+type TramScrew struct {
+	Name string  `json:"name"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+// TrammingConfig describes the bed's adjustment screws. Heights are
+// compared with the first screw, which is left alone.
+type TrammingConfig struct {
+	Screws          []TramScrew `json:"screws,omitempty"`
+	Pitch           float64     `json:"pitch,omitempty"`            // mm per turn, 0.5 for M3
+	ClockwiseRaises bool        `json:"clockwise_raises,omitempty"` // seen from above
+	Tolerance       float64     `json:"tolerance,omitempty"`        // mm
+	Clearance       float64     `json:"clearance,omitempty"`        // Z to travel at
+	Feed            float64     `json:"feed,omitempty"`             // mm/min
+	Passes          int         `json:"passes,omitempty"`           // give up after this many
+}
+
+func (c TrammingConfig) withDefaults() TrammingConfig {
+	if c.Pitch == 0 {
+		c.Pitch = 0.5
+	}
+	if c.Tolerance == 0 {
+		c.Tolerance = 0.02
+	}
+	if c.Clearance == 0 {
+		c.Clearance = 5
+	}
+	if c.Feed == 0 {
+		c.Feed = 3000
+	}
+	if c.Passes == 0 {
+		c.Passes = 5
+	}
+	return c
+}
+
+// Adjustment is how far to turn a screw to bring its corner level with
+// the reference screw; Offset is how much too high the corner is.
+type Adjustment struct {
+	Screw     TramScrew
+	Offset    float64
+	Turns     float64
+	Clockwise bool
+}
+
+func (a Adjustment) String() string {
+	direction := "anticlockwise"
+	if a.Clockwise {
+		direction = "clockwise"
+	}
+	minutes := int(math.Round(a.Turns * 60))
+	return fmt.Sprintf("%s: %+.3f mm, %.2f turns %s (%d:%02d)", a.Screw.Name, a.Offset, a.Turns, direction, minutes/60, minutes%60)
+}
+
+// Adjustments works out the turns for each screw from the heights
+// measured above them, skipping those within tolerance.
+func (c TrammingConfig) Adjustments(heights []float64) []Adjustment {
+	c = c.withDefaults()
+	adjustments := make([]Adjustment, 0, len(heights))
+	for idx := 1; idx < len(heights) && idx < len(c.Screws); idx++ {
+		offset := heights[idx] - heights[0]
+		if math.Abs(offset) <= c.Tolerance {
+			continue
+		}
+		// a high corner needs lowering
+		clockwise := (offset > 0) != c.ClockwiseRaises
+		adjustments = append(adjustments, Adjustment{c.Screws[idx], offset, math.Abs(offset) / c.Pitch, clockwise})
+	}
+	return adjustments
+}
+
+var probeRe = regexp.MustCompile(`Bed X:\s*(-?[\d.]+)\s+Y:\s*(-?[\d.]+)\s+Z:\s*(-?[\d.]+)`)
+
+// ParseProbe finds the height in a G30 reply such as
+// "Bed X: 30.00 Y: 30.00 Z: 0.12".
+func ParseProbe(lines []string) (float64, error) {
+	for _, line := range lines {
+		if match := probeRe.FindStringSubmatch(line); match != nil {
+			return strconv.ParseFloat(match[3], 64)
+		}
+	}
+	return 0, errors.New("no probe result in the printer's reply")
+}
+
+func (c TrammingConfig) visit(screw TramScrew) []Code {
+	feed := FloatParam('F', c.Feed)
+	return []Code{
+		Travel(FloatParam('Z', c.Clearance), feed),
+		Travel(FloatParam('X', screw.X), FloatParam('Y', screw.Y), feed),
+	}
+}
+
+// Tram walks the user through levelling the bed screws. With a probe
+// each pass measures every screw and reports the turns needed until all
+// are within tolerance; without one the nozzle is lowered over each
+// screw for the paper test, until a pass needs no adjustment.
+func Tram(ctx Context, probe bool) error {
+	config := ctx.Profile.Tramming.withDefaults()
+	if len(config.Screws) < 2 {
+		return errors.New("the profile has fewer than two tramming screws")
+	}
+	if err := sendCodes(ctx, AbsolutePositioning(), Home()); err != nil {
+		return err
+	}
+	for pass := 1; pass <= config.Passes; pass++ {
+		if !probe {
+			adjusted := false
+			for _, screw := range config.Screws {
+				if err := sendCodes(ctx, append(config.visit(screw), Travel(FloatParam('Z', 0)))...); err != nil {
+					return err
+				}
+				answer, err := prompt(ctx, fmt.Sprintf("Adjust %s until the paper just drags, then press enter (y if it already did, q to stop)", screw.Name))
+				if err != nil || stopped(answer) {
+					return err
+				}
+				adjusted = adjusted || !confirmed(answer)
+			}
+			if !adjusted {
+				ctx.User.WriteString("Bed is trammed")
+				return sendCodes(ctx, Travel(FloatParam('Z', config.Clearance)))
+			}
+		} else {
+			heights := make([]float64, len(config.Screws))
+			for idx, screw := range config.Screws {
+				if err := sendCodes(ctx, config.visit(screw)...); err != nil {
+					return err
+				}
+				reply, err := queryCode(ctx, ProbeAt(screw.X, screw.Y), ctx.Timeout)
+				if err != nil {
+					return err
+				}
+				if heights[idx], err = ParseProbe(reply); err != nil {
+					return fmt.Errorf("%s: %s", screw.Name, err)
+				}
+			}
+			adjustments := config.Adjustments(heights)
+			if len(adjustments) == 0 {
+				ctx.User.WriteString(fmt.Sprintf("Bed is trammed to within %.3f mm", config.Tolerance))
+				return sendCodes(ctx, Travel(FloatParam('Z', config.Clearance)))
+			}
+			ctx.User.WriteString(fmt.Sprintf("Pass %d, relative to %s:", pass, config.Screws[0].Name))
+			for _, adjustment := range adjustments {
+				ctx.User.WriteString("  " + adjustment.String())
+			}
+		}
+		answer, err := prompt(ctx, "Check again? (enter to continue, q to stop)")
+		if err != nil || stopped(answer) {
+			return err
+		}
+	}
+	return fmt.Errorf("bed not trammed after %d passes", config.Passes)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testScrews = []TramScrew{{"front left", 30, 30}, {"front right", 200, 30}, {"back right", 200, 200}}
+
+func TestTrammingAdjustments(t *testing.T) {
+	config := TrammingConfig{Screws: testScrews}
+	adjustments := config.Adjustments([]float64{0.1, 0.35, 0.11})
+	assert.Equal(t, 1, len(adjustments))
+	assert.Equal(t, "front right", adjustments[0].Screw.Name)
+	assert.InDelta(t, 0.5, adjustments[0].Turns, 1e-9)
+	assert.True(t, adjustments[0].Clockwise)
+	assert.Equal(t, "front right: +0.250 mm, 0.50 turns clockwise (0:30)", adjustments[0].String())
+
+	config.ClockwiseRaises = true
+	adjustments = config.Adjustments([]float64{0.1, 0.35, -0.2})
+	assert.False(t, adjustments[0].Clockwise)
+	assert.True(t, adjustments[1].Clockwise)
+	assert.Equal(t, "back right: -0.300 mm, 0.60 turns clockwise (0:36)", adjustments[1].String())
+}
+
+func TestParseProbe(t *testing.T) {
+	height, err := ParseProbe([]string{"echo:busy: processing", "Bed X: 30.00 Y: 30.00 Z: -0.12"})
+	assert.Nil(t, err)
+	assert.Equal(t, -0.12, height)
+	_, err = ParseProbe([]string{"Error:Probing Failed"})
+	assert.NotNil(t, err)
+}
+
+func TestTramWithProbe(t *testing.T) {
+	// the first pass finds the front right corner high, the second level
+	heights := []float64{0, 0.1, 0.01, 0, 0, 0}
+	probes := 0
+	ctx, ui, received := newSimulatedContext(t, func(line string) []string {
+		if strings.HasPrefix(line, "G30") {
+			probes++
+			return []string{fmt.Sprintf("Bed X: 0 Y: 0 Z: %.3f", heights[probes-1]), "ok"}
+		}
+		return []string{"ok"}
+	})
+	ctx.Profile.Tramming = TrammingConfig{Screws: testScrews}
+
+	ui.Commands() <- Command{"", ui}
+	assert.Nil(t, Tram(ctx, true))
+	assert.Contains(t, ui.Lines(), "  front right: +0.100 mm, 0.20 turns clockwise (0:12)")
+	assert.Contains(t, ui.Lines(), "Bed is trammed to within 0.020 mm")
+	assert.Equal(t, []string{"G90", "G28", "G0 Z5 F3000", "G0 X30 Y30 F3000", "G30 X30 Y30"}, received()[:5])
+}
+
+func TestTramStops(t *testing.T) {
+	ui := newTestUserInterface()
+	ctx := Context{User: ui, Remote: make(chan string, 32), Timeout: time.Second, Profile: NewProfile()}
+	ctx.Profile.Tramming = TrammingConfig{Screws: testScrews}
+
+	ui.Commands() <- Command{"", ui}
+	ui.Commands() <- Command{"q", ui}
+	assert.Nil(t, Tram(ctx, false))
+	assert.Equal(t, []string{"G90", "G28", "G0 Z5 F3000", "G0 X30 Y30 F3000", "G0 Z0", "G0 Z5 F3000", "G0 X200 Y30 F3000", "G0 Z0"}, drainRemote(ctx))
+
+	// every corner already right on the second pass
+	for _, answer := range []string{"", "y", "y", "", "y", "y", "Y"} {
+		ui.Commands() <- Command{answer, ui}
+	}
+	assert.Nil(t, Tram(ctx, false))
+	assert.Contains(t, ui.Lines(), "Bed is trammed")
+	sent := drainRemote(ctx)
+	assert.Equal(t, 2+2*3*3+1, len(sent))
+	assert.Equal(t, "G0 Z5", sent[len(sent)-1])
+
+	ctx.Profile.Tramming.Screws = testScrews[:1]
+	assert.NotNil(t, Tram(ctx, false))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math"
 
 	tui "github.com/marcusolsson/tui-go"
 )
@@ -72,15 +74,21 @@ func NewTUIUserInterface() *TUIUserInterface {
 		log.Fatal(err)
 	}
 
+	theme := tui.NewTheme()
+	for level, colour := range []tui.Color{tui.ColorBlue, tui.ColorCyan, tui.ColorGreen, tui.ColorYellow, tui.ColorRed} {
+		theme.SetStyle(fmt.Sprintf("label.mesh%d", level), tui.Style{Fg: tui.ColorBlack, Bg: colour})
+	}
+	tuiui.SetTheme(theme)
+
 	ui.Tui = tuiui
-	ui.Tui.SetKeybinding("Esc", func() { *ui.commands <- "quit" })
+	ui.Tui.SetKeybinding("Esc", func() { *ui.commands <- Command{"quit", ui} })
+	// the emergency stop can't wait for the command running to finish
+	ui.Tui.SetKeybinding("Ctrl+X", func() { go ui.submit(Command{"estop", ui}) })
 	ui.entry = entry
 	ui.scrollback = scrollback
 
 	entry.OnSubmit(func(e *tui.Entry) {
-		if ui.commands != nil {
-			*ui.commands <- e.Text()
-		}
+		ui.submit(Command{e.Text(), ui})
 		e.SetText("")
 	})
 
@@ -90,3 +98,23 @@ func NewTUIUserInterface() *TUIUserInterface {
 func (u *TUIUserInterface) Error(text string) {
 	u.WriteString("** ERR: " + text)
 }
+
+// ShowMesh draws the mesh as a heatmap, one styled label per point.
+func (u TUIUserInterface) ShowMesh(mesh *Mesh) {
+	stats := mesh.Stats()
+	for y := len(mesh.Points) - 1; y >= 0; y-- {
+		row := tui.NewHBox(tui.NewLabel(fmt.Sprintf("%2d ", y)))
+		for _, value := range mesh.Points[y] {
+			text := "    .   "
+			if !math.IsNaN(value) {
+				text = fmt.Sprintf(" %+.3f ", value)
+			}
+			cell := tui.NewLabel(text)
+			cell.SetStyleName(fmt.Sprintf("mesh%d", stats.Level(value)))
+			row.Append(cell)
+		}
+		row.Append(tui.NewSpacer())
+		u.scrollback.Append(row)
+	}
+	u.WriteString(stats.String())
+}
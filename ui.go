@@ -1,8 +1,22 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Command is a line of input along with the interface it was entered on,
+// so that replies and errors can be routed back to the right session.
+type Command struct {
+	Text string
+	User UserInterfacer
+}
+
 type UserInterfacer interface {
 	Close()
-	Commands() chan string
+	Commands() chan Command
 	Start()
 	Write(text []byte) (count int, err error)
 	WriteString(text string)
@@ -10,15 +24,15 @@ type UserInterfacer interface {
 }
 
 type UserInterface struct {
-	output   chan string  // application -> user
-	commands *chan string // application <- user
+	output   chan string   // application -> user
+	commands *chan Command // application <- user
 }
 
 func (u UserInterface) Close() {
 	close(*u.commands)
 }
 
-func (u UserInterface) Commands() chan string {
+func (u UserInterface) Commands() chan Command {
 	return *u.commands
 }
 
@@ -26,6 +40,87 @@ func (u *UserInterface) Start() {
 	if u.commands != nil {
 		panic("Interface command channel already created")
 	}
-	commands := make(chan string, 200)
+	commands := make(chan Command, 200)
 	u.commands = &commands
 }
+
+var (
+	urgentMutex sync.Mutex
+	urgent      func(cmd Command) bool
+)
+
+// SetUrgent installs the handler given every line of input before it's
+// queued. It returns true for input it has dealt with, such as an
+// emergency stop that can't wait for the command in progress to finish.
+func SetUrgent(handler func(cmd Command) bool) {
+	urgentMutex.Lock()
+	defer urgentMutex.Unlock()
+	urgent = handler
+}
+
+func handleUrgent(cmd Command) bool {
+	urgentMutex.Lock()
+	handler := urgent
+	urgentMutex.Unlock()
+	return handler != nil && handler(cmd)
+}
+
+// submit queues a line of input for the application unless it was
+// urgent and has been handled already.
+func (u UserInterface) submit(cmd Command) {
+	if u.commands == nil || handleUrgent(cmd) {
+		return
+	}
+	*u.commands <- cmd
+}
+
+// prompt asks the user a question and returns the next line they enter,
+// which is taken as the answer rather than run as a command. Input from
+// other sessions meanwhile is queued again, to run once it's answered.
+func prompt(ctx Context, question string) (string, error) {
+	if _, ok := ctx.User.(*BatchUserInterface); ok {
+		return "", fmt.Errorf("can't ask '%s' in batch mode", question)
+	}
+	// input arrives on the host's channel, which a console under -listen
+	// is forwarded to; reading the console's own would race the forwarder
+	commands := ctx.User.Commands()
+	if ctx.Host != nil {
+		commands = ctx.Host.Commands()
+	}
+	ctx.User.WriteString("?? " + question)
+	deferred := make([]Command, 0, 4)
+	for cmd := range commands {
+		if cmd.User != ctx.User {
+			cmd.User.Error("Waiting for an answer from another session: '" + cmd.Text + "' will run after")
+			deferred = append(deferred, cmd)
+			continue
+		}
+		for _, cmd := range deferred {
+			select {
+			case commands <- cmd:
+			default:
+				cmd.User.Error("Too much input queued, dropped '" + cmd.Text + "'")
+			}
+		}
+		return strings.TrimSpace(cmd.Text), nil
+	}
+	return "", errors.New("interface closed while waiting for an answer")
+}
+
+// confirm asks a yes or no question.
+func confirm(ctx Context, question string) (bool, error) {
+	answer, err := prompt(ctx, question+" (y/n)")
+	return confirmed(answer), err
+}
+
+// confirmed reports whether a prompt answer means yes.
+func confirmed(answer string) bool {
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+// stopped reports whether a prompt answer means the user wants to stop.
+func stopped(answer string) bool {
+	answer = strings.ToLower(answer)
+	return answer == "q" || answer == "n" || answer == "no" || answer == "quit"
+}
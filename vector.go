@@ -0,0 +1,476 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlotConfig describes how drawings are turned into toolpaths for a pen
+// plotter, laser or drag knife; zero values take the defaults below.
+type PlotConfig struct {
+	Width      float64  `json:"width,omitempty"` // fit the drawing into this area, keeping its aspect
+	Height     float64  `json:"height,omitempty"`
+	Scale      float64  `json:"scale,omitempty"` // mm per drawing unit, when not fitting
+	X          float64  `json:"x,omitempty"`     // bottom left corner of the plot
+	Y          float64  `json:"y,omitempty"`
+	Tolerance  float64  `json:"tolerance,omitempty"` // mm curves may stray when flattened
+	Feed       float64  `json:"feed,omitempty"`      // mm/min while drawing
+	TravelFeed float64  `json:"travel_feed,omitempty"`
+	PenUp      []string `json:"pen_up,omitempty"` // codes to lift the pen, or turn the laser off
+	PenDown    []string `json:"pen_down,omitempty"`
+
+	Flatten     bool    `json:"flatten,omitempty"`      // lines only, no G2/G3
+	KnifeOffset float64 `json:"knife_offset,omitempty"` // mm the drag knife's blade trails its axis
+}
+
+func (c PlotConfig) withDefaults() PlotConfig {
+	if c.Scale == 0 {
+		c.Scale = 1
+	}
+	if c.Tolerance == 0 {
+		c.Tolerance = 0.05
+	}
+	if c.Feed == 0 {
+		c.Feed = 1500
+	}
+	if c.TravelFeed == 0 {
+		c.TravelFeed = 6000
+	}
+	if c.PenUp == nil {
+		c.PenUp = []string{"G0 Z2"}
+	}
+	if c.PenDown == nil {
+		c.PenDown = []string{"G1 Z0 F600"}
+	}
+	return c
+}
+
+type Point struct {
+	X, Y float64
+}
+
+func (p Point) add(q Point) Point             { return Point{p.X + q.X, p.Y + q.Y} }
+func (p Point) sub(q Point) Point             { return Point{p.X - q.X, p.Y - q.Y} }
+func (p Point) scale(s float64) Point         { return Point{p.X * s, p.Y * s} }
+func (p Point) length() float64               { return math.Hypot(p.X, p.Y) }
+func (p Point) lerp(q Point, t float64) Point { return p.add(q.sub(p).scale(t)) }
+
+type segmentKind int
+
+const (
+	lineSegment segmentKind = iota
+	cubicSegment
+	arcSegment
+)
+
+// segment continues a path from where the last one ended: a line, a
+// cubic bezier through two controls, or a circular arc about a centre
+// sweeping a signed angle (positive for increasing angles).
+type segment struct {
+	kind   segmentKind
+	to     Point
+	c1, c2 Point
+	centre Point
+	sweep  float64
+}
+
+// VectorPath is a connected run of segments, drawn without lifting the pen.
+type VectorPath struct {
+	Start    Point
+	Segments []segment
+	Closed   bool
+}
+
+func (p *VectorPath) End() Point {
+	if len(p.Segments) == 0 {
+		return p.Start
+	}
+	return p.Segments[len(p.Segments)-1].to
+}
+
+func (p *VectorPath) lineTo(to Point) {
+	p.Segments = append(p.Segments, segment{kind: lineSegment, to: to})
+}
+
+func (p *VectorPath) cubicTo(c1, c2, to Point) {
+	p.Segments = append(p.Segments, segment{kind: cubicSegment, c1: c1, c2: c2, to: to})
+}
+
+func (p *VectorPath) arcTo(centre Point, sweep float64, to Point) {
+	p.Segments = append(p.Segments, segment{kind: arcSegment, centre: centre, sweep: sweep, to: to})
+}
+
+// ellipseTo adds an elliptical arc, centred on centre with radii rx and
+// ry rotated by phi, from parametric angle start through sweep, as cubics
+// of at most 90° each.
+func (p *VectorPath) ellipseTo(centre Point, rx, ry, phi, start, sweep float64) {
+	pieces := int(math.Ceil(math.Abs(sweep) / (math.Pi / 2)))
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	at := func(x, y float64) Point {
+		return Point{centre.X + rx*x*cos - ry*y*sin, centre.Y + rx*x*sin + ry*y*cos}
+	}
+	step := sweep / float64(pieces)
+	k := 4.0 / 3 * math.Tan(step/4)
+	for piece := 0; piece < pieces; piece++ {
+		a1, a2 := start+step*float64(piece), start+step*float64(piece+1)
+		p.cubicTo(
+			at(math.Cos(a1)-k*math.Sin(a1), math.Sin(a1)+k*math.Cos(a1)),
+			at(math.Cos(a2)+k*math.Sin(a2), math.Sin(a2)-k*math.Cos(a2)),
+			at(math.Cos(a2), math.Sin(a2)),
+		)
+	}
+}
+
+// Reversed draws the path the other way round.
+func (p *VectorPath) Reversed() VectorPath {
+	reversed := VectorPath{Start: p.End(), Closed: p.Closed, Segments: make([]segment, 0, len(p.Segments))}
+	for idx := len(p.Segments) - 1; idx >= 0; idx-- {
+		seg := p.Segments[idx]
+		seg.to = p.Start
+		if idx > 0 {
+			seg.to = p.Segments[idx-1].to
+		}
+		seg.c1, seg.c2 = seg.c2, seg.c1
+		seg.sweep = -seg.sweep
+		reversed.Segments = append(reversed.Segments, seg)
+	}
+	return reversed
+}
+
+// affine maps x, y to a*x + c*y + e, b*x + d*y + f, as SVG's matrix().
+type affine [6]float64
+
+var identity = affine{1, 0, 0, 1, 0, 0}
+
+func (m affine) apply(p Point) Point {
+	return Point{m[0]*p.X + m[2]*p.Y + m[4], m[1]*p.X + m[3]*p.Y + m[5]}
+}
+
+// then is m followed by n.
+func (m affine) then(n affine) affine {
+	return affine{
+		n[0]*m[0] + n[2]*m[1], n[1]*m[0] + n[3]*m[1],
+		n[0]*m[2] + n[2]*m[3], n[1]*m[2] + n[3]*m[3],
+		n[0]*m[4] + n[2]*m[5] + n[4], n[1]*m[4] + n[3]*m[5] + n[5],
+	}
+}
+
+func (m affine) determinant() float64 {
+	return m[0]*m[3] - m[1]*m[2]
+}
+
+// similar reports whether m keeps circles circular.
+func (m affine) similar() bool {
+	const epsilon = 1e-9
+	return (math.Abs(m[0]-m[3]) < epsilon && math.Abs(m[1]+m[2]) < epsilon) ||
+		(math.Abs(m[0]+m[3]) < epsilon && math.Abs(m[1]-m[2]) < epsilon)
+}
+
+// transform maps a path; arcs that wouldn't stay circular become cubics.
+func (p *VectorPath) transform(m affine) VectorPath {
+	mapped := VectorPath{Start: m.apply(p.Start), Closed: p.Closed, Segments: make([]segment, 0, len(p.Segments))}
+	from := p.Start
+	for _, seg := range p.Segments {
+		switch {
+		case seg.kind == arcSegment && !m.similar():
+			radius := from.sub(seg.centre).length()
+			start := math.Atan2(from.Y-seg.centre.Y, from.X-seg.centre.X)
+			curves := VectorPath{}
+			curves.ellipseTo(seg.centre, radius, radius, 0, start, seg.sweep)
+			for _, curve := range curves.Segments {
+				curve.c1, curve.c2, curve.to = m.apply(curve.c1), m.apply(curve.c2), m.apply(curve.to)
+				mapped.Segments = append(mapped.Segments, curve)
+			}
+			// land exactly on the end point
+			mapped.Segments[len(mapped.Segments)-1].to = m.apply(seg.to)
+		default:
+			moved := segment{seg.kind, m.apply(seg.to), m.apply(seg.c1), m.apply(seg.c2), m.apply(seg.centre), seg.sweep}
+			if m.determinant() < 0 {
+				moved.sweep = -moved.sweep
+			}
+			mapped.Segments = append(mapped.Segments, moved)
+		}
+		from = seg.to
+	}
+	return mapped
+}
+
+// flattenCubic adds points along a bezier until every control is within
+// tolerance of the chord.
+func flattenCubic(points []Point, from Point, seg segment, tolerance float64, depth int) []Point {
+	chord := seg.to.sub(from)
+	distance := func(p Point) float64 {
+		if chord.length() == 0 {
+			return p.sub(from).length()
+		}
+		return math.Abs(chord.X*(p.Y-from.Y)-chord.Y*(p.X-from.X)) / chord.length()
+	}
+	if depth >= 16 || math.Max(distance(seg.c1), distance(seg.c2)) <= tolerance {
+		return append(points, seg.to)
+	}
+	// split at t = 0.5 with de Casteljau
+	ab, bc, cd := from.lerp(seg.c1, 0.5), seg.c1.lerp(seg.c2, 0.5), seg.c2.lerp(seg.to, 0.5)
+	abc, bcd := ab.lerp(bc, 0.5), bc.lerp(cd, 0.5)
+	mid := abc.lerp(bcd, 0.5)
+	points = flattenCubic(points, from, segment{kind: cubicSegment, c1: ab, c2: abc, to: mid}, tolerance, depth+1)
+	return flattenCubic(points, mid, segment{kind: cubicSegment, c1: bcd, c2: cd, to: seg.to}, tolerance, depth+1)
+}
+
+// flattenArc adds points along an arc, close enough that no chord strays
+// more than tolerance from it.
+func flattenArc(points []Point, from Point, seg segment, tolerance float64) []Point {
+	radius := from.sub(seg.centre).length()
+	step := math.Pi / 2
+	if tolerance < radius {
+		step = math.Min(step, 2*math.Acos(1-tolerance/radius))
+	}
+	count := int(math.Max(1, math.Ceil(math.Abs(seg.sweep)/step)))
+	start := math.Atan2(from.Y-seg.centre.Y, from.X-seg.centre.X)
+	for idx := 1; idx < count; idx++ {
+		angle := start + seg.sweep*float64(idx)/float64(count)
+		points = append(points, Point{seg.centre.X + radius*math.Cos(angle), seg.centre.Y + radius*math.Sin(angle)})
+	}
+	return append(points, seg.to)
+}
+
+// Points flattens the path into a polyline.
+func (p *VectorPath) Points(tolerance float64) []Point {
+	points := []Point{p.Start}
+	from := p.Start
+	for _, seg := range p.Segments {
+		switch seg.kind {
+		case lineSegment:
+			points = append(points, seg.to)
+		case cubicSegment:
+			points = flattenCubic(points, from, seg, tolerance, 0)
+		case arcSegment:
+			points = flattenArc(points, from, seg, tolerance)
+		}
+		from = seg.to
+	}
+	return points
+}
+
+// Drawing is the paths read from a vector file, in the file's units.
+type Drawing struct {
+	Paths []VectorPath
+	YDown bool // SVG's y axis points down the page
+}
+
+// extremes are the points of an arc furthest along each axis, which
+// flattening would cut short.
+func extremes(from Point, seg segment) []Point {
+	radius := from.sub(seg.centre).length()
+	start := math.Atan2(from.Y-seg.centre.Y, from.X-seg.centre.X)
+	low, high := math.Min(start, start+seg.sweep), math.Max(start, start+seg.sweep)
+	points := make([]Point, 0, 4)
+	for quarter := math.Ceil(low / (math.Pi / 2)); quarter*math.Pi/2 <= high; quarter++ {
+		angle := quarter * math.Pi / 2
+		points = append(points, Point{seg.centre.X + radius*math.Cos(angle), seg.centre.Y + radius*math.Sin(angle)})
+	}
+	return points
+}
+
+// bounds are the extent of the drawing, from its flattened paths.
+func (d *Drawing) bounds() (min, max Point) {
+	min, max = Point{math.Inf(1), math.Inf(1)}, Point{math.Inf(-1), math.Inf(-1)}
+	for _, path := range d.Paths {
+		points := path.Points(1e-3)
+		from := path.Start
+		for _, seg := range path.Segments {
+			if seg.kind == arcSegment {
+				points = append(points, extremes(from, seg)...)
+			}
+			from = seg.to
+		}
+		for _, point := range points {
+			min.X, min.Y = math.Min(min.X, point.X), math.Min(min.Y, point.Y)
+			max.X, max.Y = math.Max(max.X, point.X), math.Max(max.Y, point.Y)
+		}
+	}
+	return min, max
+}
+
+// fit maps the drawing onto the machine: scaled to fit the plot area or
+// by Scale, with y up and the bottom left corner at X, Y.
+func (d *Drawing) fit(config PlotConfig) []VectorPath {
+	min, max := d.bounds()
+	scale := config.Scale
+	if config.Width > 0 || config.Height > 0 {
+		scale = math.Inf(1)
+		if width := max.X - min.X; config.Width > 0 && width > 0 {
+			scale = config.Width / width
+		}
+		if height := max.Y - min.Y; config.Height > 0 && height > 0 {
+			scale = math.Min(scale, config.Height/height)
+		}
+		if math.IsInf(scale, 1) {
+			scale = config.Scale
+		}
+	}
+	m := affine{scale, 0, 0, scale, config.X - min.X*scale, config.Y - min.Y*scale}
+	if d.YDown {
+		m = affine{scale, 0, 0, -scale, config.X - min.X*scale, config.Y + max.Y*scale}
+	}
+	paths := make([]VectorPath, 0, len(d.Paths))
+	for _, path := range d.Paths {
+		paths = append(paths, path.transform(m))
+	}
+	return paths
+}
+
+// OrderPaths sorts paths to shorten the travel between them, greedily
+// drawing whichever end of the remaining paths is nearest next.
+func OrderPaths(paths []VectorPath, from Point) []VectorPath {
+	remaining := append([]VectorPath{}, paths...)
+	ordered := make([]VectorPath, 0, len(paths))
+	for len(remaining) > 0 {
+		best, reverse, nearest := 0, false, math.Inf(1)
+		for idx := range remaining {
+			if distance := remaining[idx].Start.sub(from).length(); distance < nearest {
+				best, reverse, nearest = idx, false, distance
+			}
+			if distance := remaining[idx].End().sub(from).length(); !remaining[idx].Closed && distance < nearest {
+				best, reverse, nearest = idx, true, distance
+			}
+		}
+		path := remaining[best]
+		if reverse {
+			path = path.Reversed()
+		}
+		ordered = append(ordered, path)
+		from = path.End()
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return ordered
+}
+
+// knife offsets a polyline for a drag knife, whose blade trails offset
+// behind its axis: the axis leads each point in the direction of cut, and
+// swivels about the corners to turn the blade.
+func knife(points []Point, offset, tolerance float64) []Point {
+	directions := make([]Point, 0, len(points))
+	kept := []Point{points[0]}
+	for _, point := range points[1:] {
+		delta := point.sub(kept[len(kept)-1])
+		if length := delta.length(); length > 1e-9 {
+			directions = append(directions, delta.scale(1/length))
+			kept = append(kept, point)
+		}
+	}
+	if len(directions) == 0 {
+		return points
+	}
+	cut := []Point{kept[0].add(directions[0].scale(offset))}
+	for idx, direction := range directions {
+		corner := kept[idx+1]
+		cut = append(cut, corner.add(direction.scale(offset)))
+		if idx+1 == len(directions) {
+			break
+		}
+		next := directions[idx+1]
+		sweep := math.Atan2(direction.X*next.Y-direction.Y*next.X, direction.X*next.X+direction.Y*next.Y)
+		cut = flattenArc(cut, cut[len(cut)-1], segment{kind: arcSegment, centre: corner, sweep: sweep, to: corner.add(next.scale(offset))}, tolerance)
+	}
+	return cut
+}
+
+// parseCodes reads the pen up and down sequences.
+func parseCodes(lines []string) ([]Code, error) {
+	codes := make([]Code, 0, len(lines))
+	for _, line := range lines {
+		code, err := ParseCode(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", line, err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Toolpaths draws each path with the pen down, travelling between them
+// with it up. Curves are flattened to within the tolerance, except for
+// circular arcs which are sent as G2/G3 unless flattening everything.
+func (d *Drawing) Toolpaths(config PlotConfig) ([]Code, error) {
+	config = config.withDefaults()
+	penUp, err := parseCodes(config.PenUp)
+	if err != nil {
+		return nil, err
+	}
+	penDown, err := parseCodes(config.PenDown)
+	if err != nil {
+		return nil, err
+	}
+	paths := OrderPaths(d.fit(config), Point{config.X, config.Y})
+	if len(paths) == 0 {
+		return nil, errors.New("nothing to draw")
+	}
+	xy := func(p Point) []Param {
+		return []Param{FloatParam('X', p.X), FloatParam('Y', p.Y)}
+	}
+	codes := append([]Code{NewCode("G21", "millimetres"), AbsolutePositioning()}, penUp...)
+	for _, path := range paths {
+		var points []Point
+		if config.KnifeOffset > 0 {
+			points = knife(path.Points(config.Tolerance), config.KnifeOffset, config.Tolerance)
+		}
+		start := path.Start
+		if points != nil {
+			start = points[0]
+		}
+		codes = append(codes, Travel(append(xy(start), FloatParam('F', config.TravelFeed))...))
+		codes = append(codes, penDown...)
+		feed := []Param{FloatParam('F', config.Feed)}
+
+		if points == nil && config.Flatten {
+			points = path.Points(config.Tolerance)
+		}
+		if points != nil {
+			for _, point := range points[1:] {
+				codes = append(codes, Move(append(xy(point), feed...)...))
+				feed = nil
+			}
+			codes = append(codes, penUp...)
+			continue
+		}
+		from := path.Start
+		for _, seg := range path.Segments {
+			switch seg.kind {
+			case arcSegment:
+				offset := seg.centre.sub(from)
+				params := append(xy(seg.to), FloatParam('I', offset.X), FloatParam('J', offset.Y))
+				codes = append(codes, Arc(seg.sweep < 0, append(params, feed...)...))
+				feed = nil
+			default:
+				flat := (&VectorPath{Start: from, Segments: []segment{seg}}).Points(config.Tolerance)
+				for _, point := range flat[1:] {
+					codes = append(codes, Move(append(xy(point), feed...)...))
+					feed = nil
+				}
+			}
+			from = seg.to
+		}
+		codes = append(codes, penUp...)
+	}
+	return codes, nil
+}
+
+// LoadDrawing reads an SVG or DXF file, by its extension.
+func LoadDrawing(path string) (*Drawing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".svg":
+		return ParseSVG(file)
+	case ".dxf":
+		return ParseDXF(file)
+	}
+	return nil, fmt.Errorf("%s: expected an .svg or .dxf file", path)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertNear(t *testing.T, expected, actual Point) {
+	t.Helper()
+	assert.InDelta(t, expected.X, actual.X, 1e-9)
+	assert.InDelta(t, expected.Y, actual.Y, 1e-9)
+}
+
+func TestToolpaths(t *testing.T) {
+	drawing, err := ParseSVG(strings.NewReader(`<svg xmlns="http://www.w3.org/2000/svg">
+		<defs><rect width="100" height="100"/></defs>
+		<circle cx="30" cy="5" r="5"/>
+		<line x1="0" y1="0" x2="10" y2="0"/>
+	</svg>`))
+	assert.Nil(t, err)
+	codes, err := drawing.Toolpaths(PlotConfig{})
+	assert.Nil(t, err)
+	// y is flipped, so the circle drawn with increasing angles on the
+	// page is clockwise on the machine
+	assert.Equal(t, `G21 ;millimetres
+G90 ;absolute positioning
+G0 Z2
+G0 X0 Y10 F6000 ;travel
+G1 Z0 F600
+G1 X10 Y10 F1500 ;move
+G0 Z2
+G0 X35 Y5 F6000 ;travel
+G1 Z0 F600
+G2 X35 Y5 I-5 J0 F1500 ;clockwise arc
+G0 Z2`, emitAll(codes))
+
+	config := PlotConfig{Width: 70, Height: 100, X: 10, Y: 10, Flatten: true, PenUp: []string{"M5"}, PenDown: []string{"M3 S1000"}}
+	codes, err = drawing.Toolpaths(config)
+	assert.Nil(t, err)
+	for _, code := range codes {
+		assert.NotEqual(t, "G2", code.GCode)
+		if x, ok := code.Float('X'); ok {
+			assert.True(t, x >= 10 && x <= 80, code.Emit(0))
+		}
+		if y, ok := code.Float('Y'); ok {
+			assert.True(t, y >= 10 && y <= 30, code.Emit(0))
+		}
+	}
+	assert.Equal(t, "M3 S1000", codes[4].Emit(0))
+
+	_, err = drawing.Toolpaths(PlotConfig{PenUp: []string{"2 Z"}})
+	assert.EqualError(t, err, "2 Z: Not a G-code: 2 Z")
+}
+
+func TestParsePathData(t *testing.T) {
+	paths, err := ParsePathData("M0 0L10-5.5.5.5zm1 1h2v2")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(paths))
+	assert.True(t, paths[0].Closed)
+	assert.Equal(t, []Point{{0, 0}, {10, -5.5}, {0.5, 0.5}, {0, 0}}, paths[0].Points(0.1))
+	assert.False(t, paths[1].Closed)
+	assert.Equal(t, []Point{{1, 1}, {3, 1}, {3, 3}}, paths[1].Points(0.1))
+
+	paths, err = ParsePathData("M10 0 A10 10 0 0 1 0 10")
+	assert.Nil(t, err)
+	arc := paths[0].Segments[0]
+	assert.Equal(t, arcSegment, arc.kind)
+	assertNear(t, Point{0, 0}, arc.centre)
+	assert.InDelta(t, math.Pi/2, arc.sweep, 1e-9)
+
+	// elliptical arcs and quadratics become cubics, flattened to tolerance
+	paths, err = ParsePathData("M0 0 A20 10 0 0 1 40 0 Q20 20 0 0")
+	assert.Nil(t, err)
+	points := paths[0].Points(0.01)
+	assert.True(t, len(points) > 10)
+	for _, point := range points {
+		if point.Y <= 0 {
+			ellipse := math.Pow((point.X-20)/20, 2) + math.Pow(point.Y/10, 2)
+			assert.InDelta(t, 1, ellipse, 0.01)
+		}
+	}
+	assertNear(t, Point{0, 0}, points[len(points)-1])
+
+	_, err = ParsePathData("L10 10")
+	assert.EqualError(t, err, "path data must start with a move, not L")
+	_, err = ParsePathData("M0 0 L10")
+	assert.EqualError(t, err, "expected a number at 8 in path data")
+}
+
+func TestSVGTransforms(t *testing.T) {
+	drawing, err := ParseSVG(strings.NewReader(`<svg>
+		<g transform="translate(10 0) scale(2)">
+			<line x1="1" y1="1" x2="2" y2="1" transform="rotate(90 1 1)"/>
+			<circle cx="0" cy="0" r="1" transform="skewX(30)"/>
+		</g>
+	</svg>`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(drawing.Paths))
+	assertNear(t, Point{12, 2}, drawing.Paths[0].Start)
+	assertNear(t, Point{12, 4}, drawing.Paths[0].End())
+	// a skewed circle is no longer circular
+	for _, seg := range drawing.Paths[1].Segments {
+		assert.Equal(t, cubicSegment, seg.kind)
+	}
+
+	_, err = ParseSVG(strings.NewReader(`<svg><line transform="spin(3)"/></svg>`))
+	assert.EqualError(t, err, "unknown transform spin")
+	_, err = ParseSVG(strings.NewReader(`<svg><text>hello</text></svg>`))
+	assert.EqualError(t, err, "no shapes in the SVG")
+}
+
+func TestOrderPaths(t *testing.T) {
+	line := func(x1, y1, x2, y2 float64) VectorPath {
+		path := VectorPath{Start: Point{x1, y1}}
+		path.lineTo(Point{x2, y2})
+		return path
+	}
+	ordered := OrderPaths([]VectorPath{line(50, 0, 60, 0), line(20, 0, 10, 0), line(21, 0, 49, 0)}, Point{0, 0})
+	// the second line is drawn backwards, starting from its nearer end
+	assert.Equal(t, []VectorPath{line(10, 0, 20, 0), line(21, 0, 49, 0), line(50, 0, 60, 0)}, ordered)
+}
+
+func TestKnife(t *testing.T) {
+	points := knife([]Point{{0, 0}, {10, 0}, {10, 10}}, 1, 0.01)
+	assert.Equal(t, Point{1, 0}, points[0])
+	assert.Equal(t, Point{11, 0}, points[1])
+	assertNear(t, Point{10, 11}, points[len(points)-1])
+	// the blade swivels about the corner
+	for _, point := range points[1 : len(points)-1] {
+		assert.InDelta(t, 1, point.sub(Point{10, 0}).length(), 1e-9)
+	}
+}
+
+func TestParseDXF(t *testing.T) {
+	dxf := strings.Join([]string{
+		"0", "SECTION", "2", "HEADER", "9", "$ACADVER", "1", "AC1015", "0", "ENDSEC",
+		"0", "SECTION", "2", "ENTITIES",
+		"0", "LINE", "8", "0", "10", "0", "20", "0", "11", "10", "21", "0",
+		"0", "LWPOLYLINE", "90", "2", "70", "0", "10", "0", "20", "10", "42", "1", "10", "10", "20", "10",
+		"0", "ARC", "10", "5", "20", "5", "40", "2", "50", "270", "51", "0",
+		"0", "SPLINE", "10", "0", "20", "0",
+		"0", "ENDSEC", "0", "EOF",
+	}, "\n")
+	drawing, err := ParseDXF(strings.NewReader(dxf))
+	assert.Nil(t, err)
+	assert.False(t, drawing.YDown)
+	assert.Equal(t, 3, len(drawing.Paths))
+	assert.Equal(t, []Point{{0, 0}, {10, 0}}, drawing.Paths[0].Points(0.1))
+
+	// a bulge of 1 is a counter-clockwise semicircle
+	semicircle := drawing.Paths[1].Segments[0]
+	assertNear(t, Point{5, 10}, semicircle.centre)
+	assert.InDelta(t, math.Pi, semicircle.sweep, 1e-9)
+
+	arc := drawing.Paths[2]
+	assertNear(t, Point{5, 3}, arc.Start)
+	assertNear(t, Point{7, 5}, arc.End())
+	assert.InDelta(t, math.Pi/2, arc.Segments[0].sweep, 1e-9)
+
+	_, err = ParseDXF(strings.NewReader("0\nSECTION\n2\nENTITIES\n0\nTEXT\n0\nENDSEC\n"))
+	assert.EqualError(t, err, "no lines, polylines, circles or arcs in the DXF (found TEXT)")
+	_, err = ParseDXF(strings.NewReader("zero\nSECTION\n"))
+	assert.EqualError(t, err, `line 1: bad group code "zero"`)
+}
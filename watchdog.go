@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watchdog actions, taken once when a check trips.
+const (
+	WatchdogAlert    = "alert"    // tell the user, nothing more
+	WatchdogPause    = "pause"    // M25 when printing from SD, otherwise stop sending until resumed
+	WatchdogAbort    = "abort"    // drop everything queued, leaving the heaters on
+	WatchdogCooldown = "cooldown" // stop sending and turn the heaters off
+	WatchdogEstop    = "estop"    // M112
+)
+
+// WatchdogConfig sets the thresholds of the host's safety checks, a
+// second line of defence behind the firmware's; zero values take the
+// defaults below and a negative period or count turns a check off.
+type WatchdogConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	HeatingPeriod    float64 `json:"heating_period,omitempty"`     // seconds a hotend has to rise by HeatingRise
+	BedHeatingPeriod float64 `json:"bed_heating_period,omitempty"` // the same for the bed and chamber
+	HeatingRise      float64 `json:"heating_rise,omitempty"`       // degrees
+	Hysteresis       float64 `json:"hysteresis,omitempty"`         // degrees below target that count as reached
+	MaxDrop          float64 `json:"max_drop,omitempty"`           // degrees below target, once reached, that trip
+
+	Silence      float64 `json:"silence,omitempty"` // seconds without a line while a reply is due
+	Resends      int     `json:"resends,omitempty"` // resend requests within ResendWindow that trip
+	ResendWindow float64 `json:"resend_window,omitempty"`
+
+	Action string `json:"action,omitempty"` // alert, pause, abort, cooldown or estop
+}
+
+func (c WatchdogConfig) withDefaults() WatchdogConfig {
+	if c.HeatingPeriod == 0 {
+		c.HeatingPeriod = 40
+	}
+	if c.BedHeatingPeriod == 0 {
+		c.BedHeatingPeriod = 120
+	}
+	if c.HeatingRise == 0 {
+		c.HeatingRise = 2
+	}
+	if c.Hysteresis == 0 {
+		c.Hysteresis = 4
+	}
+	if c.MaxDrop == 0 {
+		c.MaxDrop = 15
+	}
+	if c.Silence == 0 {
+		c.Silence = 30
+	}
+	if c.ResendWindow == 0 {
+		c.ResendWindow = 60
+	}
+	if c.Resends == 0 {
+		c.Resends = 10
+	}
+	if c.Action == "" {
+		c.Action = WatchdogCooldown
+	}
+	return c
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// heaterWatch follows a heater from when its target was set.
+type heaterWatch struct {
+	target  float64
+	since   time.Time // when it last rose by HeatingRise
+	from    float64   // and the temperature then
+	reached bool
+}
+
+// Watchdog follows everything the printer says and, when a heater looks
+// to be running away, the printer stops replying or lines keep being
+// corrupted, alerts the user and takes the configured action. It then
+// stays quiet until re-armed.
+type Watchdog struct {
+	config WatchdogConfig
+	ctx    Context
+	now    func() time.Time
+
+	mutex    sync.Mutex
+	armed    bool
+	heaters  map[string]*heaterWatch
+	lastLine time.Time
+	resends  []time.Time
+	cancel   func()
+	done     chan struct{}
+}
+
+func NewWatchdog(ctx Context, config WatchdogConfig) (*Watchdog, error) {
+	config = config.withDefaults()
+	switch config.Action {
+	case WatchdogAlert, WatchdogPause, WatchdogAbort, WatchdogCooldown, WatchdogEstop:
+	default:
+		return nil, fmt.Errorf("unknown watchdog action %q", config.Action)
+	}
+	return &Watchdog{
+		config:  config,
+		ctx:     ctx,
+		now:     time.Now,
+		armed:   !config.Disabled,
+		heaters: make(map[string]*heaterWatch),
+	}, nil
+}
+
+// Start watches the printer's lines, and checks for silence every second.
+func (w *Watchdog) Start() {
+	w.mutex.Lock()
+	w.lastLine = w.now()
+	w.done = make(chan struct{})
+	w.mutex.Unlock()
+	w.cancel = w.ctx.Printer.Watch(w.observe)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				w.checkSilence()
+			}
+		}
+	}()
+}
+
+func (w *Watchdog) Stop() {
+	w.cancel()
+	close(w.done)
+}
+
+// Arm turns the checks on, or off, starting them afresh.
+func (w *Watchdog) Arm(armed bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.armed = armed
+	w.heaters = make(map[string]*heaterWatch)
+	w.resends = nil
+	w.lastLine = w.now()
+}
+
+func (w *Watchdog) Armed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.armed
+}
+
+// observe checks one line from the printer. It runs on the reader.
+func (w *Watchdog) observe(line string) {
+	dialect := w.ctx.Printer.Dialect
+	now := w.now()
+	w.mutex.Lock()
+	w.lastLine = now
+	reason := ""
+	if dialect.Reply(line).Kind == ReplyResend && w.config.Resends > 0 {
+		w.resends = append(w.resends, now)
+		for len(w.resends) > 0 && now.Sub(w.resends[0]) > seconds(w.config.ResendWindow) {
+			w.resends = w.resends[1:]
+		}
+		if len(w.resends) >= w.config.Resends {
+			reason = fmt.Sprintf("%d resends within %v", len(w.resends), seconds(w.config.ResendWindow))
+		}
+	}
+	temps := dialect.ParseTemperatures(line)
+	heaters := make([]string, 0, len(temps))
+	for heater := range temps {
+		heaters = append(heaters, heater)
+	}
+	sort.Strings(heaters)
+	for _, heater := range heaters {
+		if problem := w.checkHeater(heater, temps[heater], now); problem != "" && reason == "" {
+			reason = problem
+		}
+	}
+	w.mutex.Unlock()
+	if reason != "" {
+		w.trip(reason)
+	}
+}
+
+// checkHeater looks for a heater that isn't heating as it should, or has
+// fallen away from its target, e.g. with a loose thermistor or heater
+// cartridge. The caller holds the mutex.
+func (w *Watchdog) checkHeater(heater string, temp Temperature, now time.Time) string {
+	if temp.Target <= 0 {
+		delete(w.heaters, heater)
+		return ""
+	}
+	reached := temp.Actual >= temp.Target-w.config.Hysteresis
+	watch, ok := w.heaters[heater]
+	if !ok || watch.target != temp.Target {
+		w.heaters[heater] = &heaterWatch{target: temp.Target, since: now, from: temp.Actual, reached: reached}
+		return ""
+	}
+	period := w.config.HeatingPeriod
+	if heater == "B" || heater == "C" {
+		period = w.config.BedHeatingPeriod
+	}
+	switch {
+	case watch.reached && temp.Target-temp.Actual > w.config.MaxDrop && w.config.MaxDrop > 0:
+		return fmt.Sprintf("%s dropped to %.1f, %.1f below its target", heater, temp.Actual, temp.Target-temp.Actual)
+	case watch.reached:
+	case reached:
+		watch.reached = true
+	case temp.Actual >= watch.from+w.config.HeatingRise:
+		watch.since, watch.from = now, temp.Actual
+	case now.Sub(watch.since) > seconds(period) && period > 0:
+		return fmt.Sprintf("%s not heating: %.1f, having risen less than %g in %v", heater, temp.Actual, w.config.HeatingRise, seconds(period))
+	}
+	return ""
+}
+
+// checkSilence trips when the printer owes us a reply but hasn't said
+// anything for too long.
+func (w *Watchdog) checkSilence() {
+	if w.config.Silence <= 0 || w.ctx.Printer.Idle() {
+		w.mutex.Lock()
+		w.lastLine = w.now()
+		w.mutex.Unlock()
+		return
+	}
+	w.mutex.Lock()
+	quiet := w.now().Sub(w.lastLine)
+	w.mutex.Unlock()
+	if quiet > seconds(w.config.Silence) {
+		w.trip(fmt.Sprintf("no reply from the printer for %v", quiet.Round(time.Second)))
+	}
+}
+
+// trip alerts the user and acts, once, until re-armed.
+func (w *Watchdog) trip(reason string) {
+	w.mutex.Lock()
+	if !w.armed {
+		w.mutex.Unlock()
+		return
+	}
+	w.armed = false
+	w.mutex.Unlock()
+	w.ctx.Host.Error(fmt.Sprintf("Watchdog: %s, taking action: %s", reason, w.config.Action))
+	w.ctx.Printer.emit(Event{EventError, "watchdog: " + reason})
+	go func() {
+		if err := w.act(); err != nil {
+			w.ctx.Host.Error("Watchdog: " + err.Error())
+		}
+	}()
+}
+
+func (w *Watchdog) act() error {
+	switch w.config.Action {
+	case WatchdogPause:
+		if w.ctx.Printer.SDStatus().Printing {
+			return sendCodes(w.ctx, SDPause())
+		}
+		// the queue is kept, to carry on with "watchdog resume"
+		w.ctx.Printer.Hold()
+		return nil
+	case WatchdogAbort:
+		// the job can't be resumed, but the print may yet be saved
+		w.ctx.Printer.Abort()
+		return nil
+	case WatchdogCooldown:
+		w.ctx.Printer.Abort()
+		return sendCodes(w.ctx, cooldownCodes(w.ctx.Printer.Temperatures())...)
+	case WatchdogEstop:
+		return w.ctx.Printer.Emergency(NewCode("M112", "emergency stop"))
+	}
+	return nil
+}
+
+// cooldownCodes turn off every heater the printer has reported, or the
+// hotend and bed if it hasn't reported any.
+func cooldownCodes(temps map[string]Temperature) []Code {
+	heaters := make([]string, 0, len(temps))
+	for heater := range temps {
+		heaters = append(heaters, heater)
+	}
+	sort.Strings(heaters)
+	codes := make([]Code, 0, len(heaters))
+	for _, heater := range heaters {
+		switch heater {
+		case "T":
+			codes = append(codes, HotendTemp(0))
+		case "B":
+			codes = append(codes, BedTemp(0))
+		case "C":
+			codes = append(codes, NewCode("M141", "set chamber temp", IntParam('S', 0)))
+		default:
+			if tool, err := strconv.ParseUint(strings.TrimPrefix(heater, "T"), 10, 8); err == nil && heater[0] == 'T' {
+				codes = append(codes, ToolTemp(ToolId(tool), 0))
+			}
+		}
+	}
+	if len(codes) == 0 {
+		codes = append(codes, HotendTemp(0), BedTemp(0))
+	}
+	return codes
+}
+
+// Describe lists the thresholds, for the watchdog command.
+func (w *Watchdog) Describe() []string {
+	c := w.config
+	state := "armed"
+	if !w.Armed() {
+		state = "disarmed"
+	}
+	if w.ctx.Printer.Held() {
+		state += ", sending held until \"watchdog resume\""
+	}
+	return []string{
+		fmt.Sprintf("Watchdog %s, action: %s", state, c.Action),
+		fmt.Sprintf("  heating: rise %g within %v (bed and chamber %v)", c.HeatingRise, seconds(c.HeatingPeriod), seconds(c.BedHeatingPeriod)),
+		fmt.Sprintf("  reached within %g, tripping %g below target", c.Hysteresis, c.MaxDrop),
+		fmt.Sprintf("  silence: %v, resends: %d within %v", seconds(c.Silence), c.Resends, seconds(c.ResendWindow)),
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestWatchdog watches a printer simulated by respond, on a clock
+// the test moves with the function returned.
+func newTestWatchdog(t *testing.T, config WatchdogConfig, respond func(line string) []string) (*Watchdog, *testUserInterface, func() []string, func(time.Duration)) {
+	host, device := net.Pipe()
+	ui := newTestUserInterface()
+	remote := make(chan string, 4)
+	p := NewPrinter(host, ui, remote, 5*time.Second)
+	received := simulate(device, respond)
+	p.Start()
+	t.Cleanup(func() { p.Close() })
+
+	ctx := Context{Timeout: time.Second, User: ui, Host: ui, Remote: remote, Printer: p}
+	w, err := NewWatchdog(ctx, config)
+	assert.Nil(t, err)
+	clock := time.Now()
+	w.now = func() time.Time { return clock }
+	return w, ui, received, func(elapsed time.Duration) { clock = clock.Add(elapsed) }
+}
+
+func TestWatchdogHeating(t *testing.T) {
+	w, ui, _, advance := newTestWatchdog(t, WatchdogConfig{Action: WatchdogAlert}, func(line string) []string { return []string{"ok"} })
+
+	// rising slowly, but steadily enough
+	for temp := 20.0; temp <= 30; temp += 2 {
+		w.observe(m105Reply(temp, 200, 60, 60))
+		advance(30 * time.Second)
+	}
+	assert.True(t, w.Armed())
+	// then stuck for longer than the heating period
+	advance(15 * time.Second)
+	w.observe(m105Reply(31, 200, 60, 60))
+	assert.False(t, w.Armed())
+	assert.Equal(t, []string{"Watchdog: T not heating: 31.0, having risen less than 2 in 40s, taking action: alert"}, ui.Errors())
+
+	// the bed reached its target then fell away
+	w.Arm(true)
+	w.observe(m105Reply(200, 200, 60, 60))
+	w.observe(m105Reply(200, 200, 50, 60))
+	assert.True(t, w.Armed())
+	w.observe(m105Reply(200, 200, 44, 60))
+	assert.False(t, w.Armed())
+	assert.Equal(t, "Watchdog: B dropped to 44.0, 16.0 below its target, taking action: alert", ui.Errors()[1])
+
+	// a new target starts afresh, and heaters turned off are forgotten
+	w.Arm(true)
+	w.observe(m105Reply(200, 200, 44, 0))
+	w.observe(m105Reply(150, 250, 44, 0))
+	advance(time.Minute)
+	w.observe(m105Reply(160, 250, 44, 0))
+	assert.True(t, w.Armed())
+}
+
+// m105Reply reports a hotend and bed.
+func m105Reply(hotend, hotendTarget, bed, bedTarget float64) string {
+	return fmt.Sprintf("ok T:%.1f /%.1f B:%.1f /%.1f", hotend, hotendTarget, bed, bedTarget)
+}
+
+func TestWatchdogResendsAndSilence(t *testing.T) {
+	w, ui, received, advance := newTestWatchdog(t, WatchdogConfig{Resends: 3, ResendWindow: 10, Action: WatchdogCooldown}, func(line string) []string {
+		if line == "G28" {
+			return nil
+		}
+		return []string{"ok"}
+	})
+
+	w.observe("Resend: 5")
+	advance(11 * time.Second)
+	w.observe("Resend: 6")
+	w.observe("Resend: 7")
+	assert.True(t, w.Armed())
+	w.observe("Resend: 8")
+	assert.False(t, w.Armed())
+	assert.Equal(t, []string{"Watchdog: 3 resends within 10s, taking action: cooldown"}, ui.Errors())
+	// no temperatures yet, so everything is turned off
+	waitFor(t, func() bool { return len(received()) == 2 })
+	assert.Equal(t, []string{"M104 S0", "M140 S0"}, received())
+
+	// nothing is owed while idle, however long it's quiet
+	w.Arm(true)
+	advance(time.Hour)
+	w.checkSilence()
+	assert.True(t, w.Armed())
+	w.ctx.Remote <- "G28"
+	waitFor(t, func() bool { return len(received()) == 3 })
+	advance(20 * time.Second)
+	w.checkSilence()
+	assert.True(t, w.Armed())
+	advance(20 * time.Second)
+	w.checkSilence()
+	assert.False(t, w.Armed())
+	assert.Equal(t, "Watchdog: no reply from the printer for 40s, taking action: cooldown", ui.Errors()[1])
+	// the hung G28 is abandoned for the cooldown
+	waitFor(t, func() bool { return len(received()) == 5 })
+	assert.Equal(t, []string{"M104 S0", "M140 S0"}, received()[3:])
+}
+
+func TestWatchdogAbort(t *testing.T) {
+	w, ui, received, advance := newTestWatchdog(t, WatchdogConfig{Action: WatchdogAbort}, func(line string) []string {
+		if line == "G28" {
+			return nil
+		}
+		return []string{"ok"}
+	})
+
+	w.Arm(true)
+	w.ctx.Remote <- "G28"
+	waitFor(t, func() bool { return len(received()) == 1 })
+	advance(time.Minute)
+	w.checkSilence()
+	assert.Equal(t, []string{"Watchdog: no reply from the printer for 1m0s, taking action: abort"}, ui.Errors())
+	// the hung G28 is abandoned, and the heaters left alone
+	waitFor(t, w.ctx.Printer.Idle)
+	assert.Equal(t, []string{"G28"}, received())
+}
+
+func TestWatchdogPause(t *testing.T) {
+	w, ui, received, _ := newTestWatchdog(t, WatchdogConfig{Resends: 1, Action: WatchdogPause}, func(line string) []string {
+		if line == "M27" {
+			return []string{"SD printing byte 100/400", "ok"}
+		}
+		return []string{"ok"}
+	})
+	ctx := w.ctx
+	ctx.Watchdog = w
+
+	// nothing printing from SD, so the host stops sending
+	w.Arm(true)
+	w.observe("Resend: 5")
+	waitFor(t, w.ctx.Printer.Held)
+	ctx.Remote <- "G1 X10"
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, received())
+	assert.Contains(t, w.Describe()[0], `sending held until "watchdog resume"`)
+	dispatch(ctx, "watchdog resume")
+	waitFor(t, func() bool { return len(received()) == 1 })
+	assert.Equal(t, []string{"G1 X10"}, received())
+
+	// the printer pauses its own SD print
+	assert.Nil(t, sendRaw(ctx, "M27"))
+	waitFor(t, func() bool { return w.ctx.Printer.SDStatus().Printing })
+	w.Arm(true)
+	w.observe("Resend: 6")
+	waitFor(t, func() bool { return len(received()) == 3 })
+	assert.Equal(t, []string{"M27", "M25"}, received()[1:])
+	assert.False(t, w.ctx.Printer.Held())
+	assert.Len(t, ui.Errors(), 2)
+}
+
+func TestCooldownCodes(t *testing.T) {
+	codes := cooldownCodes(map[string]Temperature{"T": {}, "T0": {}, "T1": {}, "B": {}, "C": {}, "P": {}})
+	assert.Equal(t, `M140 S0 ;set bed temp
+M141 S0 ;set chamber temp
+M104 S0 ;set hotend temp
+M104 T0 S0 ;set tool temp
+M104 T1 S0 ;set tool temp`, emitAll(codes))
+
+	_, err := NewWatchdog(Context{}, WatchdogConfig{Action: "panic"})
+	assert.EqualError(t, err, `unknown watchdog action "panic"`)
+}